@@ -0,0 +1,250 @@
+// Package client embeds p2pftp transfers into Go programs. A Client starts
+// its own libp2p node, finds the target server in the DHT network and talks
+// to it directly, without the HTTP bridge of the connect daemon.
+//
+//	c, err := client.New(ctx,
+//		client.WithBootstrapPeers(bootstrapPeers...),
+//		client.WithTarget(serverID))
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	files, err := c.List(ctx, "/data")
+//
+// With WithEncryption, files are encrypted before Put and decrypted by Get,
+// so the server only stores ciphertext.
+//
+// Errors returned by Client methods are *Error, and can be checked against
+// kinds like ErrNotFound with errors.Is.
+package client
+
+import (
+	"context"
+	"io"
+	"path"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/crypt"
+	"github.com/leslie-wang/libp2p-ftp/node"
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+// Client talks to one remote p2pftp server
+type Client struct {
+	node   *node.Node
+	opts   options
+	cipher *crypt.Cipher
+}
+
+// New starts a node and connects to the target server
+func New(ctx context.Context, opts ...Option) (*Client, error) {
+	c := &Client{}
+	for _, opt := range opts {
+		if err := opt(&c.opts); err != nil {
+			return nil, err
+		}
+	}
+	if c.opts.conf.ServerID == "" {
+		return nil, ErrNoTarget
+	}
+	if c.opts.conf.Encryption != nil {
+		cipher, err := crypt.New(*c.opts.conf.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		c.cipher = cipher
+	}
+
+	n, err := node.StartNode(ctx, c.opts.privateKey, &c.opts.conf)
+	if err != nil {
+		return nil, err
+	}
+	err = n.FindPeer(ctx, c.opts.conf.ServerID)
+	for attempt := 0; err != nil && ctx.Err() == nil && attempt < c.opts.conf.RetryCount; attempt++ {
+		select {
+		case <-ctx.Done():
+		case <-time.After(c.opts.conf.RetryInterval):
+			err = n.FindPeer(ctx, c.opts.conf.ServerID)
+		}
+	}
+	if err != nil {
+		n.Close()
+		return nil, &Error{Op: "connect", Path: c.opts.conf.ServerID, Err: err}
+	}
+	c.node = n
+	return c, nil
+}
+
+// Close closes the underlying node
+func (c *Client) Close() error {
+	return c.node.Close()
+}
+
+// Node returns the underlying node
+func (c *Client) Node() *node.Node {
+	return c.node
+}
+
+// Ping checks the server is alive, and returns the round trip time
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if err := c.node.PingRequest(ctx); err != nil {
+		return 0, wrapError(ctx, "ping", "", err)
+	}
+	return time.Since(start), nil
+}
+
+// remotePath returns path of file on the server, which has encrypted names
+// if configured
+func (c *Client) remotePath(p string) string {
+	if c.cipher == nil {
+		return p
+	}
+	return c.cipher.EncryptPath(p)
+}
+
+// get writes content of remote file from offset on into w, decrypting it if
+// configured, and returns number of bytes written
+func (c *Client) get(w io.Writer, remote string, offset int64, request func(w io.Writer) (int64, error)) (int64, error) {
+	if c.cipher == nil || !c.cipher.Encrypted(remote) {
+		return request(w)
+	}
+	sw := crypt.NewSkipWriter(w, offset)
+	err := c.cipher.Download(remote, sw, 0, func(w io.Writer) error {
+		_, err := request(w)
+		return err
+	})
+	return sw.Written(), err
+}
+
+// List returns metadata of files under remote directory
+func (c *Client) List(ctx context.Context, dir string) ([]types.FileInfo, error) {
+	files, err := c.node.ListDetailRequest(ctx, c.remotePath(dir))
+	for i := range files {
+		c.cipher.DecryptInfo(dir, &files[i])
+	}
+	return files, wrapError(ctx, "list", dir, err)
+}
+
+// Stat returns metadata of one remote file
+func (c *Client) Stat(ctx context.Context, p string) (*types.FileInfo, error) {
+	info, err := c.node.StatRequest(ctx, c.remotePath(p))
+	if info != nil {
+		c.cipher.DecryptInfo(path.Dir(p), info)
+	}
+	return info, wrapError(ctx, "stat", p, err)
+}
+
+// Get writes content of remote file into w, and returns number of bytes
+// written
+func (c *Client) Get(ctx context.Context, remote string, w io.Writer) (int64, error) {
+	written, err := c.get(w, remote, 0, func(w io.Writer) (int64, error) {
+		return c.node.GetRequest(ctx, c.remotePath(remote), w)
+	})
+	return written, wrapError(ctx, "get", remote, err)
+}
+
+// GetRange writes content of remote file from offset on into w, and returns
+// number of bytes written
+func (c *Client) GetRange(ctx context.Context, remote string, offset int64, w io.Writer) (int64, error) {
+	written, err := c.get(w, remote, offset, func(w io.Writer) (int64, error) {
+		if c.cipher != nil && c.cipher.Encrypted(remote) {
+			// segments are authenticated in order, so encrypted files
+			// are always read from the start
+			return c.node.GetRequest(ctx, c.remotePath(remote), w)
+		}
+		return c.node.GetRangeRequest(ctx, remote, offset, w)
+	})
+	return written, wrapError(ctx, "get", remote, err)
+}
+
+// Versions returns previous versions of remote file, newest first
+func (c *Client) Versions(ctx context.Context, remote string) ([]types.FileInfo, error) {
+	versions, err := c.node.VersionsRequest(ctx, c.remotePath(remote))
+	for i := range versions {
+		c.cipher.DecryptInfo(path.Dir(remote), &versions[i])
+	}
+	return versions, wrapError(ctx, "versions", remote, err)
+}
+
+// GetVersion writes content of previous version of remote file into w, and
+// returns number of bytes written
+func (c *Client) GetVersion(ctx context.Context, remote, version string, w io.Writer) (int64, error) {
+	written, err := c.get(w, remote, 0, func(w io.Writer) (int64, error) {
+		return c.node.GetVersionRequest(ctx, c.remotePath(remote), version, w)
+	})
+	return written, wrapError(ctx, "get", remote, err)
+}
+
+// Restore makes previous version the current content of remote file
+func (c *Client) Restore(ctx context.Context, remote, version string) (*types.FileInfo, error) {
+	info, err := c.node.RestoreRequest(ctx, c.remotePath(remote), version)
+	if info != nil {
+		c.cipher.DecryptInfo(path.Dir(remote), info)
+	}
+	return info, wrapError(ctx, "restore", remote, err)
+}
+
+// Put uploads size bytes read from r as remote file
+func (c *Client) Put(ctx context.Context, remote string, r io.Reader, size int64) error {
+	r, size = c.cipher.Upload(remote, r, size)
+	return wrapError(ctx, "put", remote, c.node.PutRequest(ctx, r, size, c.remotePath(remote)))
+}
+
+// Delete removes remote file
+func (c *Client) Delete(ctx context.Context, p string) error {
+	return wrapError(ctx, "delete", p, c.node.DeleteRequest(ctx, c.remotePath(p)))
+}
+
+// Purge removes remote file permanently instead of into trash
+func (c *Client) Purge(ctx context.Context, p string) error {
+	return wrapError(ctx, "purge", p, c.node.PurgeRequest(ctx, c.remotePath(p)))
+}
+
+// Trash returns files deleted from under remote dir, newest first
+func (c *Client) Trash(ctx context.Context, dir string) ([]types.TrashEntry, error) {
+	entries, err := c.node.TrashRequest(ctx, c.remotePath(dir))
+	for i := range entries {
+		c.cipher.DecryptEntry(&entries[i])
+	}
+	return entries, wrapError(ctx, "trash", dir, err)
+}
+
+// Undelete moves trash entry back to the remote path it was deleted from
+func (c *Client) Undelete(ctx context.Context, remote, id string) (*types.FileInfo, error) {
+	info, err := c.node.UndeleteRequest(ctx, c.remotePath(remote), id)
+	if info != nil {
+		c.cipher.DecryptInfo(path.Dir(remote), info)
+	}
+	return info, wrapError(ctx, "undelete", remote, err)
+}
+
+// Mkdir creates remote directory and its parents
+func (c *Client) Mkdir(ctx context.Context, dir string) (*types.FileInfo, error) {
+	info, err := c.node.MkdirRequest(ctx, c.remotePath(dir))
+	if info != nil {
+		c.cipher.DecryptInfo(path.Dir(dir), info)
+	}
+	return info, wrapError(ctx, "mkdir", dir, err)
+}
+
+// Rename moves remote file or directory to newname
+func (c *Client) Rename(ctx context.Context, oldname, newname string) (*types.FileInfo, error) {
+	info, err := c.node.RenameRequest(ctx, c.remotePath(oldname), c.remotePath(newname))
+	if info != nil {
+		c.cipher.DecryptInfo(path.Dir(newname), info)
+	}
+	return info, wrapError(ctx, "rename", oldname, err)
+}
+
+// Quota returns storage usage and limits of this peer on the server
+func (c *Client) Quota(ctx context.Context) (*types.QuotaStatus, error) {
+	q, err := c.node.QuotaRequest(ctx)
+	return q, wrapError(ctx, "quota", "", err)
+}
+
+// Status returns network status of the server
+func (c *Client) Status(ctx context.Context) (*types.Status, error) {
+	s, err := c.node.StatusRequest(ctx)
+	return s, wrapError(ctx, "status", "", err)
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/leslie-wang/libp2p-ftp/node"
+)
+
+// Error kinds returned by Client methods. Use errors.Is to check them.
+var (
+	// ErrNotFound means the remote file does not exist
+	ErrNotFound = errors.New("file not found")
+	// ErrPermission means the remote peer refused to access the file
+	ErrPermission = errors.New("permission denied")
+	// ErrExist means the remote file already exists
+	ErrExist = errors.New("file already exists")
+	// ErrInvalidPath means the path is not usable for the operation
+	ErrInvalidPath = errors.New("invalid path")
+	// ErrNoTarget means no target peer is configured
+	ErrNoTarget = errors.New("no target peer")
+	// ErrQuota means the upload exceeds storage quota on the server
+	ErrQuota = errors.New("quota exceeded")
+)
+
+// Error describes a failed operation on remote peer
+type Error struct {
+	// Op is the operation, like list, get, put or delete
+	Op string
+	// Path is the remote path of the operation
+	Path string
+	// Kind is one of the Err* kinds, or nil if not classified
+	Kind error
+	// Err is the underlying error
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return e.Op + ": " + e.Err.Error()
+	}
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+// Is tells if target is the kind of error, so errors.Is matches kinds as
+// well as the chain of underlying errors
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// wrapError converts error of node into *Error
+func wrapError(ctx context.Context, op, p string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return &Error{Op: op, Path: p, Kind: KindOf(err), Err: err}
+}
+
+// reasons maps error reasons reported by remote peer onto error kinds
+var reasons = map[string]error{
+	"no such file or directory":       ErrNotFound,
+	"file does not exist":             ErrNotFound,
+	"permission denied":               ErrPermission,
+	"operation not permitted":         ErrPermission,
+	"file exists":                     ErrExist,
+	"file already exists":             ErrExist,
+	"directory not empty":             ErrExist,
+	"disk quota exceeded":             ErrQuota,
+	"please use absolute path":        ErrInvalidPath,
+	"remote path is not regular file": ErrInvalidPath,
+	"is a directory":                  ErrInvalidPath,
+	"not a directory":                 ErrInvalidPath,
+}
+
+// KindOf returns kind of err, which is either *Error or error of node, and
+// nil if it is unknown. Errors reported by remote peer are classified by
+// their reason only, which follows the path in their message.
+func KindOf(err error) error {
+	var e *Error
+	if errors.As(err, &e) && e.Kind != nil {
+		return e.Kind
+	}
+	if errors.Is(err, node.ErrNotAbsolute) {
+		return ErrInvalidPath
+	}
+	var remote *node.RemoteError
+	if !errors.As(err, &remote) {
+		return nil
+	}
+	reason := remote.Message
+	if i := strings.LastIndex(reason, ": "); i >= 0 {
+		reason = reason[i+2:]
+	}
+	reason = strings.ToLower(reason)
+	if strings.HasPrefix(reason, "no version ") {
+		return ErrNotFound
+	}
+	return reasons[reason]
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/leslie-wang/libp2p-ftp/node"
+)
+
+func TestKindOf(t *testing.T) {
+	for msg, want := range map[string]error{
+		"stat /docs/report.pdf: file does not exist":  ErrNotFound,
+		"open /not found.txt: permission denied":      ErrPermission,
+		"remove /permission denied: file exists":      ErrExist,
+		"remove /not allowed/x: directory not empty":  ErrExist,
+		"open /file exists: disk quota exceeded":      ErrQuota,
+		"open /a: no version 1546300800000000000":     ErrNotFound,
+		"open /dir: remote path is not regular file":  ErrInvalidPath,
+		"open /file does not exist: invalid offset 5": nil,
+		"trash is not enabled":                        nil,
+		"please use absolute path":                    ErrInvalidPath,
+	} {
+		if got := KindOf(&node.RemoteError{Message: msg}); got != want {
+			t.Errorf("%q got %v, want %v", msg, got, want)
+		}
+	}
+	if got := KindOf(errors.New("open /x: file does not exist")); got != nil {
+		t.Errorf("local error got %v", got)
+	}
+	if got := KindOf(node.ErrNotAbsolute); got != ErrInvalidPath {
+		t.Errorf("relative path got %v", got)
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	ctx := context.Background()
+	err := wrapError(ctx, "get", "/not allowed", &node.RemoteError{Message: "stat /not allowed: file does not exist"})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("%v is not ErrNotFound", err)
+	}
+	if errors.Is(err, ErrPermission) {
+		t.Errorf("%v is ErrPermission", err)
+	}
+	if got := KindOf(err); got != ErrNotFound {
+		t.Errorf("kind of wrapped error got %v", got)
+	}
+
+	// the underlying error stays reachable beside the kind
+	var remote *node.RemoteError
+	if !errors.As(err, &remote) || remote.Message != "stat /not allowed: file does not exist" {
+		t.Errorf("%v does not wrap the remote error", err)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = wrapError(cctx, "get", "/a", &node.RemoteError{Message: "stream reset"})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("%v is not context.Canceled", err)
+	}
+
+	err = wrapError(ctx, "ping", "", errors.New("stream reset"))
+	if err.Error() != "ping: stream reset" {
+		t.Errorf("error without path got %q", err.Error())
+	}
+	if err := wrapError(ctx, "ping", "", nil); err != nil {
+		t.Errorf("nil error got %v", err)
+	}
+}
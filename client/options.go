@@ -0,0 +1,88 @@
+package client
+
+import (
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+// Option configures a Client
+type Option func(*options) error
+
+type options struct {
+	privateKey string
+	conf       types.Config
+}
+
+// WithConfig takes bootstrap peers, target server, relays, client identity
+// and other network settings from conf. Options given later override them.
+func WithConfig(conf *types.Config) Option {
+	return func(o *options) error {
+		o.conf = *conf
+		if conf.ClientPrivateKey != "" {
+			o.privateKey = conf.ClientPrivateKey
+		}
+		return nil
+	}
+}
+
+// WithIdentity sets the base64 encoded private key of the client, a random
+// identity is used if not set
+func WithIdentity(privateKey string) Option {
+	return func(o *options) error {
+		o.privateKey = privateKey
+		return nil
+	}
+}
+
+// WithBootstrapPeers sets multiaddrs of bootstrap peers of the DHT network
+func WithBootstrapPeers(addrs ...string) Option {
+	return func(o *options) error {
+		o.conf.BootstrapNodes = addrs
+		return nil
+	}
+}
+
+// WithTarget sets the peer ID of the remote server
+func WithTarget(peerID string) Option {
+	return func(o *options) error {
+		o.conf.ServerID = peerID
+		return nil
+	}
+}
+
+// WithRelays sets multiaddrs of circuit relays used if the server cannot be
+// dialed directly
+func WithRelays(addrs ...string) Option {
+	return func(o *options) error {
+		o.conf.RelayNodes = addrs
+		return nil
+	}
+}
+
+// WithDatastoreDir sets the directory persisting known peers across runs
+func WithDatastoreDir(dir string) Option {
+	return func(o *options) error {
+		o.conf.DatastoreDir = dir
+		return nil
+	}
+}
+
+// WithRetry sets how many times and how long to wait between retries when
+// connecting to the server
+func WithRetry(count int, interval time.Duration) Option {
+	return func(o *options) error {
+		o.conf.RetryCount = count
+		o.conf.RetryInterval = interval
+		return nil
+	}
+}
+
+// WithEncryption encrypts files before upload and their names if configured,
+// with the base64 encoded 32 byte key of conf
+func WithEncryption(conf types.Encryption) Option {
+	return func(o *options) error {
+		o.conf.Encryption = &conf
+		return nil
+	}
+}
@@ -24,9 +24,12 @@ func main() {
 			"/ip4/128.199.219.111/tcp/4001/ipfs/QmSoLSafTMBsPKadTEgaXctDQVcqN88CNLHXMkTNwMKPnu",
 			"/ip4/178.62.158.247/tcp/4001/ipfs/QmSoLer265NRgSp2LA3dPaeykiS1J6DifTC88f5uVQKNAd",
 		},
-		RetryCount:    10,
-		RetryInterval: time.Minute,
-		HTTPListenPort: 8077,
+		RetryCount:         10,
+		RetryInterval:      time.Minute,
+		HTTPListenPort:     8077,
+		ConnMgrLowWater:    100,
+		ConnMgrHighWater:   400,
+		ConnMgrGracePeriod: 20 * time.Second,
 	}
 	// Set your own keypair
 	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
@@ -52,6 +55,40 @@ func main() {
 	}
 	conf.ServerID = peer.IDB58Encode(id)
 
+	// The relay needs an identity of its own
+	relayPriv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	relayBytes, err := crypto.MarshalPrivateKey(relayPriv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf.RelayPrivateKey = base64.StdEncoding.EncodeToString(relayBytes)
+
+	// The client gets a stable identity, which the listener allows
+	clientPriv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientBytes, err := crypto.MarshalPrivateKey(clientPriv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf.ClientPrivateKey = base64.StdEncoding.EncodeToString(clientBytes)
+	clientID, err := peer.IDFromPrivateKey(clientPriv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf.AllowedClients = []string{peer.IDB58Encode(clientID)}
+
+	// The CLI reads the token from the same config
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		log.Fatal(err)
+	}
+	conf.HTTP = &types.HTTP{Tokens: []string{base64.RawURLEncoding.EncodeToString(token)}}
+
 	f, err := os.Create("./conf.json")
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// nodeModeAuto uses the connect daemon if it is running, and starts an
+	// ephemeral node otherwise
+	nodeModeAuto = "auto"
+	// nodeModeDaemon always uses the connect daemon
+	nodeModeDaemon = "daemon"
+	// nodeModeEphemeral always starts an ephemeral node
+	nodeModeEphemeral = "ephemeral"
+)
+
+// nodeMode is set by --node
+var nodeMode = nodeModeAuto
+
+// daemonAddr returns network and address of the connect daemon's HTTP bridge
+func daemonAddr(conf *types.Config) (network, addr string) {
+	host := "localhost"
+	if conf.HTTP != nil {
+		if conf.HTTP.Socket != "" {
+			return "unix", conf.HTTP.Socket
+		}
+		if ip := net.ParseIP(conf.HTTP.ListenAddr); ip != nil && !ip.IsUnspecified() {
+			host = conf.HTTP.ListenAddr
+		}
+	}
+	return "tcp", net.JoinHostPort(host, fmt.Sprint(conf.HTTPListenPort))
+}
+
+// daemonURL returns base URL of the connect daemon's HTTP bridge
+func daemonURL(conf *types.Config) string {
+	scheme := "http"
+	if conf.HTTP != nil && conf.HTTP.CertFile != "" {
+		scheme = "https"
+	}
+	network, addr := daemonAddr(conf)
+	if network == "unix" {
+		// the host is not dialed but names the socket in errors
+		return scheme + "://unix"
+	}
+	return fmt.Sprintf("%s://%s", scheme, addr)
+}
+
+// queryURL returns URL of daemon route with query parameters escaped
+func queryURL(conf *types.Config, route string, query url.Values) string {
+	return daemonURL(conf) + route + "?" + query.Encode()
+}
+
+// daemonClient returns HTTP client of the connect daemon, which is started
+// in process as ephemeral node if no daemon is running, unless --node says
+// otherwise
+func daemonClient(ctx context.Context, conf *types.Config) (*http.Client, error) {
+	switch nodeMode {
+	case nodeModeEphemeral:
+		return ephemeralClient(ctx, conf)
+	case nodeModeAuto:
+		network, addr := daemonAddr(conf)
+		conn, err := net.DialTimeout(network, addr, time.Second)
+		if err != nil {
+			return ephemeralClient(ctx, conf)
+		}
+		conn.Close()
+	}
+	return runningDaemonClient(conf)
+}
+
+// runningDaemonClient returns HTTP client which dials the connect daemon's
+// socket and trusts its certificate, if configured
+func runningDaemonClient(conf *types.Config) (*http.Client, error) {
+	if conf.HTTP == nil || conf.HTTP.Socket == "" && conf.HTTP.CertFile == "" {
+		return http.DefaultClient, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if socket := conf.HTTP.Socket; socket != "" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+	}
+	if conf.HTTP.CertFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		cert, err := ioutil.ReadFile(conf.HTTP.CertFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(cert) {
+			return nil, errors.Errorf("no certificate in %s", conf.HTTP.CertFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+func httpRequest(conf *types.Config, url string) (*http.Response, error) {
+	return httpSend(conf, http.MethodGet, url)
+}
+
+// httpSend sends bodyless request with method, which routes changing remote
+// files require to be other than GET
+func httpSend(conf *types.Config, method, url string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return httpDo(conf, req)
+}
+
+// daemonHTTPClient is built once, so that a shell session reuses its
+// connections to the connect daemon
+var daemonHTTPClient struct {
+	sync.Once
+	client *http.Client
+	err    error
+}
+
+// httpDo sends request to the connect daemon with its token, and fails
+// unless it succeeds
+func httpDo(conf *types.Config, req *http.Request) (*http.Response, error) {
+	daemonHTTPClient.Do(func() {
+		daemonHTTPClient.client, daemonHTTPClient.err = daemonClient(req.Context(), conf)
+	})
+	client, err := daemonHTTPClient.client, daemonHTTPClient.err
+	if err != nil {
+		return nil, err
+	}
+	if conf.HTTP != nil && len(conf.HTTP.Tokens) > 0 {
+		req.Header.Set("Authorization", "Bearer "+conf.HTTP.Tokens[0])
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		// the REST API reports errors as JSON
+		reply := &types.Reply{}
+		if json.Unmarshal(data, reply) == nil && reply.Error != "" {
+			return nil, errors.New(reply.Error)
+		}
+		// replies to HEAD have no body
+		if len(data) == 0 {
+			return nil, errors.New(resp.Status)
+		}
+		return nil, fmt.Errorf("Non 200 reply: %s", string(data))
+	}
+	return resp, nil
+}
+
+// download saves body of GET url into file name, a partial file is removed
+// rather than left looking complete
+func download(conf *types.Config, url, name string) error {
+	resp, err := httpRequest(conf, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, resp.Body)
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = errors.Errorf("got %d of %d bytes", n, resp.ContentLength)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+// upload sends content of file name as body of PUT url
+func upload(conf *types.Config, url, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, url, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	resp, err := httpDo(conf, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
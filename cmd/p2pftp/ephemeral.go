@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/handler"
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/errors"
+	"github.com/whyrusleeping/go-logging"
+)
+
+// ephemeralLogLevel is the log level of ephemeral nodes, which only report
+// errors unless --verbose is given
+var ephemeralLogLevel = int(logging.ERROR)
+
+const (
+	// ephemeralAttempts is how often an ephemeral node tries to find the
+	// server, whose routing table may still be empty right after
+	// bootstrapping
+	ephemeralAttempts = 5
+	// ephemeralRetryDelay is the wait between the attempts
+	ephemeralRetryDelay = time.Second
+)
+
+// ephemeral is the connect daemon started in process, it is closed when the
+// command is done
+var ephemeral *handler.HTTPHandler
+
+// fixedPort matches port of listen multiaddr
+var fixedPort = regexp.MustCompile(`/(tcp|udp)/\d+`)
+
+// ephemeralConfig returns config of the ephemeral node. The node only dials
+// out, and may run beside a daemon with the same config, so it neither takes
+// the daemon's ports nor writes into its datastore.
+func ephemeralConfig(conf *types.Config) *types.Config {
+	c := *conf
+	c.ListenAddrs = nil
+	for _, addr := range conf.ListenAddrs {
+		c.ListenAddrs = append(c.ListenAddrs, fixedPort.ReplaceAllString(addr, "/$1/0"))
+	}
+	c.EnableNATPortMap = false
+	c.DatastoreDir = ""
+	return &c
+}
+
+// ephemeralClient starts the connect daemon in process and returns HTTP
+// client passing requests to it through in-memory pipes, so no port is
+// opened to other local users. Starting is given up when ctx is done, which
+// also stops the node.
+func ephemeralClient(ctx context.Context, conf *types.Config) (*http.Client, error) {
+	setLogLevel(ephemeralLogLevel)
+
+	h := handler.NewHTTPHandler(ephemeralConfig(conf))
+	err := h.Start(ctx)
+	for attempt := 1; err != nil && attempt < ephemeralAttempts; attempt++ {
+		select {
+		case <-ctx.Done():
+			h.Close()
+			return nil, errors.Wrap(ctx.Err(), "start ephemeral node")
+		case <-time.After(ephemeralRetryDelay):
+		}
+		err = h.Start(ctx)
+	}
+	if err != nil {
+		h.Close()
+		return nil, errors.Wrap(err, "start ephemeral node")
+	}
+	ephemeral = h
+
+	l := newPipeListener()
+	go http.Serve(l, h.Mux())
+	return &http.Client{Transport: &http.Transport{
+		DialContext: l.dial,
+		// the pipe needs no TLS, even if the daemon is configured with it
+		DialTLSContext: l.dial,
+	}}, nil
+}
+
+// closeEphemeral closes the ephemeral node, if one was started
+func closeEphemeral() {
+	if ephemeral != nil {
+		ephemeral.Close()
+	}
+}
+
+// pipeListener accepts connections dialed in process
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// dial returns client end of a new pipe, whose server end is accepted
+func (l *pipeListener) dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, errors.New("listener closed")
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "ephemeral" }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/server"
+	"github.com/leslie-wang/libp2p-ftp/storage"
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	host "github.com/libp2p/go-libp2p-host"
+)
+
+// p2pAddr returns IPv4 address of h with its peer ID
+func p2pAddr(t *testing.T, h host.Host) string {
+	for _, addr := range h.Addrs() {
+		if strings.HasPrefix(addr.String(), "/ip4/") {
+			return addr.String() + "/ipfs/" + h.ID().Pretty()
+		}
+	}
+	t.Fatalf("%s listens on no IPv4 address: %v", h.ID().Pretty(), h.Addrs())
+	return ""
+}
+
+// newTestServer serves memory storage on a new host, and returns config of
+// a client using it as both bootstrap node and server
+func newTestServer(t *testing.T) *types.Config {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	h, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	server.New(h, server.WithStorage(storage.NewMemory())).Register()
+
+	return &types.Config{
+		BootstrapNodes: []string{p2pAddr(t, h)},
+		ServerID:       h.ID().Pretty(),
+		ListenAddrs:    []string{"/ip4/127.0.0.1/tcp/0"},
+	}
+}
+
+func TestEphemeralConfig(t *testing.T) {
+	conf := &types.Config{
+		ListenAddrs:      []string{"/ip4/0.0.0.0/tcp/4001", "/ip4/0.0.0.0/tcp/4002/ws"},
+		EnableNATPortMap: true,
+		DatastoreDir:     "/var/lib/p2pftp",
+	}
+	c := ephemeralConfig(conf)
+	if got := strings.Join(c.ListenAddrs, ","); got != "/ip4/0.0.0.0/tcp/0,/ip4/0.0.0.0/tcp/0/ws" {
+		t.Fatalf("listen addresses %s", got)
+	}
+	if c.EnableNATPortMap || c.DatastoreDir != "" {
+		t.Fatalf("ephemeral config %+v", c)
+	}
+	if conf.DatastoreDir == "" || conf.ListenAddrs[0] != "/ip4/0.0.0.0/tcp/4001" {
+		t.Fatal("daemon config is changed")
+	}
+}
+
+func TestEphemeralClient(t *testing.T) {
+	conf := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := ephemeralClient(ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeEphemeral()
+
+	resp, err := client.Get(daemonURL(conf) + types.ConnectionURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("connection state got %s", resp.Status)
+	}
+}
+
+func TestEphemeralClientCancel(t *testing.T) {
+	// the bootstrap node is gone, so every attempt fails
+	conf := newTestServer(t)
+	conf.BootstrapNodes[0] = "/ip4/127.0.0.1/tcp/1/ipfs/" + conf.ServerID
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := ephemeralClient(ctx, conf); err == nil {
+		t.Fatal("ephemeral node is started without bootstrap node")
+	}
+	if elapsed := time.Since(start); elapsed >= ephemeralRetryDelay {
+		t.Fatalf("gave up after %v", elapsed)
+	}
+}
@@ -8,10 +8,17 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/leslie-wang/libp2p-ftp/handler"
+	"github.com/leslie-wang/libp2p-ftp/storage"
 	"github.com/leslie-wang/libp2p-ftp/types"
 
 	"github.com/pkg/errors"
@@ -43,6 +50,27 @@ func main() {
 			Usage: "log level: CRITICAL(0), ERROR(1), WARNING(2), NOTICE(3), INFO(4), DEBUG(5)",
 			Value: 4,
 		},
+		cli.StringFlag{
+			Name: "node",
+			Usage: "for commands on remote files, use the connect daemon (daemon), start an ephemeral node " +
+				"in process (ephemeral) or use the daemon if it is running (auto)",
+			Value: nodeModeAuto,
+		},
+	}
+	app.Before = func(ctx *cli.Context) error {
+		switch nodeMode = ctx.GlobalString("node"); nodeMode {
+		case nodeModeAuto, nodeModeDaemon, nodeModeEphemeral:
+		default:
+			return errors.Errorf("unknown node mode %s", nodeMode)
+		}
+		if ctx.GlobalIsSet("verbose") {
+			ephemeralLogLevel = ctx.GlobalInt("verbose")
+		}
+		return nil
+	}
+	app.After = func(ctx *cli.Context) error {
+		closeEphemeral()
+		return nil
 	}
 
 	app.Commands = []cli.Command{
@@ -50,11 +78,52 @@ func main() {
 			Name:   "listen",
 			Usage:  "listen as ftp server",
 			Action: listen,
+			Flags:  transportFlags,
 		},
 		{
 			Name:   "connect",
 			Usage:  "connect to remote peer",
 			Action: connect,
+			Flags:  transportFlags,
+		},
+		{
+			Name:   "relay",
+			Usage:  "run as circuit relay for peers behind NAT",
+			Action: relay,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "listen, l",
+					Usage: "multiaddr to listen on, can be repeated (default: /ip4/0.0.0.0/tcp/4001)",
+				},
+			},
+		},
+		{
+			Name:   "status",
+			Usage:  "show network status of connect daemon or remote peer",
+			Action: status,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "remote, r",
+					Usage: "show status of remote peer instead",
+				},
+			},
+		},
+		{
+			Name:   "gc",
+			Usage:  "remove unreferenced chunks of content addressed shares",
+			Action: gc,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "grace",
+					Usage: "keep chunks younger than this, must exceed the chunk refresh age of 12h by the longest upload",
+					Value: storage.DefaultGCGrace,
+				},
+			},
+		},
+		{
+			Name:   "quota",
+			Usage:  "show storage quota on remote peer",
+			Action: quota,
 		},
 		{
 			Name:      "list",
@@ -73,12 +142,59 @@ func main() {
 			ArgsUsage: "[remote filename] [local dir]",
 			Usage:     "get remote file",
 			Action:    get,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "version",
+					Usage: "get previous version instead, as shown by versions",
+				},
+			},
+		},
+		{
+			Name:      "versions",
+			ArgsUsage: "[remote filename]",
+			Usage:     "list previous versions of remote file",
+			Action:    versions,
+		},
+		{
+			Name:      "restore",
+			ArgsUsage: "[remote filename] [version]",
+			Usage:     "restore previous version of remote file",
+			Action:    restore,
 		},
 		{
 			Name:      "delete",
 			ArgsUsage: "[filename]",
 			Usage:     "delete remote file",
 			Action:    delete,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "permanent",
+					Usage: "delete permanently instead of into trash, if the server allows it",
+				},
+			},
+		},
+		{
+			Name:  "trash",
+			Usage: "list and restore deleted remote files",
+			Subcommands: []cli.Command{
+				{
+					Name:      "list",
+					ArgsUsage: "[remote dir]",
+					Usage:     "list files deleted from under remote dir",
+					Action:    trashList,
+				},
+				{
+					Name:      "restore",
+					ArgsUsage: "[remote filename] [id]",
+					Usage:     "move trash entry back to where it was deleted from",
+					Action:    trashRestore,
+				},
+			},
+		},
+		{
+			Name:   "shell",
+			Usage:  "run commands like cd, ls, get and put interactively",
+			Action: shellAction,
 		},
 	}
 
@@ -87,6 +203,29 @@ func main() {
 	}
 }
 
+// transportFlags override listen addresses and transports of config
+var transportFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "listen, l",
+		Usage: "multiaddr to listen on, like /ip4/0.0.0.0/tcp/4002/ws, can be repeated",
+	},
+	cli.StringSliceFlag{
+		Name:  "transport, t",
+		Usage: "enable only this transport, tcp or ws, can be repeated",
+	},
+}
+
+// applyTransportFlags sets listen addresses and transports given on command
+// line into conf
+func applyTransportFlags(ctx *cli.Context, conf *types.Config) {
+	if addrs := ctx.StringSlice("listen"); len(addrs) > 0 {
+		conf.ListenAddrs = addrs
+	}
+	if transports := ctx.StringSlice("transport"); len(transports) > 0 {
+		conf.Transports = transports
+	}
+}
+
 func loadConf(file string) (*types.Config, error) {
 	content, err := ioutil.ReadFile(file)
 	if err != nil {
@@ -103,15 +242,34 @@ func listen(ctx *cli.Context) error {
 		return err
 	}
 
+	applyTransportFlags(ctx, conf)
 	h := handler.NewNodeHandler(conf)
 	defer h.Close()
 
+	setLogLevel(ctx.GlobalInt("verbose"))
+
+	return h.Serve(signalContext())
+}
+
+// setLogLevel logs to stderr at level, see --verbose
+func setLogLevel(level int) {
 	backend := logging.NewLogBackend(os.Stderr, "", 0)
 	backendLeveled := logging.AddModuleLevel(backend)
-	backendLeveled.SetLevel(logging.Level(ctx.GlobalInt("verbose")), "")
+	backendLeveled.SetLevel(logging.Level(level), "")
 	logging.SetBackend(backendLeveled)
+}
 
-	return h.Serve(context.Background())
+// signalContext returns a context cancelled on SIGINT or SIGTERM
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Println("shutting down")
+		cancel()
+	}()
+	return ctx
 }
 
 func connect(ctx *cli.Context) error {
@@ -120,15 +278,134 @@ func connect(ctx *cli.Context) error {
 		return err
 	}
 
+	applyTransportFlags(ctx, conf)
 	h := handler.NewHTTPHandler(conf)
 	defer h.Close()
 
-	backend := logging.NewLogBackend(os.Stderr, "", 0)
-	backendLeveled := logging.AddModuleLevel(backend)
-	backendLeveled.SetLevel(logging.Level(ctx.GlobalInt("verbose")), "")
-	logging.SetBackend(backendLeveled)
+	setLogLevel(ctx.GlobalInt("verbose"))
+
+	return h.Serve(signalContext())
+}
+
+func relay(ctx *cli.Context) error {
+	conf, err := loadConf(ctx.GlobalString("conf"))
+	if err != nil {
+		return err
+	}
+
+	listenAddrs := ctx.StringSlice("listen")
+	if len(listenAddrs) == 0 {
+		listenAddrs = []string{"/ip4/0.0.0.0/tcp/4001"}
+	}
+	h := handler.NewRelayHandler(conf, listenAddrs)
+	defer h.Close()
+
+	setLogLevel(ctx.GlobalInt("verbose"))
+
+	return h.Serve(signalContext())
+}
+
+func status(cctx *cli.Context) error {
+	conf, err := loadConf(cctx.GlobalString("conf"))
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	if cctx.Bool("remote") {
+		query.Set(types.QueryKeyRemote, "true")
+	}
+	resp, err := httpRequest(conf, queryURL(conf, types.StatusURL, query))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	s := &types.Status{}
+	if err := json.NewDecoder(resp.Body).Decode(s); err != nil {
+		return err
+	}
+
+	fmt.Printf("Peer ID: %s\n", s.ID)
+	fmt.Printf("Behind NAT: %v\n", s.BehindNAT)
+	fmt.Printf("Publicly reachable: %v\n", s.Reachable)
+	fmt.Println("Listen addresses:")
+	for _, addr := range s.ListenAddrs {
+		fmt.Printf("  %s\n", addr)
+	}
+	fmt.Println("Observed addresses:")
+	for _, addr := range s.ObservedAddrs {
+		fmt.Printf("  %s\n", addr)
+	}
+	fmt.Println("Mapped ports:")
+	for internal, external := range s.MappedPorts {
+		fmt.Printf("  %s -> %s\n", internal, external)
+	}
+	fmt.Println("Connected bootstrap peers:")
+	for _, pid := range s.BootstrapPeers {
+		fmt.Printf("  %s\n", pid)
+	}
+	return nil
+}
+
+func gc(cctx *cli.Context) error {
+	conf, err := loadConf(cctx.GlobalString("conf"))
+	if err != nil {
+		return err
+	}
+	grace := cctx.Duration("grace")
+	if grace <= storage.ChunkRefreshAge {
+		return errors.Errorf("grace must exceed %v, the age reused chunks are rewritten at", storage.ChunkRefreshAge)
+	}
+	for _, share := range conf.Shares {
+		if !share.ContentAddressed {
+			continue
+		}
+		s, err := storage.NewBackend(share)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		stats, err := storage.NewCAS(s).GC(context.Background(), grace)
+		if err != nil {
+			return errors.Wrapf(err, "share %s", share.Path)
+		}
+		fmt.Printf("%s: %d chunks referenced, %d removed, %d bytes freed in %v\n",
+			share.Path, stats.Referenced, stats.Removed, stats.Freed, time.Since(start))
+	}
+	return nil
+}
+
+func quota(cctx *cli.Context) error {
+	conf, err := loadConf(cctx.GlobalString("conf"))
+	if err != nil {
+		return err
+	}
+	resp, err := httpRequest(conf, daemonURL(conf)+types.QuotaURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	q := &types.QuotaStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(q); err != nil {
+		return err
+	}
 
-	return h.Serve(context.Background())
+	fmt.Printf("Peer %s: %s\n", q.Peer, formatQuota(q.Used, q.Limit))
+	for _, share := range q.Shares {
+		fmt.Printf("Share %s: %s\n", share.Path, formatQuota(share.Used, share.Limit))
+	}
+	return nil
+}
+
+// formatQuota formats usage against limit
+func formatQuota(used, limit types.Limit) string {
+	bytes, files := "unlimited", "unlimited"
+	if limit.Bytes > 0 {
+		bytes = fmt.Sprintf("%d", limit.Bytes)
+	}
+	if limit.Files > 0 {
+		files = fmt.Sprintf("%d", limit.Files)
+	}
+	return fmt.Sprintf("%d of %s bytes, %d of %s files", used.Bytes, bytes, used.Files, files)
 }
 
 func list(cctx *cli.Context) error {
@@ -139,7 +416,9 @@ func list(cctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	resp, err := httpRequest(fmt.Sprintf("http://localhost:%d%s?%s=%s", conf.HTTPListenPort, types.ListURL, types.QueryKeyDestination, cctx.Args()[0]))
+	resp, err := httpRequest(conf, queryURL(conf, types.ListURL, url.Values{
+		types.QueryKeyDestination: {cctx.Args()[0]},
+	}))
 	if err != nil {
 		return err
 	}
@@ -158,20 +437,21 @@ func put(cctx *cli.Context) error {
 		return errors.New("Invalid number of arguments")
 	}
 
-	if !path.IsAbs(cctx.Args()[0]) {
+	dst := cctx.Args()[1]
+	if !path.IsAbs(dst) {
 		return errors.New("please use absolute destination path\n")
 	}
-	if !path.IsAbs(cctx.Args()[1]) {
-		return errors.New("please use absolute source path\n")
+	if strings.HasSuffix(dst, "/") {
+		dst = path.Join(dst, filepath.Base(cctx.Args()[0]))
 	}
 
 	conf, err := loadConf(cctx.GlobalString("conf"))
 	if err != nil {
 		return err
 	}
-	_, err = httpRequest(fmt.Sprintf("http://localhost:%d%s?%s=%s&%s=%s", conf.HTTPListenPort, types.PutURL,
-		types.QueryKeyDestination, cctx.Args()[1], types.QueryKeySource, cctx.Args()[0]))
-	return err
+	return upload(conf, queryURL(conf, types.PutURL, url.Values{
+		types.QueryKeyDestination: {dst},
+	}), cctx.Args()[0])
 }
 
 func get(cctx *cli.Context) error {
@@ -179,10 +459,8 @@ func get(cctx *cli.Context) error {
 		return errors.New("Invalid number of arguments")
 	}
 
-	if !path.IsAbs(cctx.Args()[0]) {
-		return errors.New("please use absolute destination path\n")
-	}
-	if !path.IsAbs(cctx.Args()[1]) {
+	src := cctx.Args()[0]
+	if !path.IsAbs(src) {
 		return errors.New("please use absolute source path\n")
 	}
 
@@ -190,9 +468,56 @@ func get(cctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	_, err = httpRequest(fmt.Sprintf("http://localhost:%d%s?%s=%s&%s=%s", conf.HTTPListenPort, types.GetURL,
-		types.QueryKeyDestination, cctx.Args()[0], types.QueryKeySource, cctx.Args()[1]))
-	return err
+	query := url.Values{types.QueryKeyDestination: {src}}
+	if version := cctx.String("version"); version != "" {
+		query.Set(types.QueryKeyVersion, version)
+	}
+	return download(conf, queryURL(conf, types.GetURL, query), filepath.Join(cctx.Args()[1], path.Base(src)))
+}
+
+func versions(cctx *cli.Context) error {
+	if len(cctx.Args()) != 1 {
+		return errors.New("Invalid number of arguments")
+	}
+	conf, err := loadConf(cctx.GlobalString("conf"))
+	if err != nil {
+		return err
+	}
+	resp, err := httpRequest(conf, queryURL(conf, types.VersionsURL, url.Values{
+		types.QueryKeyDestination: {cctx.Args()[0]},
+	}))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	versions := []types.FileInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(&versions); err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		fmt.Printf("%s  %12d  %s\n", v.Version, v.Size, v.ModTime.Local().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func restore(cctx *cli.Context) error {
+	if len(cctx.Args()) != 2 {
+		return errors.New("Invalid number of arguments")
+	}
+	conf, err := loadConf(cctx.GlobalString("conf"))
+	if err != nil {
+		return err
+	}
+	resp, err := httpSend(conf, http.MethodPost, queryURL(conf, types.RestoreURL, url.Values{
+		types.QueryKeyDestination: {cctx.Args()[0]},
+		types.QueryKeyVersion:     {cctx.Args()[1]},
+	}))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
 }
 
 func delete(cctx *cli.Context) error {
@@ -203,21 +528,64 @@ func delete(cctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	_, err = httpRequest(fmt.Sprintf("http://localhost:%d%s?%s=%s", conf.HTTPListenPort, types.DeleteURL, types.QueryKeyDestination, cctx.Args()[0]))
-	return err
+	query := url.Values{types.QueryKeyDestination: {cctx.Args()[0]}}
+	if cctx.Bool("permanent") {
+		query.Set(types.QueryKeyPermanent, "true")
+	}
+	resp, err := httpSend(conf, http.MethodDelete, queryURL(conf, types.DeleteURL, query))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
 }
 
-func httpRequest(url string) (*http.Response, error) {
-	resp, err := http.Get(url)
+func trashList(cctx *cli.Context) error {
+	dir := "/"
+	if len(cctx.Args()) > 0 {
+		dir = cctx.Args()[0]
+	}
+	conf, err := loadConf(cctx.GlobalString("conf"))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if resp.StatusCode != 200 {
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
+	resp, err := httpRequest(conf, queryURL(conf, types.TrashURL, url.Values{
+		types.QueryKeyDestination: {dir},
+	}))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	entries := []types.TrashEntry{}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		by := e.DeletedBy
+		if by == "" {
+			by = "-"
 		}
-		return nil, fmt.Errorf("Non 200 reply: %s", string(data))
+		fmt.Printf("%s  %12d  %s  %s  %s\n", e.ID, e.Size, e.DeletedAt.Local().Format(time.RFC3339), by, e.Path)
+	}
+	return nil
+}
+
+func trashRestore(cctx *cli.Context) error {
+	if len(cctx.Args()) != 2 {
+		return errors.New("Invalid number of arguments")
+	}
+	conf, err := loadConf(cctx.GlobalString("conf"))
+	if err != nil {
+		return err
 	}
-	return resp, nil
+	resp, err := httpSend(conf, http.MethodPost, queryURL(conf, types.UndeleteURL, url.Values{
+		types.QueryKeyDestination: {cctx.Args()[0]},
+		types.QueryKeyID:          {cctx.Args()[1]},
+	}))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
 }
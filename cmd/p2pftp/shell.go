@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/errors"
+
+	"github.com/urfave/cli"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// shellCommand is a command of the interactive shell
+type shellCommand struct {
+	args string
+	help string
+	// local tells that arguments name local files, for completion
+	local bool
+	run   func(s *shell, args []string) error
+}
+
+var shellCommands map[string]*shellCommand
+
+func init() {
+	shellCommands = map[string]*shellCommand{
+		"help":  {args: "[command]", help: "show commands, or usage of command", run: (*shell).help},
+		"pwd":   {help: "print remote directory", run: (*shell).pwd},
+		"cd":    {args: "[remote dir]", help: "change remote directory, to / without dir", run: (*shell).cd},
+		"ls":    {args: "[remote path]", help: "list remote directory or file", run: (*shell).ls},
+		"lpwd":  {help: "print local directory", run: (*shell).lpwd},
+		"lcd":   {args: "[local dir]", help: "change local directory, to home without dir", local: true, run: (*shell).lcd},
+		"get":   {args: "remote [local]", help: "download remote file", run: (*shell).get},
+		"put":   {args: "local [remote]", help: "upload local file", local: true, run: (*shell).put},
+		"mget":  {args: "pattern...", help: "download remote files matching patterns", run: (*shell).mget},
+		"mput":  {args: "pattern...", help: "upload local files matching patterns", local: true, run: (*shell).mput},
+		"rm":    {args: "remote...", help: "delete remote files or empty directories", run: (*shell).rm},
+		"mkdir": {args: "remote...", help: "create remote directories", run: (*shell).mkdir},
+		"mv":    {args: "from to", help: "move remote file or directory", run: (*shell).mv},
+		"quit":  {help: "leave the shell", run: (*shell).quit},
+	}
+	shellCommands["exit"] = shellCommands["quit"]
+	shellCommands["bye"] = shellCommands["quit"]
+}
+
+// errQuit ends the shell
+var errQuit = errors.New("quit")
+
+// shell is an interactive session on the connect daemon, which keeps the
+// current remote directory between commands
+type shell struct {
+	conf *types.Config
+	dir  string
+	out  io.Writer
+}
+
+func shellAction(cctx *cli.Context) error {
+	conf, err := loadConf(cctx.GlobalString("conf"))
+	if err != nil {
+		return err
+	}
+	s := &shell{conf: conf, dir: "/", out: os.Stdout}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		// commands are piped in, run them without prompt
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if err := s.exec(scanner.Text()); err == errQuit {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer terminal.Restore(fd, state)
+
+	term := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, s.prompt())
+	if width, height, err := terminal.GetSize(fd); err == nil && width > 0 {
+		term.SetSize(width, height)
+	}
+	term.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return s.complete(term, line, pos)
+	}
+	s.out = term
+
+	for {
+		line, err := term.ReadLine()
+		if err == io.EOF {
+			fmt.Fprintln(term)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.exec(line); err == errQuit {
+			return nil
+		}
+		term.SetPrompt(s.prompt())
+	}
+}
+
+func (s *shell) prompt() string {
+	return fmt.Sprintf("p2pftp:%s> ", s.dir)
+}
+
+// exec runs command line, and reports errors other than errQuit
+func (s *shell) exec(line string) error {
+	args := splitArgs(line)
+	if len(args) == 0 {
+		return nil
+	}
+	cmd, ok := shellCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(s.out, "unknown command %s, try help\n", args[0])
+		return nil
+	}
+	err := cmd.run(s, args[1:])
+	if err != nil && err != errQuit {
+		fmt.Fprintf(s.out, "%s: %s\n", args[0], err)
+	}
+	return err
+}
+
+// splitArgs splits line at spaces, except within double quotes or escaped
+// by backslash
+func splitArgs(line string) []string {
+	var (
+		args    []string
+		arg     strings.Builder
+		quoted  bool
+		escaped bool
+		inArg   bool
+	)
+	for _, r := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+			inArg = true
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+// resolve returns absolute remote path of p, relative to the current
+// directory
+func (s *shell) resolve(p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join(s.dir, p)
+	}
+	return path.Clean(p)
+}
+
+// fileURL returns REST resource of remote path p
+func (s *shell) fileURL(p string) string {
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return daemonURL(s.conf) + types.APIFilesURL + strings.Join(parts, "/")
+}
+
+func (s *shell) request(method, p string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.fileURL(p), body)
+	if err != nil {
+		return nil, err
+	}
+	return httpDo(s.conf, req)
+}
+
+// isDir tells whether remote path p is a directory
+func (s *shell) isDir(p string) (bool, error) {
+	resp, err := s.request(http.MethodHead, p, nil)
+	if err != nil {
+		return false, errors.Wrap(err, p)
+	}
+	resp.Body.Close()
+	return resp.Header.Get("X-File-Type") == "directory", nil
+}
+
+// list returns files in remote directory p
+func (s *shell) list(p string) ([]types.FileInfo, error) {
+	if isDir, err := s.isDir(p); err != nil {
+		return nil, err
+	} else if !isDir {
+		return nil, errors.Errorf("%s is not a directory", p)
+	}
+	resp, err := s.request(http.MethodGet, p, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var files []types.FileInfo
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (s *shell) help(args []string) error {
+	if len(args) > 0 {
+		cmd, ok := shellCommands[args[0]]
+		if !ok {
+			return errors.Errorf("unknown command %s", args[0])
+		}
+		fmt.Fprintf(s.out, "%s %s\n    %s\n", args[0], cmd.args, cmd.help)
+		return nil
+	}
+	names := make([]string, 0, len(shellCommands))
+	for name := range shellCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(s.out, "%-6s %s\n", name, shellCommands[name].help)
+	}
+	return nil
+}
+
+func (s *shell) pwd(args []string) error {
+	fmt.Fprintln(s.out, s.dir)
+	return nil
+}
+
+func (s *shell) cd(args []string) error {
+	dir := "/"
+	if len(args) > 0 {
+		dir = s.resolve(args[0])
+	}
+	isDir, err := s.isDir(dir)
+	if err != nil {
+		return err
+	}
+	if !isDir {
+		return errors.Errorf("%s is not a directory", dir)
+	}
+	s.dir = dir
+	return nil
+}
+
+func (s *shell) ls(args []string) error {
+	p := s.dir
+	if len(args) > 0 {
+		p = s.resolve(args[0])
+	}
+	isDir, err := s.isDir(p)
+	if err != nil {
+		return err
+	}
+	if !isDir {
+		// a file is listed from its directory, which has its details
+		files, err := s.list(path.Dir(p))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.Name == path.Base(p) {
+				s.printFile(f)
+			}
+		}
+		return nil
+	}
+	files, err := s.list(p)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		s.printFile(f)
+	}
+	return nil
+}
+
+func (s *shell) printFile(f types.FileInfo) {
+	name := f.Name
+	if f.IsDir {
+		name += "/"
+	}
+	fmt.Fprintf(s.out, "%s %12d %s %s\n", f.Mode, f.Size, f.ModTime.Local().Format("Jan _2 15:04"), name)
+}
+
+func (s *shell) lpwd(args []string) error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(s.out, dir)
+	return nil
+}
+
+func (s *shell) lcd(args []string) error {
+	dir := ""
+	if len(args) > 0 {
+		dir = args[0]
+	} else {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		dir = home
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	return s.lpwd(nil)
+}
+
+// getFile downloads remote file p into local, which may be a directory
+func (s *shell) getFile(p, local string) error {
+	if info, err := os.Stat(local); err == nil && info.IsDir() {
+		local = filepath.Join(local, path.Base(p))
+	}
+	if err := download(s.conf, s.fileURL(p), local); err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "%s -> %s\n", p, local)
+	return nil
+}
+
+// putFile uploads local file into remote, which may be a directory
+func (s *shell) putFile(local, remote string) error {
+	if isDir, err := s.isDir(remote); err == nil && isDir {
+		remote = path.Join(remote, filepath.Base(local))
+	}
+	if err := upload(s.conf, s.fileURL(remote), local); err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "%s -> %s\n", local, remote)
+	return nil
+}
+
+func (s *shell) get(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: get remote [local]")
+	}
+	local := "."
+	if len(args) == 2 {
+		local = args[1]
+	}
+	return s.getFile(s.resolve(args[0]), local)
+}
+
+func (s *shell) put(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: put local [remote]")
+	}
+	remote := s.dir
+	if len(args) == 2 {
+		remote = s.resolve(args[1])
+	}
+	return s.putFile(args[0], remote)
+}
+
+// mget downloads remote files whose names match patterns, wildcards are
+// only supported in the last element of a pattern
+func (s *shell) mget(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: mget pattern...")
+	}
+	for _, arg := range args {
+		pattern := s.resolve(arg)
+		files, err := s.list(path.Dir(pattern))
+		if err != nil {
+			return err
+		}
+		matched := false
+		for _, f := range files {
+			if ok, err := path.Match(path.Base(pattern), f.Name); err != nil {
+				return err
+			} else if !ok || f.IsDir {
+				continue
+			}
+			matched = true
+			if err := s.getFile(path.Join(path.Dir(pattern), f.Name), "."); err != nil {
+				return err
+			}
+		}
+		if !matched {
+			return errors.Errorf("no remote file matches %s", arg)
+		}
+	}
+	return nil
+}
+
+func (s *shell) mput(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: mput pattern...")
+	}
+	for _, arg := range args {
+		names, err := filepath.Glob(arg)
+		if err != nil {
+			return err
+		}
+		matched := false
+		for _, name := range names {
+			if info, err := os.Stat(name); err != nil || info.IsDir() {
+				continue
+			}
+			matched = true
+			if err := s.putFile(name, path.Join(s.dir, filepath.Base(name))); err != nil {
+				return err
+			}
+		}
+		if !matched {
+			return errors.Errorf("no local file matches %s", arg)
+		}
+	}
+	return nil
+}
+
+func (s *shell) rm(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: rm remote...")
+	}
+	for _, arg := range args {
+		resp, err := s.request(http.MethodDelete, s.resolve(arg), nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (s *shell) mkdir(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: mkdir remote...")
+	}
+	for _, arg := range args {
+		resp, err := s.request(http.MethodPut, s.resolve(arg)+"/", nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (s *shell) mv(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: mv from to")
+	}
+	to := s.resolve(args[1])
+	if isDir, err := s.isDir(to); err == nil && isDir {
+		to = path.Join(to, path.Base(s.resolve(args[0])))
+	}
+	body, err := json.Marshal(map[string]string{"Path": to})
+	if err != nil {
+		return err
+	}
+	resp, err := s.request(http.MethodPatch, s.resolve(args[0]), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *shell) quit(args []string) error {
+	return errQuit
+}
+
+// complete completes the word before the cursor as command name, or as
+// remote or local path depending on the command. Candidates are printed if
+// they share no longer prefix.
+func (s *shell) complete(term *terminal.Terminal, line string, pos int) (string, int, bool) {
+	head := line[:pos]
+	start := lastWord(head)
+	word := strings.Replace(head[start:], "\\", "", -1)
+
+	var candidates []string
+	if strings.TrimSpace(head[:start]) == "" {
+		for name := range shellCommands {
+			if strings.HasPrefix(name, word) {
+				candidates = append(candidates, name+" ")
+			}
+		}
+	} else if cmd, ok := shellCommands[strings.Fields(head)[0]]; ok && cmd.local {
+		candidates = completeLocal(word)
+	} else {
+		candidates = s.completeRemote(word)
+	}
+	if len(candidates) == 0 {
+		return "", 0, false
+	}
+	sort.Strings(candidates)
+
+	prefix := commonPrefix(candidates)
+	if len(candidates) > 1 && prefix == word {
+		fmt.Fprintln(term, strings.Join(candidates, "  "))
+		return "", 0, false
+	}
+	// spaces within names are escaped, the one ending the word is not
+	done := strings.HasSuffix(prefix, " ")
+	prefix = strings.Replace(strings.TrimSuffix(prefix, " "), " ", "\\ ", -1)
+	if done {
+		prefix += " "
+	}
+	return head[:start] + prefix + line[pos:], start + len(prefix), true
+}
+
+// commonPrefix returns the longest prefix of all candidates, which never
+// ends within a multi-byte character
+func commonPrefix(candidates []string) string {
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix)
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	return prefix
+}
+
+// lastWord returns index of the last word in line, which starts after a
+// space not escaped by backslash
+func lastWord(line string) int {
+	start := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case ' ', '\t':
+			start = i + 1
+		}
+	}
+	return start
+}
+
+// completeRemote returns remote paths starting with word, directories end
+// with slash
+func (s *shell) completeRemote(word string) []string {
+	dir, base := path.Split(word)
+	files, err := s.list(s.resolve(dir))
+	if err != nil {
+		return nil
+	}
+	var candidates []string
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name, base) {
+			continue
+		}
+		if f.IsDir {
+			candidates = append(candidates, dir+f.Name+"/")
+		} else {
+			candidates = append(candidates, dir+f.Name+" ")
+		}
+	}
+	return candidates
+}
+
+// completeLocal returns local paths starting with word, directories end
+// with separator
+func completeLocal(word string) []string {
+	matches, err := filepath.Glob(word + "*")
+	if err != nil {
+		return nil
+	}
+	var candidates []string
+	for _, m := range matches {
+		if info, err := os.Stat(m); err == nil && info.IsDir() {
+			candidates = append(candidates, m+string(filepath.Separator))
+		} else {
+			candidates = append(candidates, m+" ")
+		}
+	}
+	return candidates
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for line, want := range map[string][]string{
+		"":                      nil,
+		"   ":                   nil,
+		"ls":                    {"ls"},
+		"  get  /a   b ":        {"get", "/a", "b"},
+		"put my\\ file /dir/":   {"put", "my file", "/dir/"},
+		"mv \"a b\" \"c d\"":    {"mv", "a b", "c d"},
+		"rm \"\"":               {"rm", ""},
+		"cd a\\\"b":             {"cd", "a\"b"},
+		"get\tspäter.txt":       {"get", "später.txt"},
+		"mget \"*.txt\" x\\\\y": {"mget", "*.txt", "x\\y"},
+	} {
+		if got := splitArgs(line); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q got %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestLastWord(t *testing.T) {
+	for line, want := range map[string]int{
+		"":              0,
+		"ls":            0,
+		"ls ":           3,
+		"get /a/b":      4,
+		"get my\\ fi":   4,
+		"put a\tb":      6,
+		"get a\\ b\\ c": 4,
+	} {
+		if got := lastWord(line); got != want {
+			t.Errorf("%q got %d, want %d", line, got, want)
+		}
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	for _, c := range []struct {
+		candidates []string
+		want       string
+	}{
+		{[]string{"get "}, "get "},
+		{[]string{"mget ", "mkdir ", "mput ", "mv "}, "m"},
+		{[]string{"/data/a.txt ", "/data/b.txt "}, "/data/"},
+		{[]string{"rm ", "cd "}, ""},
+		// names differ in the second byte of the last character
+		{[]string{"äpfel ", "öl "}, ""},
+		{[]string{"/日本 ", "/日書 "}, "/日"},
+	} {
+		got := commonPrefix(c.candidates)
+		if got != c.want {
+			t.Errorf("%q got %q, want %q", c.candidates, got, c.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("%q got invalid UTF-8 %q", c.candidates, got)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	for _, c := range []struct {
+		dir, p, want string
+	}{
+		{"/", "a", "/a"},
+		{"/data", "a/b", "/data/a/b"},
+		{"/data", "/other", "/other"},
+		{"/data/sub", "..", "/data"},
+		{"/data", "../../..", "/"},
+		{"/data", "", "/data"},
+		{"/data", "./a/", "/data/a"},
+	} {
+		s := &shell{dir: c.dir}
+		if got := s.resolve(c.p); got != c.want {
+			t.Errorf("%q in %q got %q, want %q", c.p, c.dir, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+// Package crypt encrypts files on the client before they are uploaded, so
+// the listener only stores ciphertext.
+//
+// Content is split into segments sealed with AES-256-GCM, each with its own
+// nonce, so files are encrypted and decrypted while they stream and
+// truncation is detected. File names are optionally encrypted one path
+// element at a time. Name encryption is deterministic, so the key holder
+// can still address and list files, at the cost of revealing which names
+// are equal.
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// segmentSize is the plaintext size of each sealed segment
+	segmentSize = 64 << 10
+	magic       = "P2E1"
+	// headerSize is magic followed by nonce prefix
+	headerSize = len(magic) + noncePrefixSize
+	// noncePrefixSize leaves room for segment counter and final flag
+	noncePrefixSize = 7
+)
+
+var (
+	// ErrInvalidKey is returned for keys which are not 32 base64 encoded
+	// bytes
+	ErrInvalidKey = errors.New("encryption key must be 32 base64 encoded bytes")
+	// ErrNotEncrypted is returned when content was not encrypted by this
+	// package
+	ErrNotEncrypted = errors.New("content is not encrypted")
+	// ErrAuth is returned when content or name was modified, or encrypted
+	// with another key
+	ErrAuth = errors.New("message authentication failed")
+)
+
+// Cipher encrypts content and names with one key
+type Cipher struct {
+	content cipher.AEAD
+	names   cipher.AEAD
+	nameKey []byte
+	conf    types.Encryption
+}
+
+// New creates cipher of configuration
+func New(conf types.Encryption) (*Cipher, error) {
+	key, err := base64.StdEncoding.DecodeString(conf.Key)
+	if err != nil || len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+	content, err := newAEAD(subkey(key, "content"))
+	if err != nil {
+		return nil, err
+	}
+	names, err := newAEAD(subkey(key, "names"))
+	if err != nil {
+		return nil, err
+	}
+	if conf.Root == "" {
+		conf.Root = "/"
+	}
+	conf.Root = path.Clean(conf.Root)
+	return &Cipher{content: content, names: names, nameKey: subkey(key, "name nonce"), conf: conf}, nil
+}
+
+// subkey derives independent key for one purpose
+func subkey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypted reports whether remote path is below the encryption root
+func (c *Cipher) Encrypted(p string) bool {
+	p = path.Clean(p)
+	return c.conf.Root == "/" || p == c.conf.Root || strings.HasPrefix(p, c.conf.Root+"/")
+}
+
+// EncryptPath encrypts the elements of remote path below the encryption
+// root, if names are encrypted
+func (c *Cipher) EncryptPath(p string) string {
+	if !c.conf.EncryptNames || !c.Encrypted(p) {
+		return p
+	}
+	clean := path.Clean(p)
+	rel := strings.TrimPrefix(strings.TrimPrefix(clean, c.conf.Root), "/")
+	if rel == "" {
+		return p
+	}
+	elems := strings.Split(rel, "/")
+	for i, elem := range elems {
+		elems[i] = c.encryptName(elem)
+	}
+	encrypted := path.Join(c.conf.Root, strings.Join(elems, "/"))
+	if strings.HasSuffix(p, "/") {
+		encrypted += "/"
+	}
+	return encrypted
+}
+
+// DecryptPath decrypts the elements of remote path below the encryption
+// root, if names are encrypted
+func (c *Cipher) DecryptPath(p string) (string, error) {
+	if !c.conf.EncryptNames || !c.Encrypted(p) {
+		return p, nil
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(path.Clean(p), c.conf.Root), "/")
+	if rel == "" {
+		return p, nil
+	}
+	elems := strings.Split(rel, "/")
+	for i, elem := range elems {
+		name, err := c.decryptName(elem)
+		if err != nil {
+			return "", err
+		}
+		elems[i] = name
+	}
+	return path.Join(c.conf.Root, strings.Join(elems, "/")), nil
+}
+
+// DecryptName decrypts name of entry listed in remote dir. Names which are
+// not encrypted with this key are returned with error.
+func (c *Cipher) DecryptName(dir, name string) (string, error) {
+	if !c.conf.EncryptNames || !c.Encrypted(path.Join(dir, name)) {
+		return name, nil
+	}
+	return c.decryptName(name)
+}
+
+// encryptName seals name with nonce derived from it, so that equal names
+// are encrypted equally
+func (c *Cipher) encryptName(name string) string {
+	mac := hmac.New(sha256.New, c.nameKey)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:c.names.NonceSize()]
+	sealed := c.names.Seal(nonce, nonce, []byte(name), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+func (c *Cipher) decryptName(name string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || len(sealed) < c.names.NonceSize() {
+		return "", ErrAuth
+	}
+	n := c.names.NonceSize()
+	plain, err := c.names.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", ErrAuth
+	}
+	return string(plain), nil
+}
+
+// EncryptedSize returns ciphertext size of plaintext size
+func (c *Cipher) EncryptedSize(size int64) int64 {
+	segments := size/segmentSize + 1
+	return int64(headerSize) + size + segments*int64(c.content.Overhead())
+}
+
+// DecryptedSize returns plaintext size of ciphertext size
+func (c *Cipher) DecryptedSize(size int64) (int64, error) {
+	overhead := int64(c.content.Overhead())
+	size -= int64(headerSize)
+	if size < overhead {
+		return 0, ErrNotEncrypted
+	}
+	full := size / (segmentSize + overhead)
+	last := size % (segmentSize + overhead)
+	if last < overhead {
+		return 0, ErrNotEncrypted
+	}
+	return full*segmentSize + last - overhead, nil
+}
+
+// nonce returns nonce of segment
+func nonce(prefix []byte, counter uint32, final bool) []byte {
+	n := make([]byte, 12)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[noncePrefixSize:], counter)
+	if final {
+		n[11] = 1
+	}
+	return n
+}
+
+// Encrypt returns reader of ciphertext of r
+func (c *Cipher) Encrypt(r io.Reader) io.Reader {
+	return &encrypter{c: c, r: r}
+}
+
+type encrypter struct {
+	c       *Cipher
+	r       io.Reader
+	prefix  []byte
+	counter uint32
+	out     bytes.Buffer
+	plain   []byte
+	done    bool
+	err     error
+}
+
+func (e *encrypter) Read(p []byte) (int, error) {
+	for e.out.Len() == 0 && !e.done && e.err == nil {
+		e.err = e.next()
+	}
+	if e.out.Len() > 0 {
+		return e.out.Read(p)
+	}
+	if e.err != nil {
+		return 0, e.err
+	}
+	return 0, io.EOF
+}
+
+// next seals one more segment into out
+func (e *encrypter) next() error {
+	if e.prefix == nil {
+		e.prefix = make([]byte, noncePrefixSize)
+		if _, err := rand.Read(e.prefix); err != nil {
+			return err
+		}
+		e.out.WriteString(magic)
+		e.out.Write(e.prefix)
+		e.plain = make([]byte, segmentSize)
+	}
+	n, err := io.ReadFull(e.r, e.plain)
+	final := false
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		final = true
+	default:
+		return err
+	}
+	e.out.Write(e.c.content.Seal(nil, nonce(e.prefix, e.counter, final), e.plain[:n], nil))
+	e.counter++
+	e.done = final
+	return nil
+}
+
+// Decrypt returns writer which writes plaintext of ciphertext written into
+// it to w. Close fails if the content was truncated.
+func (c *Cipher) Decrypt(w io.Writer) io.WriteCloser {
+	return &decrypter{c: c, w: w}
+}
+
+type decrypter struct {
+	c       *Cipher
+	w       io.Writer
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func (d *decrypter) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	if d.prefix == nil {
+		if len(d.buf) < headerSize {
+			return len(p), nil
+		}
+		if string(d.buf[:len(magic)]) != magic {
+			return 0, ErrNotEncrypted
+		}
+		d.prefix = append([]byte{}, d.buf[len(magic):headerSize]...)
+		d.buf = d.buf[headerSize:]
+	}
+	// a full segment is never the final one, which is kept until Close
+	sealed := segmentSize + d.c.content.Overhead()
+	for len(d.buf) > sealed {
+		if err := d.open(d.buf[:sealed], false); err != nil {
+			return 0, err
+		}
+		d.buf = d.buf[sealed:]
+	}
+	return len(p), nil
+}
+
+func (d *decrypter) open(sealed []byte, final bool) error {
+	plain, err := d.c.content.Open(nil, nonce(d.prefix, d.counter, final), sealed, nil)
+	if err != nil {
+		return ErrAuth
+	}
+	d.counter++
+	_, err = d.w.Write(plain)
+	return err
+}
+
+func (d *decrypter) Close() error {
+	if d.prefix == nil {
+		return ErrNotEncrypted
+	}
+	return d.open(d.buf, true)
+}
@@ -0,0 +1,218 @@
+package crypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+func newTestCipher(t *testing.T, conf types.Encryption) *Cipher {
+	conf.Key = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	c, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func encrypt(t *testing.T, c *Cipher, plain []byte) []byte {
+	sealed, err := ioutil.ReadAll(c.Encrypt(bytes.NewReader(plain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+// decrypt returns plaintext of sealed, and the first error of writing or
+// closing the decrypter
+func decrypt(c *Cipher, sealed []byte) ([]byte, error) {
+	var plain bytes.Buffer
+	d := c.Decrypt(&plain)
+	if _, err := d.Write(sealed); err != nil {
+		return nil, err
+	}
+	if err := d.Close(); err != nil {
+		return nil, err
+	}
+	return plain.Bytes(), nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	c := newTestCipher(t, types.Encryption{})
+	for _, size := range []int{0, 1, segmentSize, segmentSize + 1, 3 * segmentSize} {
+		plain := bytes.Repeat([]byte{'x'}, size)
+		sealed := encrypt(t, c, plain)
+		if int64(len(sealed)) != c.EncryptedSize(int64(size)) {
+			t.Fatalf("size %d: ciphertext is %d bytes, EncryptedSize is %d", size, len(sealed), c.EncryptedSize(int64(size)))
+		}
+		got, err := decrypt(c, sealed)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: decrypted %d bytes", size, len(got))
+		}
+	}
+}
+
+func TestTamperedContent(t *testing.T) {
+	c := newTestCipher(t, types.Encryption{})
+	sealed := encrypt(t, c, bytes.Repeat([]byte{'x'}, 2*segmentSize+1))
+	full := segmentSize + c.content.Overhead()
+
+	// the file is cut after a full segment, which is not sealed as final
+	if _, err := decrypt(c, sealed[:headerSize+full]); err != ErrAuth {
+		t.Fatalf("truncated content got %v, want ErrAuth", err)
+	}
+
+	reordered := append([]byte{}, sealed[:headerSize]...)
+	reordered = append(reordered, sealed[headerSize+full:headerSize+2*full]...)
+	reordered = append(reordered, sealed[headerSize:headerSize+full]...)
+	reordered = append(reordered, sealed[headerSize+2*full:]...)
+	if _, err := decrypt(c, reordered); err != ErrAuth {
+		t.Fatalf("reordered segments got %v, want ErrAuth", err)
+	}
+
+	other, err := New(types.Encryption{Key: base64.StdEncoding.EncodeToString(make([]byte, 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decrypt(other, sealed); err != ErrAuth {
+		t.Fatalf("content of other key got %v, want ErrAuth", err)
+	}
+
+	if _, err := decrypt(c, []byte("plain text content")); err != ErrNotEncrypted {
+		t.Fatalf("plain content got %v, want ErrNotEncrypted", err)
+	}
+}
+
+func TestSizes(t *testing.T) {
+	c := newTestCipher(t, types.Encryption{})
+	for _, size := range []int64{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 5*segmentSize + 7} {
+		got, err := c.DecryptedSize(c.EncryptedSize(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != size {
+			t.Fatalf("DecryptedSize(EncryptedSize(%d)) is %d", size, got)
+		}
+	}
+	for _, size := range []int64{0, int64(headerSize), int64(headerSize + c.content.Overhead() - 1)} {
+		if _, err := c.DecryptedSize(size); err != ErrNotEncrypted {
+			t.Fatalf("DecryptedSize(%d) got %v, want ErrNotEncrypted", size, err)
+		}
+	}
+}
+
+func TestEncryptPath(t *testing.T) {
+	c := newTestCipher(t, types.Encryption{EncryptNames: true, Root: "/share"})
+
+	encrypted := c.EncryptPath("/share/dir/file")
+	if encrypted != c.EncryptPath("/share/dir/file") {
+		t.Fatal("path is not encrypted deterministically")
+	}
+	if !strings.HasPrefix(encrypted, "/share/") || strings.Contains(encrypted, "dir") || strings.Contains(encrypted, "file") {
+		t.Fatalf("encrypted path %s", encrypted)
+	}
+	if elems := strings.Split(encrypted, "/"); elems[2] != strings.Split(c.EncryptPath("/share/dir/other"), "/")[2] {
+		t.Fatal("equal names are encrypted differently")
+	}
+	decrypted, err := c.DecryptPath(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "/share/dir/file" {
+		t.Fatalf("decrypted path %s", decrypted)
+	}
+
+	if p := c.EncryptPath("/share/dir/"); !strings.HasSuffix(p, "/") {
+		t.Fatalf("trailing slash is dropped: %s", p)
+	}
+	for _, p := range []string{"/other/file", "/share"} {
+		if got := c.EncryptPath(p); got != p {
+			t.Fatalf("%s outside encryption root is encrypted to %s", p, got)
+		}
+	}
+	if _, err := c.DecryptPath("/share/plain"); err != ErrAuth {
+		t.Fatalf("plain name got %v, want ErrAuth", err)
+	}
+}
+
+func TestSkipWriter(t *testing.T) {
+	for _, c := range []struct {
+		skip   int64
+		writes []string
+		want   string
+	}{
+		{0, []string{"abc", "def"}, "abcdef"},
+		{2, []string{"abc", "def"}, "cdef"},
+		{3, []string{"abc", "def"}, "def"},
+		{4, []string{"abc", "def"}, "ef"},
+		{6, []string{"abc", "def"}, ""},
+		{1, []string{"", "a", "bc"}, "bc"},
+	} {
+		var buf bytes.Buffer
+		w := NewSkipWriter(&buf, c.skip)
+		for _, s := range c.writes {
+			// every write reports the whole input as written
+			if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+				t.Fatalf("write %q got %d, %v", s, n, err)
+			}
+		}
+		if buf.String() != c.want || w.Written() != int64(len(c.want)) {
+			t.Errorf("skip %d of %q got %q, %d written, want %q", c.skip, c.writes, buf.String(), w.Written(), c.want)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	c := newTestCipher(t, types.Encryption{Root: "/secret"})
+	plain := bytes.Repeat([]byte("0123456789"), segmentSize/5)
+	r, size := c.Upload("/secret/a", bytes.NewReader(plain), int64(len(plain)))
+	if size != c.EncryptedSize(int64(len(plain))) {
+		t.Fatalf("upload size %d", size)
+	}
+	sealed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offset := range []int64{0, 5, segmentSize + 3} {
+		var buf bytes.Buffer
+		if err := c.Download("/secret/a", &buf, offset, func(w io.Writer) error {
+			_, err := w.Write(sealed)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), plain[offset:]) {
+			t.Errorf("download from %d got %d bytes", offset, buf.Len())
+		}
+	}
+	// truncated content is detected
+	err = c.Download("/secret/a", ioutil.Discard, 0, func(w io.Writer) error {
+		_, err := w.Write(sealed[:len(sealed)-1])
+		return err
+	})
+	if err != ErrAuth {
+		t.Fatalf("truncated download got %v", err)
+	}
+
+	// files outside the root, and a nil cipher, are passed on as they are
+	var nilCipher *Cipher
+	for _, c := range []*Cipher{c, nilCipher} {
+		if r, size := c.Upload("/public/a", bytes.NewReader(plain), 3); r == nil || size != 3 {
+			t.Fatalf("upload outside root got size %d", size)
+		}
+		info := types.FileInfo{Name: "a", Size: 3}
+		c.DecryptInfo("/public", &info)
+		if info.Name != "a" || info.Size != 3 {
+			t.Fatalf("info outside root became %+v", info)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package crypt
+
+import (
+	"io"
+	"path"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+// The helpers below are shared by the client package and the connect
+// daemon, which both list, get and put remote files. They accept a nil
+// cipher, which leaves everything as it is.
+
+// DecryptInfo replaces encrypted name and size of file in dir with their
+// plaintext, entries not encrypted with the key are left as they are
+func (c *Cipher) DecryptInfo(dir string, info *types.FileInfo) {
+	if c == nil {
+		return
+	}
+	if name, err := c.DecryptName(dir, info.Name); err == nil {
+		info.Name = name
+	}
+	if info.IsDir || !c.Encrypted(path.Join(dir, info.Name)) {
+		return
+	}
+	if size, err := c.DecryptedSize(info.Size); err == nil {
+		info.Size = size
+	}
+}
+
+// DecryptEntry replaces encrypted path and size of trash entry with their
+// plaintext
+func (c *Cipher) DecryptEntry(entry *types.TrashEntry) {
+	if c == nil {
+		return
+	}
+	if p, err := c.DecryptPath(entry.Path); err == nil {
+		entry.Path = p
+	}
+	if entry.IsDir || !c.Encrypted(entry.Path) {
+		return
+	}
+	if size, err := c.DecryptedSize(entry.Size); err == nil {
+		entry.Size = size
+	}
+}
+
+// Upload returns content and size to put as remote file p for size bytes
+// read from r, they are encrypted if p is below the encryption root
+func (c *Cipher) Upload(p string, r io.Reader, size int64) (io.Reader, int64) {
+	if c == nil || !c.Encrypted(p) {
+		return r, size
+	}
+	return c.Encrypt(io.LimitReader(r, size)), c.EncryptedSize(size)
+}
+
+// Download calls get with a writer which decrypts remote file p into w, if
+// p is below the encryption root, and fails if the content is truncated.
+// Encrypted segments are authenticated in order, so get must write the
+// whole file, which is written into w from offset on.
+func (c *Cipher) Download(p string, w io.Writer, offset int64, get func(w io.Writer) error) error {
+	if c == nil || !c.Encrypted(p) {
+		return get(w)
+	}
+	d := c.Decrypt(NewSkipWriter(w, offset))
+	if err := get(d); err != nil {
+		return err
+	}
+	return d.Close()
+}
+
+// SkipWriter discards the first bytes written to it, and passes on the rest
+type SkipWriter struct {
+	w       io.Writer
+	skip    int64
+	written int64
+}
+
+// NewSkipWriter returns writer discarding the first skip bytes written to it
+func NewSkipWriter(w io.Writer, skip int64) *SkipWriter {
+	return &SkipWriter{w: w, skip: skip}
+}
+
+func (w *SkipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.skip >= int64(n) {
+		w.skip -= int64(n)
+		return n, nil
+	}
+	p = p[w.skip:]
+	w.skip = 0
+	written, err := w.w.Write(p)
+	w.written += int64(written)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Written returns number of bytes passed on
+func (w *SkipWriter) Written() int64 {
+	return w.written
+}
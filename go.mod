@@ -12,22 +12,23 @@ require (
 	github.com/gxed/eventfd v0.0.0-20160916113412-80a92cca79a8 // indirect
 	github.com/gxed/hashland v0.0.0-20180221191214-d9f6b97f8db2 // indirect
 	github.com/hashicorp/golang-lru v0.5.0 // indirect
-	github.com/ipfs/go-cid v0.9.0 // indirect
+	github.com/ipfs/go-cid v0.9.0
 	github.com/ipfs/go-datastore v3.2.0+incompatible // indirect
 	github.com/ipfs/go-ipfs-addr v0.1.25
 	github.com/ipfs/go-ipfs-util v1.2.8 // indirect
-	github.com/ipfs/go-log v1.5.7 // indirect
+	github.com/ipfs/go-log v1.5.7
 	github.com/ipfs/go-todocounter v1.0.1 // indirect
 	github.com/jbenet/go-context v0.0.0-20150711004518-d14ea06fba99 // indirect
 	github.com/jbenet/go-temp-err-catcher v0.0.0-20150120210811-aac704a3f4f2 // indirect
 	github.com/jbenet/goprocess v0.0.0-20160826012719-b497e2f366b8 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/libp2p/go-addr-util v2.0.7+incompatible // indirect
 	github.com/libp2p/go-buffer-pool v0.1.1 // indirect
 	github.com/libp2p/go-conn-security v0.1.15 // indirect
 	github.com/libp2p/go-conn-security-multistream v0.1.15 // indirect
 	github.com/libp2p/go-flow-metrics v0.2.0 // indirect
 	github.com/libp2p/go-libp2p v6.0.23+incompatible
-	github.com/libp2p/go-libp2p-circuit v2.3.2+incompatible // indirect
+	github.com/libp2p/go-libp2p-circuit v2.3.2+incompatible
 	github.com/libp2p/go-libp2p-crypto v2.0.1+incompatible
 	github.com/libp2p/go-libp2p-host v3.0.15+incompatible
 	github.com/libp2p/go-libp2p-interface-connmgr v0.0.21 // indirect
@@ -40,11 +41,11 @@ require (
 	github.com/libp2p/go-libp2p-net v3.0.15+incompatible
 	github.com/libp2p/go-libp2p-peer v2.4.0+incompatible
 	github.com/libp2p/go-libp2p-peerstore v2.0.6+incompatible
-	github.com/libp2p/go-libp2p-protocol v1.0.0 // indirect
+	github.com/libp2p/go-libp2p-protocol v1.0.0
 	github.com/libp2p/go-libp2p-record v4.1.7+incompatible // indirect
 	github.com/libp2p/go-libp2p-routing v2.7.1+incompatible // indirect
 	github.com/libp2p/go-libp2p-secio v2.0.17+incompatible // indirect
-	github.com/libp2p/go-libp2p-swarm v3.0.22+incompatible // indirect
+	github.com/libp2p/go-libp2p-swarm v3.0.22+incompatible
 	github.com/libp2p/go-libp2p-transport v3.0.15+incompatible // indirect
 	github.com/libp2p/go-libp2p-transport-upgrader v0.1.16 // indirect
 	github.com/libp2p/go-maddr-filter v1.1.10 // indirect
@@ -54,21 +55,22 @@ require (
 	github.com/libp2p/go-reuseport-transport v0.1.11 // indirect
 	github.com/libp2p/go-sockaddr v1.0.3 // indirect
 	github.com/libp2p/go-stream-muxer v3.0.1+incompatible // indirect
-	github.com/libp2p/go-tcp-transport v2.0.16+incompatible // indirect
-	github.com/libp2p/go-ws-transport v2.0.15+incompatible // indirect
+	github.com/libp2p/go-tcp-transport v2.0.16+incompatible
+	github.com/libp2p/go-ws-transport v2.0.15+incompatible
 	github.com/mattn/go-colorable v0.0.9 // indirect
 	github.com/mattn/go-isatty v0.0.4 // indirect
 	github.com/minio/blake2b-simd v0.0.0-20160723061019-3f5f724cb5b1 // indirect
 	github.com/minio/sha256-simd v0.0.0-20181005183134-51976451ce19 // indirect
 	github.com/mr-tron/base58 v1.1.0 // indirect
-	github.com/multiformats/go-multiaddr v1.3.0 // indirect
+	github.com/multiformats/go-multiaddr v1.3.0
 	github.com/multiformats/go-multiaddr-dns v0.2.5 // indirect
 	github.com/multiformats/go-multiaddr-net v1.6.3 // indirect
 	github.com/multiformats/go-multibase v0.3.0 // indirect
-	github.com/multiformats/go-multihash v1.0.8 // indirect
+	github.com/multiformats/go-multihash v1.0.8
 	github.com/multiformats/go-multistream v0.3.9 // indirect
 	github.com/opentracing/opentracing-go v1.0.2 // indirect
 	github.com/pkg/errors v0.8.0
+	github.com/pkg/sftp v1.8.3
 	github.com/spaolacci/murmur3 v0.0.0-20180118202830-f09979ecbc72 // indirect
 	github.com/urfave/cli v1.20.0
 	github.com/whyrusleeping/base32 v0.0.0-20170828182744-c30ac30633cc // indirect
@@ -81,7 +83,7 @@ require (
 	github.com/whyrusleeping/mafmt v1.2.8 // indirect
 	github.com/whyrusleeping/multiaddr-filter v0.0.0-20160516205228-e903e4adabd7 // indirect
 	github.com/whyrusleeping/yamux v1.1.2 // indirect
-	golang.org/x/crypto v0.0.0-20181106171534-e4dc69e5b2fd // indirect
-	golang.org/x/net v0.0.0-20181106065722-10aee1819953 // indirect
+	golang.org/x/crypto v0.0.0-20181106171534-e4dc69e5b2fd
+	golang.org/x/net v0.0.0-20181106065722-10aee1819953
 	golang.org/x/sys v0.0.0-20181106135930-3a76605856fd // indirect
 )
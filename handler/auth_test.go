@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+const testToken = "secret-token"
+
+func newTestHandler() *HTTPHandler {
+	return NewHTTPHandler(&types.Config{HTTP: &types.HTTP{Tokens: []string{"other", testToken}}})
+}
+
+func TestFTPLogin(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go newFTPSession(context.Background(), newTestHandler(), server).serve()
+
+	r := bufio.NewReader(client)
+	expect := func(cmd string, code int) {
+		t.Helper()
+		if cmd != "" {
+			fmt.Fprintf(client, "%s\r\n", cmd)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, fmt.Sprint(code)) {
+			t.Fatalf("%s got %q, want %d", cmd, line, code)
+		}
+	}
+	expect("", 220)
+	expect("PWD", 530)
+	expect("USER anonymous", 331)
+	expect("PASS guess", 530)
+	expect("PWD", 530)
+	expect("PASS "+testToken, 230)
+	expect("PWD", 257)
+	expect("QUIT", 221)
+}
+
+func TestWebDAVAuth(t *testing.T) {
+	handler := authenticateDAV([]string{testToken}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for name, c := range map[string]struct {
+		auth string
+		want int
+	}{
+		"none":         {"", http.StatusUnauthorized},
+		"wrong basic":  {"Basic " + basic("user", "guess"), http.StatusUnauthorized},
+		"token basic":  {"Basic " + basic("user", testToken), http.StatusOK},
+		"token bearer": {"Bearer " + testToken, http.StatusOK},
+		"raw token":    {testToken, http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s got %d, want %d", name, w.Code, c.want)
+		}
+	}
+}
+
+func basic(user, password string) string {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth(user, password)
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Basic ")
+}
+
+func TestS3AccessKey(t *testing.T) {
+	for auth, want := range map[string]string{
+		"AWS4-HMAC-SHA256 Credential=AKID/20190101/us-east-1/s3/aws4_request, SignedHeaders=host, Signature=abc": "AKID",
+		"AWS AKID:signature": "AKID",
+		"":                   "",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", auth)
+		if got := s3AccessKey(r); got != want {
+			t.Errorf("%q got %q, want %q", auth, got, want)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/bucket/key?X-Amz-Credential=AKID%2F20190101%2Fus-east-1%2Fs3%2Faws4_request", nil)
+	if got := s3AccessKey(r); got != "AKID" {
+		t.Errorf("presigned got %q", got)
+	}
+}
+
+func TestS3RequiresToken(t *testing.T) {
+	g := &s3Gateway{h: newTestHandler(), uploads: map[string]*s3Upload{}}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "AWS guess:signature")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "InvalidAccessKeyId") {
+		t.Fatalf("wrong access key got %d %s", w.Code, w.Body.String())
+	}
+
+	// with the token, the request reaches the remote peer, which is not
+	// connected
+	r.Header.Set("Authorization", "AWS "+testToken+":signature")
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("token got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,528 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/client"
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+// ftpDataTimeout is how long a passive data connection is waited for
+const ftpDataTimeout = 30 * time.Second
+
+// ftpCommands handles FTP commands, the argument is the rest of the line
+var ftpCommands = map[string]func(s *ftpSession, arg string){
+	"USER": (*ftpSession).user,
+	"PASS": (*ftpSession).pass,
+	"SYST": (*ftpSession).syst,
+	"FEAT": (*ftpSession).feat,
+	"OPTS": (*ftpSession).opts,
+	"NOOP": (*ftpSession).noop,
+	"QUIT": (*ftpSession).quit,
+	"PWD":  (*ftpSession).pwd,
+	"XPWD": (*ftpSession).pwd,
+	"CWD":  (*ftpSession).cwd,
+	"XCWD": (*ftpSession).cwd,
+	"CDUP": (*ftpSession).cdup,
+	"TYPE": (*ftpSession).typ,
+	"MODE": (*ftpSession).mode,
+	"STRU": (*ftpSession).stru,
+	"PASV": (*ftpSession).pasv,
+	"EPSV": (*ftpSession).epsv,
+	"LIST": (*ftpSession).list,
+	"NLST": (*ftpSession).nlst,
+	"MLSD": (*ftpSession).mlsd,
+	"MLST": (*ftpSession).mlst,
+	"SIZE": (*ftpSession).size,
+	"MDTM": (*ftpSession).mdtm,
+	"REST": (*ftpSession).rest,
+	"RETR": (*ftpSession).retr,
+	"STOR": (*ftpSession).stor,
+	"DELE": (*ftpSession).dele,
+	"RMD":  (*ftpSession).dele,
+	"XRMD": (*ftpSession).dele,
+	"MKD":  (*ftpSession).mkd,
+	"XMKD": (*ftpSession).mkd,
+	"RNFR": (*ftpSession).rnfr,
+	"RNTO": (*ftpSession).rnto,
+}
+
+// ftpPublicCommands may be used before logging in
+var ftpPublicCommands = map[string]bool{
+	"USER": true, "PASS": true, "SYST": true, "FEAT": true,
+	"OPTS": true, "NOOP": true, "QUIT": true,
+}
+
+// serveFTP serves FTP on localhost, translating commands into requests to
+// the remote peer, until ctx is done
+func (h *HTTPHandler) serveFTP(ctx context.Context) error {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", h.conf.FTPListenPort))
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("ftp accept: %v", err)
+				}
+				return
+			}
+			go newFTPSession(ctx, h, conn).serve()
+		}
+	}()
+	return nil
+}
+
+// ftpSession is one FTP control connection. Only passive mode is supported,
+// and files are always transferred as binary.
+type ftpSession struct {
+	h    *HTTPHandler
+	ctx  context.Context
+	conn net.Conn
+	r    *bufio.Reader
+
+	dir      string
+	data     net.Listener
+	offset   int64
+	renaming string
+	closed   bool
+	// loggedIn is set once one of the tokens is given as password
+	loggedIn bool
+}
+
+// newFTPSession creates session of control connection, which needs to log
+// in if tokens are configured
+func newFTPSession(ctx context.Context, h *HTTPHandler, conn net.Conn) *ftpSession {
+	return &ftpSession{h: h, ctx: ctx, conn: conn, r: bufio.NewReader(conn), dir: "/",
+		loggedIn: len(h.tokens()) == 0}
+}
+
+func (s *ftpSession) serve() {
+	defer s.conn.Close()
+	defer s.closeData()
+
+	s.reply(220, "p2pftp ready")
+	for !s.closed {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+		cmd = strings.ToUpper(cmd)
+
+		f, ok := ftpCommands[cmd]
+		if !ok {
+			s.reply(502, "Command not implemented")
+			continue
+		}
+		if !s.loggedIn && !ftpPublicCommands[cmd] {
+			s.reply(530, "Please login with USER and PASS")
+			continue
+		}
+		f(s, arg)
+		// restart offset and rename source only apply to the command
+		// right after them
+		if cmd != "REST" {
+			s.offset = 0
+		}
+		if cmd != "RNFR" {
+			s.renaming = ""
+		}
+	}
+}
+
+// reply writes reply line of code
+func (s *ftpSession) reply(code int, format string, args ...interface{}) {
+	fmt.Fprintf(s.conn, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+}
+
+// replyError reports failure of remote request, with code by the kind of
+// error reported by remote peer
+func (s *ftpSession) replyError(err error) {
+	if os.IsNotExist(err) {
+		s.reply(550, "%s", err)
+		return
+	}
+	switch client.KindOf(err) {
+	case client.ErrNotFound, client.ErrPermission, client.ErrInvalidPath:
+		s.reply(550, "%s", err)
+	case client.ErrExist:
+		s.reply(553, "%s", err)
+	case client.ErrQuota:
+		s.reply(552, "%s", err)
+	default:
+		s.reply(451, "%s", err)
+	}
+}
+
+// abs resolves p against working directory
+func (s *ftpSession) abs(p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join(s.dir, p)
+	}
+	return path.Clean(p)
+}
+
+func (s *ftpSession) user(arg string) {
+	if len(s.h.tokens()) == 0 {
+		s.reply(331, "Any password will do")
+		return
+	}
+	s.reply(331, "Password is a token of the HTTP bridge")
+}
+
+func (s *ftpSession) pass(arg string) {
+	if len(s.h.tokens()) > 0 && !validToken(s.h.tokens(), arg) {
+		s.loggedIn = false
+		s.reply(530, "Login incorrect")
+		return
+	}
+	s.loggedIn = true
+	s.reply(230, "Logged in")
+}
+
+func (s *ftpSession) syst(arg string) {
+	s.reply(215, "UNIX Type: L8")
+}
+
+func (s *ftpSession) feat(arg string) {
+	fmt.Fprintf(s.conn, "211-Features:\r\n EPSV\r\n MDTM\r\n MLST type*;size*;modify*;\r\n PASV\r\n REST STREAM\r\n SIZE\r\n UTF8\r\n")
+	s.reply(211, "End")
+}
+
+func (s *ftpSession) opts(arg string) {
+	if strings.EqualFold(arg, "UTF8 ON") {
+		s.reply(200, "Always in UTF8 mode")
+		return
+	}
+	s.reply(501, "Option not understood")
+}
+
+func (s *ftpSession) noop(arg string) {
+	s.reply(200, "OK")
+}
+
+func (s *ftpSession) quit(arg string) {
+	s.reply(221, "Goodbye")
+	s.closed = true
+}
+
+func (s *ftpSession) pwd(arg string) {
+	s.reply(257, "\"%s\" is current directory", strings.Replace(s.dir, "\"", "\"\"", -1))
+}
+
+func (s *ftpSession) cwd(arg string) {
+	dir := s.abs(arg)
+	info, err := s.h.remoteStat(s.ctx, dir)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	if !info.IsDir {
+		s.reply(550, "%s: not a directory", dir)
+		return
+	}
+	s.dir = dir
+	s.reply(250, "Directory changed to %s", dir)
+}
+
+func (s *ftpSession) cdup(arg string) {
+	s.cwd("..")
+}
+
+func (s *ftpSession) typ(arg string) {
+	s.reply(200, "Type set to %s", arg)
+}
+
+func (s *ftpSession) mode(arg string) {
+	if !strings.EqualFold(arg, "S") {
+		s.reply(504, "Only stream mode is supported")
+		return
+	}
+	s.reply(200, "Mode set to S")
+}
+
+func (s *ftpSession) stru(arg string) {
+	if !strings.EqualFold(arg, "F") {
+		s.reply(504, "Only file structure is supported")
+		return
+	}
+	s.reply(200, "Structure set to F")
+}
+
+// listenData opens listener of next passive data connection
+func (s *ftpSession) listenData() (int, error) {
+	s.closeData()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	s.data = l
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (s *ftpSession) closeData() {
+	if s.data != nil {
+		s.data.Close()
+		s.data = nil
+	}
+}
+
+func (s *ftpSession) pasv(arg string) {
+	port, err := s.listenData()
+	if err != nil {
+		s.reply(425, "%s", err)
+		return
+	}
+	s.reply(227, "Entering Passive Mode (127,0,0,1,%d,%d)", port>>8, port&0xff)
+}
+
+func (s *ftpSession) epsv(arg string) {
+	port, err := s.listenData()
+	if err != nil {
+		s.reply(425, "%s", err)
+		return
+	}
+	s.reply(229, "Entering Extended Passive Mode (|||%d|)", port)
+}
+
+// transfer accepts the passive data connection and runs f on it, replying
+// before and after
+func (s *ftpSession) transfer(f func(conn net.Conn) error) {
+	if s.data == nil {
+		s.reply(425, "Use PASV or EPSV first")
+		return
+	}
+	l := s.data.(*net.TCPListener)
+	defer s.closeData()
+
+	s.reply(150, "Opening data connection")
+	l.SetDeadline(time.Now().Add(ftpDataTimeout))
+	conn, err := l.Accept()
+	if err != nil {
+		s.reply(425, "%s", err)
+		return
+	}
+	err = f(conn)
+	if cerr := conn.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(226, "Transfer complete")
+}
+
+// listArg strips options like -la given by some clients to LIST
+func listArg(arg string) string {
+	for _, field := range strings.Fields(arg) {
+		if !strings.HasPrefix(field, "-") {
+			return field
+		}
+	}
+	return ""
+}
+
+// listFiles returns entries of directory, or the file itself
+func (s *ftpSession) listFiles(p string) ([]types.FileInfo, error) {
+	info, err := s.h.remoteStat(s.ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir {
+		return []types.FileInfo{*info}, nil
+	}
+	return s.h.remoteList(s.ctx, p)
+}
+
+func (s *ftpSession) list(arg string) {
+	files, err := s.listFiles(s.abs(listArg(arg)))
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.transfer(func(conn net.Conn) error {
+		w := bufio.NewWriter(conn)
+		for _, file := range files {
+			mode := file.Mode
+			if file.IsDir {
+				mode |= os.ModeDir
+			}
+			modTime := file.ModTime.Format("Jan _2 15:04")
+			if time.Since(file.ModTime) > 180*24*time.Hour {
+				modTime = file.ModTime.Format("Jan _2  2006")
+			}
+			fmt.Fprintf(w, "%s 1 p2pftp p2pftp %12d %s %s\r\n", mode, file.Size, modTime, file.Name)
+		}
+		return w.Flush()
+	})
+}
+
+func (s *ftpSession) nlst(arg string) {
+	files, err := s.listFiles(s.abs(listArg(arg)))
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.transfer(func(conn net.Conn) error {
+		w := bufio.NewWriter(conn)
+		for _, file := range files {
+			fmt.Fprintf(w, "%s\r\n", file.Name)
+		}
+		return w.Flush()
+	})
+}
+
+// facts formats metadata of file as in RFC 3659
+func facts(file types.FileInfo) string {
+	typ := "file"
+	if file.IsDir {
+		typ = "dir"
+	}
+	return fmt.Sprintf("type=%s;size=%d;modify=%s; %s", typ, file.Size, file.ModTime.UTC().Format("20060102150405"), file.Name)
+}
+
+func (s *ftpSession) mlsd(arg string) {
+	dir := s.abs(arg)
+	info, err := s.h.remoteStat(s.ctx, dir)
+	if err == nil && !info.IsDir {
+		s.reply(501, "%s: not a directory", dir)
+		return
+	}
+	var files []types.FileInfo
+	if err == nil {
+		files, err = s.h.remoteList(s.ctx, dir)
+	}
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.transfer(func(conn net.Conn) error {
+		w := bufio.NewWriter(conn)
+		for _, file := range files {
+			fmt.Fprintf(w, "%s\r\n", facts(file))
+		}
+		return w.Flush()
+	})
+}
+
+func (s *ftpSession) mlst(arg string) {
+	p := s.abs(arg)
+	info, err := s.h.remoteStat(s.ctx, p)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	info.Name = p
+	fmt.Fprintf(s.conn, "250-Listing %s\r\n %s\r\n", p, facts(*info))
+	s.reply(250, "End")
+}
+
+func (s *ftpSession) size(arg string) {
+	info, err := s.h.remoteStat(s.ctx, s.abs(arg))
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	if info.IsDir {
+		s.reply(550, "%s: not a regular file", arg)
+		return
+	}
+	s.reply(213, "%d", info.Size)
+}
+
+func (s *ftpSession) mdtm(arg string) {
+	info, err := s.h.remoteStat(s.ctx, s.abs(arg))
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(213, "%s", info.ModTime.UTC().Format("20060102150405"))
+}
+
+func (s *ftpSession) rest(arg string) {
+	offset, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || offset < 0 {
+		s.reply(501, "Invalid offset %s", arg)
+		return
+	}
+	s.offset = offset
+	s.reply(350, "Restarting at %d", offset)
+}
+
+func (s *ftpSession) retr(arg string) {
+	p, offset := s.abs(arg), s.offset
+	s.transfer(func(conn net.Conn) error {
+		return s.h.remoteGet(s.ctx, p, offset, conn)
+	})
+}
+
+func (s *ftpSession) stor(arg string) {
+	if s.offset > 0 {
+		s.reply(504, "Restarting uploads is not supported")
+		return
+	}
+	p := s.abs(arg)
+	s.transfer(func(conn net.Conn) error {
+		return s.h.remotePut(s.ctx, p, conn, -1)
+	})
+}
+
+func (s *ftpSession) dele(arg string) {
+	if err := s.h.remoteRemove(s.ctx, s.abs(arg)); err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(250, "Deleted %s", arg)
+}
+
+func (s *ftpSession) mkd(arg string) {
+	dir := s.abs(arg)
+	if err := s.h.remoteMkdir(s.ctx, dir); err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(257, "\"%s\" created", strings.Replace(dir, "\"", "\"\"", -1))
+}
+
+func (s *ftpSession) rnfr(arg string) {
+	p := s.abs(arg)
+	if _, err := s.h.remoteStat(s.ctx, p); err != nil {
+		s.replyError(err)
+		return
+	}
+	s.renaming = p
+	s.reply(350, "Ready for RNTO")
+}
+
+func (s *ftpSession) rnto(arg string) {
+	if s.renaming == "" {
+		s.reply(503, "Use RNFR first")
+		return
+	}
+	if err := s.h.remoteRename(s.ctx, s.renaming, s.abs(arg)); err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(250, "Renamed to %s", arg)
+}
@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/leslie-wang/libp2p-ftp/node"
+)
+
+func TestFTPReplyError(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	s := newFTPSession(context.Background(), newTestHandler(), server)
+	r := bufio.NewReader(client)
+
+	for _, c := range []struct {
+		err  error
+		code string
+	}{
+		{&os.PathError{Op: "open", Path: "/a", Err: os.ErrNotExist}, "550"},
+		{&node.RemoteError{Message: "stat /a: file does not exist"}, "550"},
+		{&node.RemoteError{Message: "remove /a: permission denied"}, "550"},
+		{&node.RemoteError{Message: "mkdir /a: file exists"}, "553"},
+		{&node.RemoteError{Message: "open /a: disk quota exceeded"}, "552"},
+		// reasons are matched after the path, not within it
+		{&node.RemoteError{Message: "open /no such file/a: broken pipe"}, "451"},
+		{errNotConnected, "451"},
+		{errors.New("broken"), "451"},
+	} {
+		go s.replyError(c.err)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, c.code+" ") {
+			t.Errorf("%v got %q, want %s", c.err, line, c.code)
+		}
+	}
+}
@@ -2,15 +2,19 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
-	"time"
 
+	"github.com/leslie-wang/libp2p-ftp/client"
+	"github.com/leslie-wang/libp2p-ftp/crypt"
 	"github.com/leslie-wang/libp2p-ftp/node"
 	"github.com/leslie-wang/libp2p-ftp/types"
 )
@@ -18,124 +22,373 @@ import (
 // HTTPHandler is the struct for handler request
 type HTTPHandler struct {
 	conf *types.Config
-	node *node.Node
+	sup  *supervisor
+	// cipher encrypts files before upload, nil if encryption is disabled
+	cipher *crypt.Cipher
 }
 
 // NewHTTPHandler creates one handler
 func NewHTTPHandler(c *types.Config) *HTTPHandler {
-	return &HTTPHandler{conf: c}
+	return &HTTPHandler{conf: c, sup: newSupervisor(c)}
 }
 
 // Close is to close handler and its corresponding host
 func (h *HTTPHandler) Close() {
-	h.node.Close()
+	h.sup.Close()
 }
 
-// Serve starts node
-func (h *HTTPHandler) Serve(ctx context.Context) error {
-	if err := h.connect(ctx); err != nil {
-		return err
+// Start connects to remote peer, after which requests can be served by Mux
+func (h *HTTPHandler) Start(ctx context.Context) error {
+	if h.conf.Encryption != nil {
+		c, err := crypt.New(*h.conf.Encryption)
+		if err != nil {
+			return err
+		}
+		h.cipher = c
 	}
+	return h.sup.Start(ctx)
+}
 
-	go h.ping()
-
-	http.HandleFunc(types.ListURL, h.list)
-	http.HandleFunc(types.DeleteURL, h.delete)
-	http.HandleFunc(types.GetURL, h.get)
-	http.HandleFunc(types.PutURL, h.put)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", h.conf.HTTPListenPort), nil))
+// Mux returns the HTTP API, both the REST API and the endpoints used by
+// the p2pftp command
+func (h *HTTPHandler) Mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(types.ListURL, h.list)
+	mux.HandleFunc(types.DeleteURL, allowMethods(h.delete, http.MethodPost, http.MethodDelete))
+	mux.HandleFunc(types.GetURL, h.get)
+	mux.HandleFunc(types.PutURL, allowMethods(h.put, http.MethodPut, http.MethodPost))
+	mux.HandleFunc(types.StatusURL, h.status)
+	mux.HandleFunc(types.VersionsURL, h.versions)
+	mux.HandleFunc(types.RestoreURL, allowMethods(h.restore, http.MethodPost))
+	mux.HandleFunc(types.TrashURL, h.trash)
+	mux.HandleFunc(types.UndeleteURL, allowMethods(h.undelete, http.MethodPost))
+	mux.HandleFunc(types.QuotaURL, h.quota)
+	mux.HandleFunc(types.ConnectionURL, h.connection)
+	h.registerAPI(mux)
+	return mux
+}
 
-	select {}
+// allowMethods passes requests with one of methods on to handler, so that
+// routes changing remote files cannot be triggered by plain GET of a link
+func allowMethods(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range methods {
+			if r.Method == method {
+				handler(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		http.Error(w, r.Method+" is not allowed", http.StatusMethodNotAllowed)
+	}
 }
 
-func (h *HTTPHandler) connect(ctx context.Context) error {
-	var err error
-	h.node, err = node.StartNode(ctx, "", h.conf.BootstrapNodes)
-	if err != nil {
+// Serve starts node and the front ends, and serves until ctx is done or the
+// HTTP bridge fails
+func (h *HTTPHandler) Serve(ctx context.Context) error {
+	// front ends stop with ctx, also when the HTTP bridge fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := h.Start(ctx); err != nil {
 		return err
 	}
+	if h.conf.FTPListenPort > 0 {
+		if err := h.serveFTP(ctx); err != nil {
+			return err
+		}
+	}
+	if h.conf.SFTP != nil {
+		if err := h.serveSFTP(ctx); err != nil {
+			return err
+		}
+	}
+	if h.conf.WebDAVListenPort > 0 {
+		if err := h.serveWebDAV(ctx); err != nil {
+			return err
+		}
+	}
+	if h.conf.S3ListenPort > 0 {
+		if err := h.serveS3(ctx); err != nil {
+			return err
+		}
+	}
 
-	return h.node.FindPeer(ctx, h.conf.ServerID)
+	return h.serveHTTP(ctx, h.Mux())
 }
 
-func (h *HTTPHandler) ping() {
-	failCount := 0
-	for {
-		time.Sleep(h.conf.RetryInterval)
-		if failCount > 100 {
-			// start reconnect
-			if err := h.node.Close(); err != nil {
-				fmt.Printf("node close got: %v\n", err)
-				continue
-			}
-			if err := h.connect(context.Background()); err != nil {
-				fmt.Printf("node connect got: %v\n", err)
-				continue
-			}
-		}
-		if err := h.node.PingRequest(context.Background()); err != nil {
-			fmt.Printf("ping got: %v", err)
-			failCount++
-		} else {
-			failCount = 0
-		}
+// remotePath returns path of file on remote peer, which has encrypted
+// names if configured
+func (h *HTTPHandler) remotePath(p string) string {
+	if h.cipher == nil {
+		return p
 	}
+	return h.cipher.EncryptPath(p)
 }
 
 func (h *HTTPHandler) list(w http.ResponseWriter, r *http.Request) {
-	files, err := h.node.ListRequest(context.Background(), r.URL.Query().Get(types.QueryKeyDestination))
+	dir := r.URL.Query().Get(types.QueryKeyDestination)
+	var files []string
+	err := h.sup.Do(func(n *node.Node) (err error) {
+		files, err = n.ListRequest(r.Context(), h.remotePath(dir))
+		return
+	})
 	if err != nil {
 		writeError(w, err)
 		return
 	}
+	if h.cipher != nil {
+		for i, file := range files {
+			// names not encrypted with our key are listed as they are
+			if name, err := h.cipher.DecryptName(dir, file); err == nil {
+				files[i] = name
+			}
+		}
+	}
 
 	w.Write([]byte(strings.Join(files, "\n")))
 }
 
 func (h *HTTPHandler) delete(w http.ResponseWriter, r *http.Request) {
-	if err := h.node.DeleteRequest(context.Background(), r.URL.Query().Get(types.QueryKeyDestination)); err != nil {
+	dst := h.remotePath(r.URL.Query().Get(types.QueryKeyDestination))
+	permanent, _ := strconv.ParseBool(r.URL.Query().Get(types.QueryKeyPermanent))
+	err := h.sup.Do(func(n *node.Node) error {
+		if permanent {
+			return n.PurgeRequest(r.Context(), dst)
+		}
+		return n.DeleteRequest(r.Context(), dst)
+	})
+	if err != nil {
 		writeError(w, err)
 		return
 	}
 }
 
+// get streams remote file, or its previous version, in the response body
 func (h *HTTPHandler) get(w http.ResponseWriter, r *http.Request) {
 	dst := r.URL.Query().Get(types.QueryKeyDestination)
-	src := r.URL.Query().Get(types.QueryKeySource)
-	filename := path.Base(dst)
-	f, err := os.Create(path.Join(src, filename))
+	if version := r.URL.Query().Get(types.QueryKeyVersion); version != "" {
+		h.getVersion(w, r, dst, version)
+		return
+	}
+	info, err := h.remoteStat(r.Context(), dst)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
-	defer f.Close()
+	if info.IsDir {
+		http.Error(w, dst+" is a directory", http.StatusBadRequest)
+		return
+	}
+	h.serveFile(w, r, dst, info)
+}
+
+// serveFile streams remote file with range and conditional requests
+// handled, browsers save it under its own name
+func (h *HTTPHandler) serveFile(w http.ResponseWriter, r *http.Request, p string, info *types.FileInfo) {
+	contentType := mime.TypeByExtension(path.Ext(p))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(p)}))
+
+	reader := &remoteReader{h: h, ctx: r.Context(), path: p, size: info.Size}
+	defer reader.Close()
+	http.ServeContent(w, r, "", info.ModTime, io.NewSectionReader(reader, 0, info.Size))
+}
 
-	if err := h.node.GetRequest(context.Background(), dst, f); err != nil {
+// getVersion streams previous version of remote file, which is looked up
+// first for its size. Versions are always sent whole.
+func (h *HTTPHandler) getVersion(w http.ResponseWriter, r *http.Request, dst, version string) {
+	remote := h.remotePath(dst)
+	var versions []types.FileInfo
+	err := h.sup.Do(func(n *node.Node) (err error) {
+		versions, err = n.VersionsRequest(r.Context(), remote)
+		return
+	})
+	if err != nil {
 		writeError(w, err)
 		return
 	}
+	size := int64(-1)
+	for _, v := range versions {
+		if v.Version == version {
+			size = v.Size
+		}
+	}
+	if size < 0 {
+		http.Error(w, fmt.Sprintf("version %s of %s not found", version, dst), http.StatusNotFound)
+		return
+	}
+	if h.cipher != nil && h.cipher.Encrypted(dst) {
+		if size, err = h.cipher.DecryptedSize(size); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(dst)}))
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	err = h.sup.Do(func(n *node.Node) error {
+		return h.cipher.Download(dst, w, 0, func(w io.Writer) error {
+			_, err := n.GetVersionRequest(r.Context(), remote, version, w)
+			return err
+		})
+	})
+	if err != nil {
+		// status is sent already, the client sees the short body
+		log.Printf("get %s version %s: %v", dst, version, err)
+	}
 }
 
+// put uploads request body as remote file
 func (h *HTTPHandler) put(w http.ResponseWriter, r *http.Request) {
 	dst := r.URL.Query().Get(types.QueryKeyDestination)
-	src := r.URL.Query().Get(types.QueryKeySource)
+	if err := h.remotePut(r.Context(), dst, r.Body, r.ContentLength); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+func (h *HTTPHandler) versions(w http.ResponseWriter, r *http.Request) {
+	dst := r.URL.Query().Get(types.QueryKeyDestination)
+	var versions []types.FileInfo
+	err := h.sup.Do(func(n *node.Node) (err error) {
+		versions, err = n.VersionsRequest(r.Context(), h.remotePath(dst))
+		return
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if h.cipher != nil && h.cipher.Encrypted(dst) {
+		for i := range versions {
+			versions[i].Name = path.Base(dst)
+			if size, err := h.cipher.DecryptedSize(versions[i].Size); err == nil {
+				versions[i].Size = size
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+func (h *HTTPHandler) restore(w http.ResponseWriter, r *http.Request) {
+	var info *types.FileInfo
+	err := h.sup.Do(func(n *node.Node) (err error) {
+		info, err = n.RestoreRequest(r.Context(), h.remotePath(r.URL.Query().Get(types.QueryKeyDestination)),
+			r.URL.Query().Get(types.QueryKeyVersion))
+		return
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func (h *HTTPHandler) trash(w http.ResponseWriter, r *http.Request) {
+	var entries []types.TrashEntry
+	err := h.sup.Do(func(n *node.Node) (err error) {
+		entries, err = n.TrashRequest(r.Context(), h.remotePath(r.URL.Query().Get(types.QueryKeyDestination)))
+		return
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for i := range entries {
+		h.cipher.DecryptEntry(&entries[i])
+	}
 
-	content, err := ioutil.ReadFile(src)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (h *HTTPHandler) undelete(w http.ResponseWriter, r *http.Request) {
+	var info *types.FileInfo
+	err := h.sup.Do(func(n *node.Node) (err error) {
+		info, err = n.UndeleteRequest(r.Context(), h.remotePath(r.URL.Query().Get(types.QueryKeyDestination)),
+			r.URL.Query().Get(types.QueryKeyID))
+		return
+	})
 	if err != nil {
 		writeError(w, err)
 		return
 	}
 
-	if strings.HasSuffix(dst, "/") {
-		dst = path.Join(dst, path.Base(src))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func (h *HTTPHandler) quota(w http.ResponseWriter, r *http.Request) {
+	var q *types.QuotaStatus
+	err := h.sup.Do(func(n *node.Node) (err error) {
+		q, err = n.QuotaRequest(r.Context())
+		return
+	})
+	if err != nil {
+		writeError(w, err)
+		return
 	}
 
-	if err := h.node.PutRequest(context.Background(), content, dst); err != nil {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q)
+}
+
+func (h *HTTPHandler) status(w http.ResponseWriter, r *http.Request) {
+	var s *types.Status
+	err := h.sup.Do(func(n *node.Node) (err error) {
+		if remote, _ := strconv.ParseBool(r.URL.Query().Get(types.QueryKeyRemote)); remote {
+			s, err = n.StatusRequest(r.Context())
+		} else {
+			s = n.Status()
+		}
+		return
+	})
+	if err != nil {
 		writeError(w, err)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func (h *HTTPHandler) connection(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.sup.State())
 }
 
 func writeError(w http.ResponseWriter, err error) {
-	http.Error(w, err.Error(), http.StatusInternalServerError)
+	http.Error(w, err.Error(), httpStatus(err))
+}
+
+// httpStatus maps error, which is classified by its kind if reported by
+// remote peer, onto HTTP status
+func httpStatus(err error) int {
+	if err == errNotConnected {
+		return http.StatusServiceUnavailable
+	}
+	if os.IsNotExist(err) {
+		return http.StatusNotFound
+	}
+	switch client.KindOf(err) {
+	case client.ErrNotFound:
+		return http.StatusNotFound
+	case client.ErrPermission:
+		return http.StatusForbidden
+	case client.ErrExist:
+		return http.StatusConflict
+	case client.ErrQuota:
+		return http.StatusInsufficientStorage
+	case client.ErrInvalidPath:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
 }
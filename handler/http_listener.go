@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/leslie-wang/libp2p-ftp/server"
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+// serveHTTP serves handler on the configured TCP address or Unix domain
+// socket, with TLS if configured, until it fails or ctx is done. In-flight
+// requests are waited for on shutdown.
+func (h *HTTPHandler) serveHTTP(ctx context.Context, handler http.Handler) error {
+	conf := h.conf.HTTP
+	if conf == nil {
+		conf = &types.HTTP{}
+	}
+	l, err := listenHTTP(conf, h.conf.HTTPListenPort)
+	if err != nil {
+		return err
+	}
+	if len(conf.Tokens) > 0 {
+		handler = authenticate(conf.Tokens, handler)
+	}
+	handler = sameOrigin(handler)
+
+	srv := &http.Server{Handler: handler}
+	done := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), server.DefaultDrainTimeout)
+		defer cancel()
+		done <- srv.Shutdown(sctx)
+	}()
+	if conf.CertFile != "" {
+		err = srv.ServeTLS(l, conf.CertFile, conf.KeyFile)
+	} else {
+		err = srv.Serve(l)
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return <-done
+}
+
+// listenHTTP listens on socket, which only its owner may connect to, or on
+// port of localhost unless another address is configured
+func listenHTTP(conf *types.HTTP, port int) (net.Listener, error) {
+	if conf.Socket != "" {
+		// socket of an earlier run is left behind unless it shut down cleanly
+		if info, err := os.Stat(conf.Socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(conf.Socket)
+		}
+		l, err := net.Listen("unix", conf.Socket)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(conf.Socket, 0600); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+
+	addr := conf.ListenAddr
+	if addr == "" {
+		addr = "127.0.0.1"
+	}
+	return net.Listen("tcp", net.JoinHostPort(addr, fmt.Sprint(port)))
+}
+
+// authenticate passes requests bearing one of tokens on to handler. Links
+// of the web UI carry the token as access_token query, and the page itself
+// needs none.
+func authenticate(tokens []string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if auth == "" && r.URL.Query().Get("access_token") != "" {
+			auth = "Bearer " + r.URL.Query().Get("access_token")
+		}
+		if strings.HasPrefix(auth, "Bearer ") && validToken(tokens, strings.TrimPrefix(auth, "Bearer ")) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="p2pftp"`)
+		http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+	})
+}
+
+// sameOrigin rejects requests which browsers send on behalf of other sites,
+// so that a web page cannot use the bridge even when it needs no token
+func sameOrigin(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		site := r.Header.Get("Sec-Fetch-Site")
+		origin := r.Header.Get("Origin")
+		if site == "cross-site" || site == "same-site" || (origin != "" && !originOf(r, origin)) {
+			http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// originOf tells if origin is the one of the bridge itself
+func originOf(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// validToken tells if given is one of tokens
+func validToken(tokens []string, given string) bool {
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// tokens returns the tokens of the HTTP bridge, which the other front ends
+// of the connect daemon require as well
+func (h *HTTPHandler) tokens() []string {
+	if h.conf.HTTP == nil {
+		return nil
+	}
+	return h.conf.HTTP.Tokens
+}
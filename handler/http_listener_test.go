@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+func TestServeHTTPShutdown(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "http.sock")
+	h := NewHTTPHandler(&types.Config{HTTP: &types.HTTP{Socket: socket}})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- h.serveHTTP(ctx, handler) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	replied := make(chan error, 1)
+	go func() {
+		for {
+			resp, err := client.Get("http://unix/")
+			if err == nil {
+				resp.Body.Close()
+				replied <- nil
+				return
+			}
+			// the listener may not be up yet
+			select {
+			case <-started:
+				replied <- err
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	<-started
+	cancel()
+	select {
+	case err := <-served:
+		t.Fatalf("returned with request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err := <-replied; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	handler := sameOrigin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for name, c := range map[string]struct {
+		header, value string
+		want          int
+	}{
+		"cli":               {"", "", http.StatusOK},
+		"same origin":       {"Origin", "http://localhost:8077", http.StatusOK},
+		"other origin":      {"Origin", "http://evil.example", http.StatusForbidden},
+		"other port":        {"Origin", "http://localhost:8078", http.StatusForbidden},
+		"same origin fetch": {"Sec-Fetch-Site", "same-origin", http.StatusOK},
+		"cross site fetch":  {"Sec-Fetch-Site", "cross-site", http.StatusForbidden},
+		"same site fetch":   {"Sec-Fetch-Site", "same-site", http.StatusForbidden},
+		"typed in address":  {"Sec-Fetch-Site", "none", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost:8077/p2pftp/v1/list", nil)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s got %d, want %d", name, w.Code, c.want)
+		}
+	}
+}
+
+func TestLegacyRoutesRejectGet(t *testing.T) {
+	mux := newTestHandler().Mux()
+	for route, method := range map[string]string{
+		types.DeleteURL:   http.MethodDelete,
+		types.RestoreURL:  http.MethodPost,
+		types.UndeleteURL: http.MethodPost,
+		types.PutURL:      http.MethodPut,
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, route+"?dst=/file", nil))
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") == "" {
+			t.Errorf("GET %s got %d, Allow %q", route, w.Code, w.Header().Get("Allow"))
+		}
+		// the request reaches the remote peer, which is not connected
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, route+"?dst=/file", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s got %d", method, route, w.Code)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+
+	"github.com/leslie-wang/libp2p-ftp/node"
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	circuit "github.com/libp2p/go-libp2p-circuit"
+)
+
+// RelayHandler runs a circuit relay node for peers behind NAT
+type RelayHandler struct {
+	conf        *types.Config
+	listenAddrs []string
+	node        *node.Node
+}
+
+// NewRelayHandler creates one relay handler listening on given addresses
+func NewRelayHandler(c *types.Config, listenAddrs []string) *RelayHandler {
+	return &RelayHandler{conf: c, listenAddrs: listenAddrs}
+}
+
+// Close is to close handler and its corresponding host
+func (h *RelayHandler) Close() {
+	if h.node != nil {
+		h.node.Close()
+	}
+}
+
+// relayConfig returns configuration of relay node. It only shares bootstrap
+// nodes and transports with the listener, so both can run from one config
+// without sharing ports, datastore or connection limits. A relay never uses
+// other relays itself.
+func (h *RelayHandler) relayConfig() *types.Config {
+	conf := &types.Config{
+		BootstrapNodes: h.conf.BootstrapNodes,
+		Transports:     h.conf.Transports,
+		ListenAddrs:    h.listenAddrs,
+	}
+	if h.conf.DatastoreDir != "" {
+		conf.DatastoreDir = filepath.Join(h.conf.DatastoreDir, "relay")
+	}
+	return conf
+}
+
+// Serve starts relay node, and relays until ctx is done
+func (h *RelayHandler) Serve(ctx context.Context) (err error) {
+	h.node, err = node.StartNode(ctx, h.conf.RelayPrivateKey, h.relayConfig(), libp2p.EnableRelay(circuit.OptHop))
+	if err != nil {
+		return
+	}
+
+	for _, addr := range h.node.Host().Addrs() {
+		log.Printf("relay address: %s/ipfs/%s", addr, h.node.Host().ID().Pretty())
+	}
+
+	<-ctx.Done()
+	return nil
+}
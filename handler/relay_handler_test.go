@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/leslie-wang/libp2p-ftp/node"
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	host "github.com/libp2p/go-libp2p-host"
+)
+
+// p2pAddr returns IPv4 address of h with its peer ID
+func p2pAddr(t *testing.T, h host.Host) string {
+	for _, addr := range h.Addrs() {
+		if strings.HasPrefix(addr.String(), "/ip4/") {
+			return addr.String() + "/ipfs/" + h.ID().Pretty()
+		}
+	}
+	t.Fatalf("%s listens on no IPv4 address: %v", h.ID().Pretty(), h.Addrs())
+	return ""
+}
+
+func TestRelayConfig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bootstrap, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bootstrap.Close()
+
+	dir := t.TempDir()
+	h := NewRelayHandler(&types.Config{
+		BootstrapNodes:   []string{p2pAddr(t, bootstrap)},
+		ListenAddrs:      []string{"/ip4/127.0.0.1/tcp/0", "/ip4/127.0.0.1/tcp/0/ws"},
+		DatastoreDir:     dir,
+		ConnMgrHighWater: 10,
+		RelayNodes:       []string{"/ip4/127.0.0.1/tcp/1/ipfs/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"},
+	}, []string{"/ip4/127.0.0.1/tcp/0"})
+
+	conf := h.relayConfig()
+	if conf.DatastoreDir != filepath.Join(dir, "relay") {
+		t.Fatalf("relay datastore %s", conf.DatastoreDir)
+	}
+	if conf.ConnMgrHighWater != 0 || len(conf.RelayNodes) != 0 {
+		t.Fatalf("relay takes listener settings: %+v", conf)
+	}
+	n, err := node.StartNode(ctx, "", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	// only the relay's own address is listened on
+	var addrs []string
+	for _, addr := range n.Host().Network().ListenAddresses() {
+		if strings.HasPrefix(addr.String(), "/ip4/") {
+			addrs = append(addrs, addr.String())
+		}
+	}
+	if len(addrs) != 1 || strings.HasSuffix(addrs[0], "/ws") {
+		t.Fatalf("relay listens on %v", addrs)
+	}
+}
@@ -0,0 +1,210 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/node"
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+// The remote file operations below are shared by the protocol front ends of
+// the connect daemon. They run through the supervised node, and encrypt and
+// decrypt files if configured.
+
+// remoteList returns metadata of files under remote directory
+func (h *HTTPHandler) remoteList(ctx context.Context, dir string) ([]types.FileInfo, error) {
+	var files []types.FileInfo
+	err := h.sup.Do(func(n *node.Node) (err error) {
+		files, err = n.ListDetailRequest(ctx, h.remotePath(dir))
+		return
+	})
+	for i := range files {
+		h.cipher.DecryptInfo(dir, &files[i])
+	}
+	return files, err
+}
+
+// remoteStat returns metadata of one remote file
+func (h *HTTPHandler) remoteStat(ctx context.Context, p string) (*types.FileInfo, error) {
+	var info *types.FileInfo
+	err := h.sup.Do(func(n *node.Node) (err error) {
+		info, err = n.StatRequest(ctx, h.remotePath(p))
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.cipher.DecryptInfo(path.Dir(p), info)
+	return info, nil
+}
+
+// remoteGet writes content of remote file from offset on into w
+func (h *HTTPHandler) remoteGet(ctx context.Context, p string, offset int64, w io.Writer) error {
+	remote := h.remotePath(p)
+	return h.sup.Do(func(n *node.Node) error {
+		if h.cipher == nil || !h.cipher.Encrypted(p) {
+			var err error
+			if offset > 0 {
+				_, err = n.GetRangeRequest(ctx, remote, offset, w)
+			} else {
+				_, err = n.GetRequest(ctx, remote, w)
+			}
+			return err
+		}
+		return h.cipher.Download(p, w, offset, func(w io.Writer) error {
+			_, err := n.GetRequest(ctx, remote, w)
+			return err
+		})
+	})
+}
+
+// remotePut uploads content of r as remote file. Content of unknown size is
+// spooled into a temporary file first, since its size is sent ahead.
+func (h *HTTPHandler) remotePut(ctx context.Context, p string, r io.Reader, size int64) error {
+	if size < 0 {
+		f, err := ioutil.TempFile("", "p2pftp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if size, err = io.Copy(f, r); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r = f
+	}
+	remote := h.remotePath(p)
+	r, size = h.cipher.Upload(p, r, size)
+	return h.sup.Do(func(n *node.Node) error {
+		return n.PutRequest(ctx, r, size, remote)
+	})
+}
+
+// remoteRemove removes remote file or empty directory
+func (h *HTTPHandler) remoteRemove(ctx context.Context, p string) error {
+	return h.sup.Do(func(n *node.Node) error {
+		return n.DeleteRequest(ctx, h.remotePath(p))
+	})
+}
+
+// remoteMkdir creates remote directory and its parents
+func (h *HTTPHandler) remoteMkdir(ctx context.Context, p string) error {
+	return h.sup.Do(func(n *node.Node) error {
+		_, err := n.MkdirRequest(ctx, h.remotePath(p))
+		return err
+	})
+}
+
+// remoteRename moves remote file or directory to newname
+func (h *HTTPHandler) remoteRename(ctx context.Context, oldname, newname string) error {
+	return h.sup.Do(func(n *node.Node) error {
+		_, err := n.RenameRequest(ctx, h.remotePath(oldname), h.remotePath(newname))
+		return err
+	})
+}
+
+// fileInfo is os.FileInfo of remote file
+type fileInfo struct {
+	info types.FileInfo
+}
+
+func (fi fileInfo) Name() string       { return fi.info.Name }
+func (fi fileInfo) Size() int64        { return fi.info.Size }
+func (fi fileInfo) ModTime() time.Time { return fi.info.ModTime }
+func (fi fileInfo) IsDir() bool        { return fi.info.IsDir }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+func (fi fileInfo) Mode() os.FileMode {
+	if fi.info.IsDir {
+		return fi.info.Mode | os.ModeDir
+	}
+	return fi.info.Mode
+}
+
+// remoteReader reads remote file through one get request as long as reads
+// are sequential, and restarts it at the new offset otherwise
+type remoteReader struct {
+	h    *HTTPHandler
+	ctx  context.Context
+	path string
+	size int64
+
+	lock   sync.Mutex
+	r      *io.PipeReader
+	offset int64
+}
+
+func (r *remoteReader) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if r.r == nil || off != r.offset {
+		r.close()
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(r.h.remoteGet(r.ctx, r.path, off, pw))
+		}()
+		r.r, r.offset = pr, off
+	}
+	n, err := io.ReadFull(r.r, p)
+	r.offset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if err != nil && err != io.EOF {
+		r.close()
+	}
+	return n, err
+}
+
+func (r *remoteReader) close() {
+	if r.r != nil {
+		r.r.Close()
+		r.r = nil
+	}
+}
+
+// Close stops the get request in flight
+func (r *remoteReader) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.close()
+	return nil
+}
+
+// remoteWriter collects written content in a temporary file, and uploads it
+// once closed
+type remoteWriter struct {
+	h    *HTTPHandler
+	ctx  context.Context
+	path string
+	f    *os.File
+}
+
+func (w *remoteWriter) WriteAt(p []byte, off int64) (int, error) {
+	return w.f.WriteAt(p, off)
+}
+
+// Close uploads written content as remote file
+func (w *remoteWriter) Close() error {
+	defer os.Remove(w.f.Name())
+	defer w.f.Close()
+
+	info, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	return w.h.remotePut(w.ctx, w.path, io.NewSectionReader(w.f, 0, info.Size()), info.Size())
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/leslie-wang/libp2p-ftp/storage"
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+func TestRemoteReader(t *testing.T) {
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	for name, encryption := range map[string]*types.Encryption{
+		"plain": nil,
+		// encrypted files are always read from the start, and the head is
+		// skipped
+		"encrypted": {Key: "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="},
+	} {
+		h := newTestAPI(t, storage.NewMemory(), encryption)
+		ctx := context.Background()
+		if err := h.remotePut(ctx, "/file", bytes.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+		r := &remoteReader{h: h, ctx: ctx, path: "/file", size: int64(len(content))}
+		for _, c := range []struct {
+			off, n int64
+		}{
+			{0, 1000},
+			// sequential, the get request in flight goes on
+			{1000, 5000},
+			// backwards and forwards, the get request restarts
+			{10, 10},
+			{70000, 20000},
+			{99990, 10},
+		} {
+			p := make([]byte, c.n)
+			if n, err := r.ReadAt(p, c.off); err != nil || int64(n) != c.n {
+				t.Fatalf("%s read %d at %d got %d, %v", name, c.n, c.off, n, err)
+			}
+			if !bytes.Equal(p, content[c.off:c.off+c.n]) {
+				t.Fatalf("%s read %d at %d got wrong content", name, c.n, c.off)
+			}
+		}
+		// reads beyond the end are short
+		p := make([]byte, 100)
+		if n, err := r.ReadAt(p, 99950); n != 50 || err != io.EOF {
+			t.Fatalf("%s read beyond end got %d, %v", name, n, err)
+		}
+		if n, err := r.ReadAt(p, int64(len(content))); n != 0 || err != io.EOF {
+			t.Fatalf("%s read at end got %d, %v", name, n, err)
+		}
+		r.Close()
+
+		// the whole file streams through the body
+		w := serve(h.Mux(), http.MethodGet, types.GetURL+"?dst=/file", "")
+		if data, _ := ioutil.ReadAll(w.Body); w.Code != http.StatusOK || !bytes.Equal(data, content) {
+			t.Fatalf("%s get got %d with %d bytes", name, w.Code, len(data))
+		}
+	}
+}
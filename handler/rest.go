@@ -0,0 +1,204 @@
+package handler
+
+import (
+	_ "embed" // for the OpenAPI description and the web UI
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/leslie-wang/libp2p-ftp/node"
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+// headerFileType tells whether resource is a file or a directory
+const headerFileType = "X-File-Type"
+
+//go:embed openapi.json
+var openAPI []byte
+
+//go:embed webui.html
+var webUI []byte
+
+// registerAPI registers the REST API, which is described by openapi.json
+func (h *HTTPHandler) registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc(types.APIFilesURL+"/", h.apiFiles)
+	mux.HandleFunc(types.APIStatusURL, h.apiStatus)
+	mux.HandleFunc(types.APIConnectionURL, h.apiConnection)
+	mux.HandleFunc(types.APIQuotaURL, h.apiQuota)
+	mux.HandleFunc(types.APIOpenAPIURL, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPI)
+	})
+	mux.HandleFunc("/", serveWebUI)
+}
+
+// serveWebUI serves the single page web UI, which works on the REST API
+func serveWebUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(webUI)
+}
+
+// writeJSON replies v as JSON with status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError replies error as JSON, with status mapped from the error
+// reported by remote peer
+func writeAPIError(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(httpStatus(err))
+		return
+	}
+	writeJSON(w, httpStatus(err), &types.Reply{Error: err.Error()})
+}
+
+// apiFiles serves remote files and directories under their path
+func (h *HTTPHandler) apiFiles(w http.ResponseWriter, r *http.Request) {
+	p := "/" + strings.TrimPrefix(r.URL.Path, types.APIFilesURL+"/")
+	if path.Clean(p) != strings.TrimSuffix(p, "/") && p != "/" {
+		writeJSON(w, http.StatusBadRequest, &types.Reply{Error: "path is not clean"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.apiGet(w, r, p)
+	case http.MethodPut:
+		h.apiPut(w, r, p)
+	case http.MethodDelete:
+		h.apiDelete(w, r, p)
+	case http.MethodPatch:
+		h.apiRename(w, r, p)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE, PATCH")
+		writeJSON(w, http.StatusMethodNotAllowed, &types.Reply{Error: r.Method + " is not allowed"})
+	}
+}
+
+// apiGet replies listing of directory as JSON, or content of file
+func (h *HTTPHandler) apiGet(w http.ResponseWriter, r *http.Request, p string) {
+	info, err := h.remoteStat(r.Context(), p)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if info.IsDir {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+		w.Header().Set(headerFileType, "directory")
+		if r.Method == http.MethodHead {
+			return
+		}
+		files, err := h.remoteList(r.Context(), p)
+		if err != nil {
+			writeAPIError(w, r, err)
+			return
+		}
+		if files == nil {
+			files = []types.FileInfo{}
+		}
+		writeJSON(w, http.StatusOK, files)
+		return
+	}
+
+	w.Header().Set(headerFileType, "file")
+	h.serveFile(w, r, p, info)
+}
+
+// apiPut uploads request body as file, paths ending with slash create
+// directory
+func (h *HTTPHandler) apiPut(w http.ResponseWriter, r *http.Request, p string) {
+	var err error
+	if strings.HasSuffix(p, "/") {
+		err = h.remoteMkdir(r.Context(), path.Clean(p))
+	} else {
+		err = h.remotePut(r.Context(), p, r.Body, r.ContentLength)
+	}
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", types.APIFilesURL+p)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// apiDelete removes file or empty directory, into trash unless permanent
+// is set
+func (h *HTTPHandler) apiDelete(w http.ResponseWriter, r *http.Request, p string) {
+	var err error
+	if permanent, _ := strconv.ParseBool(r.URL.Query().Get(types.QueryKeyPermanent)); permanent {
+		err = h.sup.Do(func(n *node.Node) error {
+			return n.PurgeRequest(r.Context(), h.remotePath(p))
+		})
+	} else {
+		err = h.remoteRemove(r.Context(), p)
+	}
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// renameRequest is body of PATCH, which moves file to Path
+type renameRequest struct {
+	Path string
+}
+
+func (h *HTTPHandler) apiRename(w http.ResponseWriter, r *http.Request, p string) {
+	req := &renameRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || !path.IsAbs(req.Path) {
+		writeJSON(w, http.StatusBadRequest, &types.Reply{Error: "body must have absolute Path"})
+		return
+	}
+	if err := h.remoteRename(r.Context(), p, path.Clean(req.Path)); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", types.APIFilesURL+path.Clean(req.Path))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiStatus reports network status of the connect daemon, or of the remote
+// peer with remote set
+func (h *HTTPHandler) apiStatus(w http.ResponseWriter, r *http.Request) {
+	var s *types.Status
+	err := h.sup.Do(func(n *node.Node) (err error) {
+		if remote, _ := strconv.ParseBool(r.URL.Query().Get(types.QueryKeyRemote)); remote {
+			s, err = n.StatusRequest(r.Context())
+		} else {
+			s = n.Status()
+		}
+		return
+	})
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (h *HTTPHandler) apiConnection(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.sup.State())
+}
+
+func (h *HTTPHandler) apiQuota(w http.ResponseWriter, r *http.Request) {
+	var q *types.QuotaStatus
+	err := h.sup.Do(func(n *node.Node) (err error) {
+		q, err = n.QuotaRequest(r.Context())
+		return
+	})
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, q)
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/leslie-wang/libp2p-ftp/node"
+	"github.com/leslie-wang/libp2p-ftp/storage"
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+func TestAPIFilesUncleanPath(t *testing.T) {
+	h := newTestHandler()
+	for _, p := range []string{"/a/../b", "/a//b", "/./a", "/a/."} {
+		// the mux would redirect them, the handler itself must not pass
+		// them on
+		w := serve(http.HandlerFunc(h.apiFiles), http.MethodGet, types.APIFilesURL+p, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s got %d, want %d", p, w.Code, http.StatusBadRequest)
+		}
+	}
+	// a clean path reaches the remote peer, which is not connected
+	if w := serve(http.HandlerFunc(h.apiFiles), http.MethodGet, types.APIFilesURL+"/a/b", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("clean path got %d", w.Code)
+	}
+}
+
+func TestAPIFiles(t *testing.T) {
+	mux := newTestAPI(t, storage.NewMemory(), nil).Mux()
+	expect := func(w *httptest.ResponseRecorder, code int) {
+		t.Helper()
+		if w.Code != code {
+			t.Fatalf("got %d %s, want %d", w.Code, w.Body.String(), code)
+		}
+	}
+
+	w := serve(mux, http.MethodPut, types.APIFilesURL+"/dir/a.txt", "hello")
+	expect(w, http.StatusCreated)
+	if loc := w.Header().Get("Location"); loc != types.APIFilesURL+"/dir/a.txt" {
+		t.Fatalf("put Location %q", loc)
+	}
+	expect(serve(mux, http.MethodPut, types.APIFilesURL+"/empty/", ""), http.StatusCreated)
+
+	w = serve(mux, http.MethodGet, types.APIFilesURL+"/dir/a.txt", "")
+	expect(w, http.StatusOK)
+	if w.Body.String() != "hello" || w.Header().Get(headerFileType) != "file" {
+		t.Fatalf("get %q, %s %q", w.Body.String(), headerFileType, w.Header().Get(headerFileType))
+	}
+	w = serve(mux, http.MethodGet, types.APIFilesURL+"/dir/a.txt", "", "Range", "bytes=1-3")
+	expect(w, http.StatusPartialContent)
+	if w.Body.String() != "ell" {
+		t.Fatalf("get range %q", w.Body.String())
+	}
+
+	w = serve(mux, http.MethodGet, types.APIFilesURL+"/dir", "")
+	expect(w, http.StatusOK)
+	files := []types.FileInfo{}
+	if err := json.NewDecoder(w.Body).Decode(&files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "a.txt" || files[0].Size != 5 {
+		t.Fatalf("list %+v", files)
+	}
+	w = serve(mux, http.MethodHead, types.APIFilesURL+"/dir", "")
+	expect(w, http.StatusOK)
+	if w.Body.Len() != 0 || w.Header().Get(headerFileType) != "directory" {
+		t.Fatalf("head of directory %q, %s %q", w.Body.String(), headerFileType, w.Header().Get(headerFileType))
+	}
+
+	w = serve(mux, http.MethodPatch, types.APIFilesURL+"/dir/a.txt", `{"Path": "/dir/b.txt"}`)
+	expect(w, http.StatusNoContent)
+	if loc := w.Header().Get("Location"); loc != types.APIFilesURL+"/dir/b.txt" {
+		t.Fatalf("rename Location %q", loc)
+	}
+	expect(serve(mux, http.MethodPatch, types.APIFilesURL+"/dir/b.txt", `{"Path": "relative"}`), http.StatusBadRequest)
+
+	expect(serve(mux, http.MethodDelete, types.APIFilesURL+"/dir", ""), http.StatusConflict)
+	expect(serve(mux, http.MethodDelete, types.APIFilesURL+"/dir/b.txt", ""), http.StatusNoContent)
+	expect(serve(mux, http.MethodGet, types.APIFilesURL+"/dir/b.txt", ""), http.StatusNotFound)
+
+	w = serve(mux, http.MethodPost, types.APIFilesURL+"/dir", "")
+	expect(w, http.StatusMethodNotAllowed)
+	if allow := w.Header().Get("Allow"); allow != "GET, HEAD, PUT, DELETE, PATCH" {
+		t.Fatalf("Allow %q", allow)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	ctx := context.Background()
+	q, err := storage.NewQuota(ctx, storage.NewTrash(storage.NewMemory(), 0),
+		types.Quota{Default: types.Limit{Bytes: 10}}, nil, filepath.Join(t.TempDir(), "quota.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := newTestAPI(t, q, nil).Mux()
+
+	// replies to HEAD have no body
+	w := serve(mux, http.MethodHead, types.APIFilesURL+"/missing", "")
+	if w.Code != http.StatusNotFound || w.Body.Len() != 0 {
+		t.Fatalf("head of missing file got %d %q", w.Code, w.Body.String())
+	}
+	w = serve(mux, http.MethodGet, types.APIFilesURL+"/missing", "")
+	reply := &types.Reply{}
+	if w.Code != http.StatusNotFound || json.NewDecoder(w.Body).Decode(reply) != nil || reply.Error == "" {
+		t.Fatalf("get of missing file got %d %+v", w.Code, reply)
+	}
+
+	if w := serve(mux, http.MethodPut, types.APIFilesURL+"/big", strings.Repeat("x", 11)); w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("put beyond quota got %d %s", w.Code, w.Body.String())
+	}
+	serve(mux, http.MethodPut, types.APIFilesURL+"/small", "x")
+	// only configured purgers may remove permanently
+	if w := serve(mux, http.MethodDelete, types.APIFilesURL+"/small?permanent=true", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("purge got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want int
+	}{
+		{errNotConnected, http.StatusServiceUnavailable},
+		{&node.RemoteError{Message: "stat /a: file does not exist"}, http.StatusNotFound},
+		{&node.RemoteError{Message: "open /a: no such file or directory"}, http.StatusNotFound},
+		{&node.RemoteError{Message: "remove /a: permission denied"}, http.StatusForbidden},
+		{&node.RemoteError{Message: "mkdir /a: file exists"}, http.StatusConflict},
+		{&node.RemoteError{Message: "remove /a: directory not empty"}, http.StatusConflict},
+		{&node.RemoteError{Message: "open /a: disk quota exceeded"}, http.StatusInsufficientStorage},
+		{&node.RemoteError{Message: "please use absolute path"}, http.StatusBadRequest},
+		// reasons are matched after the path, not within it
+		{&node.RemoteError{Message: "open /permission denied/a: something else"}, http.StatusInternalServerError},
+		{errors.New("broken"), http.StatusInternalServerError},
+	} {
+		if got := httpStatus(c.err); got != c.want {
+			t.Errorf("%v got %d, want %d", c.err, got, c.want)
+		}
+	}
+}
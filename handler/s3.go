@@ -0,0 +1,894 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/client"
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// s3Namespace is the XML namespace of S3 responses
+	s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+	// s3TimeFormat is the time format in S3 listings
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	// s3MaxKeys is the default and largest number of keys listed at once
+	s3MaxKeys = 1000
+)
+
+// errListFull stops listing once enough keys are collected
+var errListFull = errors.New("listing is full")
+
+// s3Error is error reply of S3 API
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string `xml:",omitempty"`
+	status   int
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newS3Error(status int, code, format string, args ...interface{}) *s3Error {
+	return &s3Error{Code: code, Message: fmt.Sprintf(format, args...), status: status}
+}
+
+// s3Gateway serves S3 API on localhost. Buckets are the top level
+// directories, which are the shares, of the remote peer, and object keys are
+// paths below them.
+type s3Gateway struct {
+	h *HTTPHandler
+
+	lock    sync.Mutex
+	uploads map[string]*s3Upload
+}
+
+// serveS3 serves S3 API on localhost until ctx is done
+func (h *HTTPHandler) serveS3(ctx context.Context) error {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", h.conf.S3ListenPort))
+	if err != nil {
+		return err
+	}
+	g := &s3Gateway{h: h, uploads: map[string]*s3Upload{}}
+	srv := &http.Server{Handler: g}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go g.expire(ctx)
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("s3: %v", err)
+		}
+	}()
+	return nil
+}
+
+// ServeHTTP dispatches path style requests by method and sub-resource
+func (g *s3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if tokens := g.h.tokens(); len(tokens) > 0 && !validToken(tokens, s3AccessKey(r)) {
+		g.writeError(w, r, newS3Error(http.StatusForbidden, "InvalidAccessKeyId",
+			"access key must be a token of the HTTP bridge"))
+		return
+	}
+	bucket, key := r.URL.Path, ""
+	bucket = strings.TrimPrefix(bucket, "/")
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, key = bucket[:i], bucket[i+1:]
+	}
+	query := r.URL.Query()
+	_, uploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	var err error
+	switch {
+	case bucket == "" && r.Method == http.MethodGet:
+		err = g.listBuckets(w, r)
+	case bucket == "":
+		err = newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "%s is not allowed on service", r.Method)
+	case key == "":
+		switch r.Method {
+		case http.MethodGet:
+			if _, ok := query["location"]; ok {
+				err = g.bucketLocation(w, r, bucket)
+			} else {
+				err = g.listObjects(w, r, bucket)
+			}
+		case http.MethodHead:
+			err = g.headBucket(w, r, bucket)
+		case http.MethodPut:
+			err = g.createBucket(w, r, bucket)
+		case http.MethodDelete:
+			err = g.deleteBucket(w, r, bucket)
+		case http.MethodPost:
+			if _, ok := query["delete"]; ok {
+				err = g.deleteObjects(w, r, bucket)
+				break
+			}
+			fallthrough
+		default:
+			err = newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "%s is not allowed on bucket", r.Method)
+		}
+	default:
+		switch {
+		case r.Method == http.MethodGet, r.Method == http.MethodHead:
+			err = g.getObject(w, r, bucket, key)
+		case r.Method == http.MethodPut && uploadID != "":
+			err = g.uploadPart(w, r, bucket, key, uploadID)
+		case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+			err = g.copyObject(w, r, bucket, key)
+		case r.Method == http.MethodPut:
+			err = g.putObject(w, r, bucket, key)
+		case r.Method == http.MethodPost && uploads:
+			err = g.createUpload(w, r, bucket, key)
+		case r.Method == http.MethodPost && uploadID != "":
+			err = g.completeUpload(w, r, bucket, key, uploadID)
+		case r.Method == http.MethodDelete && uploadID != "":
+			err = g.abortUpload(w, r, bucket, key, uploadID)
+		case r.Method == http.MethodDelete:
+			err = g.deleteObject(w, r, bucket, key)
+		default:
+			err = newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "%s is not allowed on object", r.Method)
+		}
+	}
+	if err != nil {
+		g.writeError(w, r, err)
+	}
+}
+
+// s3AccessKey returns access key of signed or presigned request, signature
+// version 4 or 2. The signature is not verified, the access key is the
+// secret.
+func s3AccessKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	query := r.URL.Query()
+	switch {
+	case strings.HasPrefix(auth, "AWS4-HMAC-SHA256 "):
+		for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "Credential=") {
+				return strings.SplitN(strings.TrimPrefix(field, "Credential="), "/", 2)[0]
+			}
+		}
+	case strings.HasPrefix(auth, "AWS "):
+		return strings.SplitN(strings.TrimPrefix(auth, "AWS "), ":", 2)[0]
+	case query.Get("X-Amz-Credential") != "":
+		return strings.SplitN(query.Get("X-Amz-Credential"), "/", 2)[0]
+	}
+	return query.Get("AWSAccessKeyId")
+}
+
+// writeError replies S3 error, errors of remote peer are classified by
+// their kind
+func (g *s3Gateway) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	s3err, ok := err.(*s3Error)
+	if !ok {
+		kind := client.KindOf(err)
+		switch {
+		case err == errNotConnected:
+			s3err = newS3Error(http.StatusServiceUnavailable, "ServiceUnavailable", "%v", err)
+		case kind == client.ErrNotFound:
+			s3err = newS3Error(http.StatusNotFound, "NoSuchKey", "%v", err)
+		case kind == client.ErrPermission:
+			s3err = newS3Error(http.StatusForbidden, "AccessDenied", "%v", err)
+		case kind == client.ErrQuota:
+			s3err = newS3Error(http.StatusForbidden, "QuotaExceeded", "%v", err)
+		case kind == client.ErrExist:
+			s3err = newS3Error(http.StatusConflict, "OperationAborted", "%v", err)
+		case kind == client.ErrInvalidPath:
+			s3err = newS3Error(http.StatusBadRequest, "InvalidArgument", "%v", err)
+		default:
+			log.Printf("s3 %s %s: %v", r.Method, r.URL.Path, err)
+			s3err = newS3Error(http.StatusInternalServerError, "InternalError", "%v", err)
+		}
+	}
+	s3err.Resource = r.URL.Path
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3err.status)
+		return
+	}
+	writeXML(w, s3err.status, s3err)
+}
+
+// writeXML replies v as XML document
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// objectPath returns remote path of object, keys which are no clean paths
+// can not be mapped
+func objectPath(bucket, key string) (string, error) {
+	p := "/" + bucket + "/" + strings.TrimSuffix(key, "/")
+	if path.Clean(p) != p {
+		return "", newS3Error(http.StatusBadRequest, "InvalidArgument", "key %s is not a clean path", key)
+	}
+	return p, nil
+}
+
+// objectETag returns entity tag of remote file. Remote peers do not keep
+// MD5 of content, and the dash tells clients not to verify against it.
+func objectETag(info *types.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime.UnixNano(), info.Size)
+}
+
+// bucketExists fails with NoSuchBucket unless bucket is remote directory
+func (g *s3Gateway) bucketExists(ctx context.Context, bucket string) (*types.FileInfo, error) {
+	info, err := g.h.remoteStat(ctx, "/"+bucket)
+	if err != nil && client.KindOf(err) == client.ErrNotFound || err == nil && !info.IsDir {
+		return nil, newS3Error(http.StatusNotFound, "NoSuchBucket", "bucket %s does not exist", bucket)
+	}
+	return info, err
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+// listBuckets lists top level directories of remote peer
+func (g *s3Gateway) listBuckets(w http.ResponseWriter, r *http.Request) error {
+	files, err := g.h.remoteList(r.Context(), "/")
+	if err != nil {
+		return err
+	}
+	result := &listAllMyBucketsResult{Xmlns: s3Namespace, Owner: s3Owner{ID: g.h.conf.ServerID}}
+	for _, file := range files {
+		if file.IsDir {
+			result.Buckets = append(result.Buckets, s3Bucket{Name: file.Name, CreationDate: file.ModTime.UTC().Format(s3TimeFormat)})
+		}
+	}
+	writeXML(w, http.StatusOK, result)
+	return nil
+}
+
+type locationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+// bucketLocation replies the default region, which clients ask for before
+// signing requests to bucket
+func (g *s3Gateway) bucketLocation(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if _, err := g.bucketExists(r.Context(), bucket); err != nil {
+		return err
+	}
+	writeXML(w, http.StatusOK, &locationConstraint{Xmlns: s3Namespace})
+	return nil
+}
+
+func (g *s3Gateway) headBucket(w http.ResponseWriter, r *http.Request, bucket string) error {
+	_, err := g.bucketExists(r.Context(), bucket)
+	return err
+}
+
+// createBucket creates top level directory, which must be allowed by the
+// remote peer
+func (g *s3Gateway) createBucket(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if _, err := g.bucketExists(r.Context(), bucket); err == nil {
+		return newS3Error(http.StatusConflict, "BucketAlreadyOwnedByYou", "bucket %s already exists", bucket)
+	}
+	if err := g.h.remoteMkdir(r.Context(), "/"+bucket); err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/"+bucket)
+	return nil
+}
+
+func (g *s3Gateway) deleteBucket(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if _, err := g.bucketExists(r.Context(), bucket); err != nil {
+		return err
+	}
+	err := g.h.remoteRemove(r.Context(), "/"+bucket)
+	if err != nil && client.KindOf(err) == client.ErrExist {
+		return newS3Error(http.StatusConflict, "BucketNotEmpty", "bucket %s is not empty", bucket)
+	}
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name   `xml:"ListBucketResult"`
+	Xmlns                 string     `xml:"xmlns,attr"`
+	Name                  string     `xml:"Name"`
+	Prefix                string     `xml:"Prefix"`
+	Delimiter             string     `xml:"Delimiter,omitempty"`
+	Marker                *string    `xml:"Marker"`
+	NextMarker            string     `xml:"NextMarker,omitempty"`
+	StartAfter            string     `xml:"StartAfter,omitempty"`
+	ContinuationToken     string     `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+	KeyCount              *int       `xml:"KeyCount"`
+	MaxKeys               int        `xml:"MaxKeys"`
+	EncodingType          string     `xml:"EncodingType,omitempty"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+}
+
+// listObjects replies ListObjectsV2, or ListObjects without list-type
+func (g *s3Gateway) listObjects(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if _, err := g.bucketExists(r.Context(), bucket); err != nil {
+		return err
+	}
+	query := r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	l := &s3Lister{
+		g:         g,
+		ctx:       r.Context(),
+		bucket:    bucket,
+		prefix:    query.Get("prefix"),
+		delimiter: query.Get("delimiter"),
+		max:       s3MaxKeys,
+	}
+	if s := query.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid max-keys %s", s)
+		}
+		if n < l.max {
+			l.max = n
+		}
+	}
+
+	token := query.Get("continuation-token")
+	switch {
+	case !v2:
+		l.after = query.Get("marker")
+	case token != "":
+		after, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid continuation token")
+		}
+		l.after = string(after)
+	default:
+		l.after = query.Get("start-after")
+	}
+
+	// only the directory of prefix and below can hold matching keys
+	dir := l.prefix[:strings.LastIndex(l.prefix, "/")+1]
+	err := l.walk(dir, time.Time{})
+	if err != nil && err != errListFull && client.KindOf(err) != client.ErrNotFound {
+		return err
+	}
+
+	encode := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		encode = func(s string) string { return (&url.URL{Path: s}).EscapedPath() }
+	}
+	result := &listBucketResult{
+		Xmlns:       s3Namespace,
+		Name:        bucket,
+		Prefix:      encode(l.prefix),
+		Delimiter:   encode(l.delimiter),
+		MaxKeys:     l.max,
+		IsTruncated: l.truncated,
+	}
+	if query.Get("encoding-type") == "url" {
+		result.EncodingType = "url"
+	}
+	for _, obj := range l.objects {
+		obj.Key = encode(obj.Key)
+		result.Contents = append(result.Contents, obj)
+	}
+	for _, p := range l.prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, s3Prefix{Prefix: encode(p.Prefix)})
+	}
+	if v2 {
+		count := len(l.objects) + len(l.prefixes)
+		result.KeyCount = &count
+		result.ContinuationToken = token
+		result.StartAfter = encode(query.Get("start-after"))
+		if l.truncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(l.last))
+		}
+	} else {
+		marker := encode(l.after)
+		result.Marker = &marker
+		if l.truncated {
+			result.NextMarker = encode(l.last)
+		}
+	}
+	writeXML(w, http.StatusOK, result)
+	return nil
+}
+
+// s3Lister collects keys of bucket in lexical order by walking remote
+// directories. Directories rolled up into a common prefix are not walked.
+type s3Lister struct {
+	g         *s3Gateway
+	ctx       context.Context
+	bucket    string
+	prefix    string
+	delimiter string
+	after     string
+	max       int
+
+	objects   []s3Object
+	prefixes  []s3Prefix
+	truncated bool
+	// last is the last key or common prefix collected
+	last string
+}
+
+// walk collects keys under directory, whose key ends with slash. Empty
+// directories are listed as zero sized objects named like the directory.
+func (l *s3Lister) walk(dir string, modTime time.Time) error {
+	files, err := l.g.h.remoteList(l.ctx, path.Join("/", l.bucket, dir))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 && dir != "" && strings.HasPrefix(dir, l.prefix) {
+		return l.addObject(dir, &types.FileInfo{ModTime: modTime})
+	}
+
+	keys := make([]string, len(files))
+	for i, file := range files {
+		keys[i] = dir + file.Name
+		if file.IsDir {
+			keys[i] += "/"
+		}
+	}
+	sort.Sort(byKey{keys, files})
+
+	for i, key := range keys {
+		if !strings.HasPrefix(key, l.prefix) && !(files[i].IsDir && strings.HasPrefix(l.prefix, key)) {
+			continue
+		}
+		if files[i].IsDir && key < l.after && !strings.HasPrefix(l.after, key) {
+			// every key below sorts before the continuation point
+			continue
+		}
+		if p, ok := l.commonPrefix(key); ok {
+			if err := l.addPrefix(p); err != nil {
+				return err
+			}
+			continue
+		}
+		if files[i].IsDir {
+			err = l.walk(key, files[i].ModTime)
+		} else {
+			err = l.addObject(key, &files[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commonPrefix returns the prefix key rolls up into, which covers all keys
+// below directory key as well
+func (l *s3Lister) commonPrefix(key string) (string, bool) {
+	if l.delimiter == "" || !strings.HasPrefix(key, l.prefix) {
+		return "", false
+	}
+	i := strings.Index(key[len(l.prefix):], l.delimiter)
+	if i < 0 {
+		return "", false
+	}
+	return key[:len(l.prefix)+i+len(l.delimiter)], true
+}
+
+// add accounts for one more key, and stops listing when it does not fit
+func (l *s3Lister) add(key string) (bool, error) {
+	if key <= l.after || key == l.last {
+		return false, nil
+	}
+	if len(l.objects)+len(l.prefixes) >= l.max {
+		l.truncated = true
+		return false, errListFull
+	}
+	l.last = key
+	return true, nil
+}
+
+func (l *s3Lister) addObject(key string, info *types.FileInfo) error {
+	ok, err := l.add(key)
+	if ok {
+		l.objects = append(l.objects, s3Object{
+			Key:          key,
+			LastModified: info.ModTime.UTC().Format(s3TimeFormat),
+			ETag:         objectETag(info),
+			Size:         info.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	return err
+}
+
+func (l *s3Lister) addPrefix(prefix string) error {
+	ok, err := l.add(prefix)
+	if ok {
+		l.prefixes = append(l.prefixes, s3Prefix{Prefix: prefix})
+	}
+	return err
+}
+
+// byKey sorts directory entries by their key
+type byKey struct {
+	keys  []string
+	files []types.FileInfo
+}
+
+func (b byKey) Len() int           { return len(b.keys) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	b.files[i], b.files[j] = b.files[j], b.files[i]
+}
+
+// statObject returns metadata of object, keys ending with slash are
+// directories
+func (g *s3Gateway) statObject(ctx context.Context, bucket, key string) (string, *types.FileInfo, error) {
+	p, err := objectPath(bucket, key)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := g.bucketExists(ctx, bucket); err != nil {
+		return "", nil, err
+	}
+	info, err := g.h.remoteStat(ctx, p)
+	if err != nil {
+		return "", nil, err
+	}
+	if info.IsDir != strings.HasSuffix(key, "/") {
+		return "", nil, newS3Error(http.StatusNotFound, "NoSuchKey", "key %s does not exist", key)
+	}
+	if info.IsDir {
+		info.Size = 0
+	}
+	return p, info, nil
+}
+
+// getObject replies content of object, conditional and range requests are
+// handled like for any static file
+func (g *s3Gateway) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	p, info, err := g.statObject(r.Context(), bucket, key)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", objectETag(info))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	reader := &remoteReader{h: g.h, ctx: r.Context(), path: p, size: info.Size}
+	defer reader.Close()
+	http.ServeContent(w, r, "", info.ModTime, io.NewSectionReader(reader, 0, info.Size))
+	return nil
+}
+
+// requestBody returns content of upload and its size, which is -1 if
+// unknown. Chunked signature encoding of streaming uploads is removed.
+func requestBody(r *http.Request) (io.Reader, int64, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return r.Body, r.ContentLength, nil
+	}
+	size, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+	if err != nil {
+		return nil, 0, newS3Error(http.StatusBadRequest, "MissingContentLength", "invalid decoded content length")
+	}
+	return &awsChunkedReader{r: bufio.NewReader(r.Body)}, size, nil
+}
+
+// putObject uploads object, keys ending with slash create directory
+func (g *s3Gateway) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	p, err := objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	if _, err := g.bucketExists(r.Context(), bucket); err != nil {
+		return err
+	}
+	body, size, err := requestBody(r)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(key, "/") {
+		if size != 0 {
+			return newS3Error(http.StatusBadRequest, "InvalidArgument", "directory %s can not have content", key)
+		}
+		return g.h.remoteMkdir(r.Context(), p)
+	}
+
+	want, err := contentMD5(r)
+	if err != nil {
+		return err
+	}
+	if want != nil {
+		// the content is checked before it replaces the object
+		f, err := ioutil.TempFile("", "p2pftp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		hash := md5.New()
+		if size, err = io.Copy(io.MultiWriter(f, hash), body); err != nil {
+			return err
+		}
+		if !bytes.Equal(hash.Sum(nil), want) {
+			return newS3Error(http.StatusBadRequest, "BadDigest", "Content-MD5 does not match the content")
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		body = f
+	}
+
+	hash := md5.New()
+	if err := g.h.remotePut(r.Context(), p, io.TeeReader(body, hash), size); err != nil {
+		return err
+	}
+	w.Header().Set("ETag", `"`+hex.EncodeToString(hash.Sum(nil))+`"`)
+	return nil
+}
+
+// contentMD5 returns binary MD5 of Content-MD5 header, or nil without one
+func contentMD5(r *http.Request) ([]byte, error) {
+	header := r.Header.Get("Content-MD5")
+	if header == "" {
+		return nil, nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(header)
+	if err != nil || len(sum) != md5.Size {
+		return nil, newS3Error(http.StatusBadRequest, "InvalidDigest", "Content-MD5 %q is invalid", header)
+	}
+	return sum, nil
+}
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string
+	ETag         string
+}
+
+// copyObject copies object by getting it from and putting it to the remote
+// peer again
+func (g *s3Gateway) copyObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	dst, err := objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid copy source")
+	}
+	if i := strings.Index(source, "?"); i >= 0 {
+		source = source[:i]
+	}
+	source = strings.TrimPrefix(source, "/")
+	i := strings.Index(source, "/")
+	if i < 0 {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid copy source %s", source)
+	}
+	src, info, err := g.statObject(r.Context(), source[:i], source[i+1:])
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "can not copy directory %s", source)
+	}
+	if _, err := g.bucketExists(r.Context(), bucket); err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(g.h.remoteGet(r.Context(), src, 0, pw))
+	}()
+	err = g.h.remotePut(r.Context(), dst, pr, info.Size)
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+	copied, err := g.h.remoteStat(r.Context(), dst)
+	if err != nil {
+		return err
+	}
+	writeXML(w, http.StatusOK, &copyObjectResult{
+		Xmlns:        s3Namespace,
+		LastModified: copied.ModTime.UTC().Format(s3TimeFormat),
+		ETag:         objectETag(copied),
+	})
+	return nil
+}
+
+// removeObject removes remote file. Missing keys are no error, and
+// directories which are not empty are kept like their keys are.
+func (g *s3Gateway) removeObject(ctx context.Context, bucket, key string) error {
+	p, err := objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	err = g.h.remoteRemove(ctx, p)
+	if err == nil {
+		return nil
+	}
+	switch client.KindOf(err) {
+	case client.ErrNotFound:
+		return nil
+	case client.ErrExist:
+		if strings.HasSuffix(key, "/") {
+			return nil
+		}
+	}
+	return err
+}
+
+func (g *s3Gateway) deleteObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	if _, err := g.bucketExists(r.Context(), bucket); err != nil {
+		return err
+	}
+	if err := g.removeObject(r.Context(), bucket, key); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type deleteRequest struct {
+	Quiet   bool
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type deletedObject struct {
+	Key string
+}
+
+type deleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+type deleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+// deleteObjects removes several objects, failures are reported per key
+func (g *s3Gateway) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if _, err := g.bucketExists(r.Context(), bucket); err != nil {
+		return err
+	}
+	req := &deleteRequest{}
+	if err := xml.NewDecoder(r.Body).Decode(req); err != nil {
+		return newS3Error(http.StatusBadRequest, "MalformedXML", "%v", err)
+	}
+	result := &deleteResult{Xmlns: s3Namespace}
+	for _, obj := range req.Objects {
+		if err := g.removeObject(r.Context(), bucket, obj.Key); err != nil {
+			failure := deleteError{Key: obj.Key, Code: "InternalError", Message: err.Error()}
+			if s3err, ok := err.(*s3Error); ok {
+				failure.Code, failure.Message = s3err.Code, s3err.Message
+			} else if client.KindOf(err) == client.ErrPermission {
+				failure.Code = "AccessDenied"
+			}
+			result.Errors = append(result.Errors, failure)
+		} else if !req.Quiet {
+			result.Deleted = append(result.Deleted, deletedObject{Key: obj.Key})
+		}
+	}
+	writeXML(w, http.StatusOK, result)
+	return nil
+}
+
+// awsChunkedReader decodes aws-chunked content of streaming uploads. Chunk
+// signatures and trailing checksums are not verified.
+type awsChunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if err == io.EOF && c.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// next reads header of the next chunk, which is its hex size followed by
+// extensions. Empty lines end the data of the previous chunk.
+func (c *awsChunkedReader) next() error {
+	for {
+		line, err := c.r.ReadString('\n')
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		size, err := strconv.ParseInt(line, 16, 64)
+		if err != nil || size < 0 {
+			return errors.Errorf("invalid chunk size %s", line)
+		}
+		c.left, c.done = size, size == 0
+		return nil
+	}
+}
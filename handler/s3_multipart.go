@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3MaxParts is the highest part number of multipart upload
+	s3MaxParts = 10000
+	// s3UploadExpiry is how long multipart upload is kept after its last
+	// request, clients which never complete nor abort would fill the disk
+	s3UploadExpiry = 24 * time.Hour
+)
+
+// s3Upload is multipart upload in progress. Parts are kept in temporary
+// files, since they may come in any order, and the object is put to the
+// remote peer once the upload is completed.
+type s3Upload struct {
+	bucket string
+	key    string
+	path   string
+	parts  map[int]*s3Part
+	// used is the time of the last request to the upload
+	used time.Time
+}
+
+type s3Part struct {
+	file string
+	size int64
+	// md5 is the binary MD5 of content, its hex is the ETag of part
+	md5 []byte
+}
+
+// remove deletes temporary files of all parts
+func (u *s3Upload) remove() {
+	for _, part := range u.parts {
+		os.Remove(part.file)
+	}
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadID string `xml:"UploadId"`
+}
+
+func (g *s3Gateway) createUpload(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	p, err := objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	if _, err := g.bucketExists(r.Context(), bucket); err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	upload := &s3Upload{bucket: bucket, key: key, path: p, parts: map[int]*s3Part{}, used: time.Now()}
+
+	g.lock.Lock()
+	g.uploads[hex.EncodeToString(id)] = upload
+	g.lock.Unlock()
+
+	writeXML(w, http.StatusOK, &initiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: hex.EncodeToString(id),
+	})
+	return nil
+}
+
+// upload returns multipart upload in progress, and keeps it from expiring.
+// The upload must be of bucket and key in the request URL.
+func (g *s3Gateway) upload(id, bucket, key string) (*s3Upload, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	upload, ok := g.uploads[id]
+	if !ok || upload.bucket != bucket || upload.key != key {
+		return nil, newS3Error(http.StatusNotFound, "NoSuchUpload", "upload %s does not exist", id)
+	}
+	upload.used = time.Now()
+	return upload, nil
+}
+
+// expireUploads removes uploads not used since before
+func (g *s3Gateway) expireUploads(before time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for id, upload := range g.uploads {
+		if upload.used.Before(before) {
+			delete(g.uploads, id)
+			upload.remove()
+		}
+	}
+}
+
+// removeUploads removes all uploads, their parts are not reused by the next
+// start
+func (g *s3Gateway) removeUploads() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for id, upload := range g.uploads {
+		delete(g.uploads, id)
+		upload.remove()
+	}
+}
+
+// expire removes stale uploads periodically until ctx is done, and then
+// all uploads
+func (g *s3Gateway) expire(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			g.removeUploads()
+			return
+		case <-time.After(s3UploadExpiry / 24):
+		}
+		g.expireUploads(time.Now().Add(-s3UploadExpiry))
+	}
+}
+
+// uploadPart stores part into temporary file, replacing earlier upload of
+// the same part number
+func (g *s3Gateway) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key, id string) error {
+	upload, err := g.upload(id, bucket, key)
+	if err != nil {
+		return err
+	}
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > s3MaxParts {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "part number must be between 1 and %d", s3MaxParts)
+	}
+	want, err := contentMD5(r)
+	if err != nil {
+		return err
+	}
+	body, _, err := requestBody(r)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile("", "p2pftp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), body)
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	part := &s3Part{file: f.Name(), size: size, md5: hash.Sum(nil)}
+	if want != nil && !bytes.Equal(part.md5, want) {
+		os.Remove(part.file)
+		return newS3Error(http.StatusBadRequest, "BadDigest", "Content-MD5 does not match the content")
+	}
+
+	g.lock.Lock()
+	// the upload may have been completed, aborted or expired meanwhile
+	if g.uploads[id] != upload {
+		g.lock.Unlock()
+		os.Remove(part.file)
+		return newS3Error(http.StatusNotFound, "NoSuchUpload", "upload %s does not exist", id)
+	}
+	if old, ok := upload.parts[number]; ok {
+		os.Remove(old.file)
+	}
+	upload.parts[number] = part
+	g.lock.Unlock()
+
+	w.Header().Set("ETag", `"`+hex.EncodeToString(part.md5)+`"`)
+	return nil
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+// completeUpload puts the listed parts as one object to the remote peer
+func (g *s3Gateway) completeUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) error {
+	upload, err := g.upload(id, bucket, key)
+	if err != nil {
+		return err
+	}
+	req := &completeMultipartUpload{}
+	if err := xml.NewDecoder(r.Body).Decode(req); err != nil {
+		return newS3Error(http.StatusBadRequest, "MalformedXML", "%v", err)
+	}
+	if len(req.Parts) == 0 {
+		return newS3Error(http.StatusBadRequest, "MalformedXML", "no part is listed")
+	}
+
+	var (
+		readers []io.Reader
+		size    int64
+		sums    []byte
+	)
+	g.lock.Lock()
+	for i, listed := range req.Parts {
+		if i > 0 && listed.PartNumber <= req.Parts[i-1].PartNumber {
+			g.lock.Unlock()
+			return newS3Error(http.StatusBadRequest, "InvalidPartOrder", "parts must be listed in ascending order")
+		}
+		part, ok := upload.parts[listed.PartNumber]
+		if !ok || strings.Trim(listed.ETag, `"`) != hex.EncodeToString(part.md5) {
+			g.lock.Unlock()
+			return newS3Error(http.StatusBadRequest, "InvalidPart", "part %d was not uploaded", listed.PartNumber)
+		}
+		f, err := os.Open(part.file)
+		if err != nil {
+			g.lock.Unlock()
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+		size += part.size
+		sums = append(sums, part.md5...)
+	}
+	g.lock.Unlock()
+
+	if err := g.h.remotePut(r.Context(), upload.path, io.MultiReader(readers...), size); err != nil {
+		return err
+	}
+	g.lock.Lock()
+	delete(g.uploads, id)
+	upload.remove()
+	g.lock.Unlock()
+
+	sum := md5.Sum(sums)
+	writeXML(w, http.StatusOK, &completeMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + upload.bucket + "/" + upload.key,
+		Bucket:   upload.bucket,
+		Key:      upload.key,
+		ETag:     fmt.Sprintf(`"%x-%d"`, sum, len(req.Parts)),
+	})
+	return nil
+}
+
+func (g *s3Gateway) abortUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) error {
+	upload, err := g.upload(id, bucket, key)
+	if err != nil {
+		return err
+	}
+	g.lock.Lock()
+	delete(g.uploads, id)
+	upload.remove()
+	g.lock.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/storage"
+)
+
+// newTestUpload adds upload with one part in a temporary file
+func newTestUpload(t *testing.T, g *s3Gateway, id string, used time.Time) *s3Upload {
+	file := filepath.Join(t.TempDir(), id)
+	if err := ioutil.WriteFile(file, []byte("part"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	upload := &s3Upload{bucket: "share", key: id, parts: map[int]*s3Part{1: {file: file, size: 4}}, used: used}
+	g.uploads[id] = upload
+	return upload
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func TestS3UploadExpiry(t *testing.T) {
+	g := &s3Gateway{uploads: map[string]*s3Upload{}}
+	now := time.Now()
+	stale := newTestUpload(t, g, "stale", now.Add(-2*s3UploadExpiry))
+	fresh := newTestUpload(t, g, "fresh", now)
+
+	g.expireUploads(now.Add(-s3UploadExpiry))
+	if _, ok := g.uploads["stale"]; ok || exists(stale.parts[1].file) {
+		t.Fatal("stale upload is kept")
+	}
+	if _, ok := g.uploads["fresh"]; !ok || !exists(fresh.parts[1].file) {
+		t.Fatal("fresh upload is removed")
+	}
+
+	// uploads are removed on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	g.expire(ctx)
+	if len(g.uploads) != 0 || exists(fresh.parts[1].file) {
+		t.Fatal("upload is kept after shutdown")
+	}
+}
+
+// abortingReader aborts upload while its part is being received, and then
+// ends the part
+type abortingReader struct {
+	g  *s3Gateway
+	id string
+}
+
+func (r *abortingReader) Read(p []byte) (int, error) {
+	r.g.abortUpload(httptest.NewRecorder(), nil, "share", r.id, r.id)
+	return 0, io.EOF
+}
+
+func TestS3UploadPartAborted(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	g := &s3Gateway{uploads: map[string]*s3Upload{}}
+	newTestUpload(t, g, "id", time.Now())
+
+	r := httptest.NewRequest(http.MethodPut, "/share/id?partNumber=2&uploadId=id", strings.NewReader("x"))
+	r.Body = ioutil.NopCloser(&abortingReader{g: g, id: "id"})
+	if err := g.uploadPart(httptest.NewRecorder(), r, "share", "id", "id"); err == nil {
+		t.Fatal("part of aborted upload is stored")
+	}
+	files, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("aborted part left %s", files[0].Name())
+	}
+}
+
+func TestS3UploadPartOtherKey(t *testing.T) {
+	g := &s3Gateway{h: newTestHandler(), uploads: map[string]*s3Upload{}}
+	upload := newTestUpload(t, g, "id", time.Now())
+
+	for _, target := range []string{"/share/other?partNumber=2&uploadId=id", "/other/id?partNumber=2&uploadId=id"} {
+		w := serve(g, http.MethodPut, target, "x", "Authorization", "AWS4-HMAC-SHA256 Credential=other/")
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "NoSuchUpload") {
+			t.Errorf("%s got %d %s", target, w.Code, w.Body.String())
+		}
+	}
+	if len(upload.parts) != 1 {
+		t.Fatal("part of other key is stored")
+	}
+}
+
+func TestS3ContentMD5(t *testing.T) {
+	g := &s3Gateway{h: newTestAPI(t, storage.NewMemory(), nil), uploads: map[string]*s3Upload{}}
+	newTestUpload(t, g, "id", time.Now())
+	if w := serve(g, http.MethodPut, "/share", ""); w.Code != http.StatusOK {
+		t.Fatalf("create bucket got %d %s", w.Code, w.Body.String())
+	}
+	// MD5 of "hello"
+	const sum = "XUFAKrxLKna5cZ2REBfFkg=="
+
+	for _, c := range []struct {
+		target, md5 string
+		want        int
+		code        string
+	}{
+		{"/share/a", sum, http.StatusOK, ""},
+		{"/share/b", "XUFAKrxLKna5cZ2REBfFkw==", http.StatusBadRequest, "BadDigest"},
+		{"/share/b", "hello", http.StatusBadRequest, "InvalidDigest"},
+		{"/share/id?partNumber=2&uploadId=id", sum, http.StatusOK, ""},
+		{"/share/id?partNumber=3&uploadId=id", "XUFAKrxLKna5cZ2REBfFkw==", http.StatusBadRequest, "BadDigest"},
+	} {
+		w := serve(g, http.MethodPut, c.target, "hello", "Content-MD5", c.md5)
+		if w.Code != c.want || !strings.Contains(w.Body.String(), c.code) {
+			t.Errorf("%s %s got %d %s", c.target, c.md5, w.Code, w.Body.String())
+		}
+	}
+	// the mismatching object is not put
+	if w := serve(g, http.MethodHead, "/share/b", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("head of bad digest object got %d", w.Code)
+	}
+	if _, ok := g.uploads["id"].parts[3]; ok {
+		t.Fatal("part of bad digest is stored")
+	}
+}
@@ -0,0 +1,270 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/leslie-wang/libp2p-ftp/client"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// errNotSupported is returned for SFTP operations without remote equivalent
+var errNotSupported = errors.New("operation not supported")
+
+// serveSFTP runs SSH server on localhost, whose sftp subsystem works on the
+// remote peer, until ctx is done
+func (h *HTTPHandler) serveSFTP(ctx context.Context) error {
+	conf, err := h.sshConfig()
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", h.conf.SFTP.ListenPort))
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("sftp accept: %v", err)
+				}
+				return
+			}
+			go h.serveSSH(ctx, conn, conf)
+		}
+	}()
+	return nil
+}
+
+// sshConfig authenticates configured users by public key
+func (h *HTTPHandler) sshConfig() (*ssh.ServerConfig, error) {
+	users := map[string][][]byte{}
+	for user, keys := range h.conf.SFTP.Users {
+		for _, key := range keys {
+			pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid key of user %s", user)
+			}
+			users[user] = append(users[user], pub.Marshal())
+		}
+	}
+
+	conf := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, allowed := range users[meta.User()] {
+				if bytes.Equal(allowed, key.Marshal()) {
+					return &ssh.Permissions{}, nil
+				}
+			}
+			return nil, errors.Errorf("unknown public key of %s", meta.User())
+		},
+	}
+	signer, err := loadHostKey(h.conf.SFTP.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	conf.AddHostKey(signer)
+	return conf, nil
+}
+
+// loadHostKey reads PEM encoded host key, which is generated if the file
+// does not exist. Without file a new key is used on every start.
+func loadHostKey(file string) (ssh.Signer, error) {
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err == nil {
+			return ssh.ParsePrivateKey(data)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if file != "" {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(file, data, 0600); err != nil {
+			return nil, err
+		}
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// serveSSH serves sftp subsystem of sessions on one SSH connection
+func (h *HTTPHandler) serveSSH(ctx context.Context, conn net.Conn, conf *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, conf)
+	if err != nil {
+		log.Printf("ssh handshake: %v", err)
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			log.Printf("ssh channel: %v", err)
+			continue
+		}
+		go h.serveSession(ctx, channel, requests)
+	}
+}
+
+// serveSession waits for the sftp subsystem request, other requests like
+// shell or exec are refused
+func (h *HTTPHandler) serveSession(ctx context.Context, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		// payload is the subsystem name as SSH string
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+
+		fs := &sftpHandler{h: h}
+		server := sftp.NewRequestServer(channel, sftp.Handlers{
+			FileGet:  fs,
+			FilePut:  fs,
+			FileCmd:  fs,
+			FileList: fs,
+		})
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Printf("sftp: %v", err)
+		}
+		server.Close()
+		return
+	}
+}
+
+// sftpError maps remote errors to errnos, which the sftp package turns into
+// status codes like SSH_FX_NO_SUCH_FILE. It only knows EPERM as permission
+// denied.
+func sftpError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch client.KindOf(err) {
+	case client.ErrNotFound:
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+	case client.ErrExist:
+		return &os.PathError{Op: op, Path: name, Err: syscall.EEXIST}
+	case client.ErrPermission:
+		return &os.PathError{Op: op, Path: name, Err: syscall.EPERM}
+	}
+	return err
+}
+
+// sftpHandler maps sftp requests onto remote requests
+type sftpHandler struct {
+	h *HTTPHandler
+}
+
+// Fileread returns reader of remote file
+func (s *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	info, err := s.h.remoteStat(r.Context(), r.Filepath)
+	if err != nil {
+		return nil, sftpError("open", r.Filepath, err)
+	}
+	if info.IsDir {
+		return nil, errors.Errorf("%s is a directory", r.Filepath)
+	}
+	return &remoteReader{h: s.h, ctx: r.Context(), path: r.Filepath, size: info.Size}, nil
+}
+
+// Filewrite returns writer which uploads remote file once closed
+func (s *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	f, err := ioutil.TempFile("", "p2pftp")
+	if err != nil {
+		return nil, err
+	}
+	return &remoteWriter{h: s.h, ctx: r.Context(), path: r.Filepath, f: f}, nil
+}
+
+// Filecmd runs commands without reply data
+func (s *sftpHandler) Filecmd(r *sftp.Request) error {
+	var err error
+	switch r.Method {
+	case "Rename":
+		err = s.h.remoteRename(r.Context(), r.Filepath, r.Target)
+	case "Rmdir", "Remove":
+		err = s.h.remoteRemove(r.Context(), r.Filepath)
+	case "Mkdir":
+		err = s.h.remoteMkdir(r.Context(), r.Filepath)
+	case "Setstat":
+		// remote files keep their own mode and times
+		return nil
+	default:
+		return errNotSupported
+	}
+	return sftpError(strings.ToLower(r.Method), r.Filepath, err)
+}
+
+// Filelist lists directory or stats file
+func (s *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		files, err := s.h.remoteList(r.Context(), r.Filepath)
+		if err != nil {
+			return nil, sftpError("open", r.Filepath, err)
+		}
+		infos := make(listerAt, len(files))
+		for i := range files {
+			infos[i] = fileInfo{files[i]}
+		}
+		return infos, nil
+	case "Stat":
+		info, err := s.h.remoteStat(r.Context(), r.Filepath)
+		if err != nil {
+			return nil, sftpError("stat", r.Filepath, err)
+		}
+		return listerAt{fileInfo{*info}}, nil
+	}
+	return nil, errNotSupported
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
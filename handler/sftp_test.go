@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/leslie-wang/libp2p-ftp/node"
+	"github.com/leslie-wang/libp2p-ftp/storage"
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/sftp"
+)
+
+func TestListerAt(t *testing.T) {
+	l := listerAt{
+		fileInfo{types.FileInfo{Name: "a"}},
+		fileInfo{types.FileInfo{Name: "b"}},
+		fileInfo{types.FileInfo{Name: "c"}},
+	}
+	for _, c := range []struct {
+		offset int64
+		size   int
+		n      int
+		err    error
+	}{
+		// the last entries come with EOF, so the client stops listing
+		{0, 2, 2, nil},
+		{0, 3, 3, nil},
+		{0, 5, 3, io.EOF},
+		{2, 2, 1, io.EOF},
+		{3, 2, 0, io.EOF},
+		{4, 2, 0, io.EOF},
+	} {
+		infos := make([]os.FileInfo, c.size)
+		n, err := l.ListAt(infos, c.offset)
+		if n != c.n || err != c.err {
+			t.Errorf("%d at %d got %d, %v, want %d, %v", c.size, c.offset, n, err, c.n, c.err)
+			continue
+		}
+		for i := 0; i < n; i++ {
+			if infos[i] != l[int(c.offset)+i] {
+				t.Errorf("%d at %d got %s at %d", c.size, c.offset, infos[i].Name(), i)
+			}
+		}
+	}
+}
+
+func TestSFTPHandler(t *testing.T) {
+	fs := &sftpHandler{h: newTestAPI(t, storage.NewMemory(), nil)}
+
+	if err := fs.Filecmd(sftp.NewRequest("Mkdir", "/dir")); err != nil {
+		t.Fatal(err)
+	}
+	w, err := fs.Filewrite(sftp.NewRequest("Put", "/dir/file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sftp clients write chunks out of order
+	w.WriteAt([]byte("world"), 6)
+	w.WriteAt([]byte("hello "), 0)
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fs.Fileread(sftp.NewRequest("Get", "/dir/file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(io.NewSectionReader(r, 0, 11))
+	r.(io.Closer).Close()
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	if _, err := fs.Fileread(sftp.NewRequest("Get", "/dir")); err == nil {
+		t.Fatal("read of directory succeeded")
+	}
+
+	l, err := fs.Filelist(sftp.NewRequest("List", "/dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := make([]os.FileInfo, 2)
+	if n, err := l.ListAt(infos, 0); n != 1 || err != io.EOF || infos[0].Name() != "file" || infos[0].Size() != 11 {
+		t.Fatalf("list got %d, %v", n, err)
+	}
+	l, err = fs.Filelist(sftp.NewRequest("Stat", "/dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := l.ListAt(infos, 0); n != 1 || !infos[0].IsDir() || !infos[0].Mode().IsDir() {
+		t.Fatalf("stat got %d %+v", n, infos[0])
+	}
+
+	if err := fs.Filecmd(&sftp.Request{Method: "Rename", Filepath: "/dir/file", Target: "/moved"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Filecmd(sftp.NewRequest("Remove", "/moved")); err != nil {
+		t.Fatal(err)
+	}
+	// sftp replies NO_SUCH_FILE only for ENOENT
+	if _, err := fs.Filelist(sftp.NewRequest("Stat", "/moved")); !isErrno(err, syscall.ENOENT) {
+		t.Fatalf("stat of removed file got %v", err)
+	}
+	if _, err := fs.Fileread(sftp.NewRequest("Get", "/moved")); !isErrno(err, syscall.ENOENT) {
+		t.Fatalf("read of removed file got %v", err)
+	}
+	if err := fs.Filecmd(sftp.NewRequest("Remove", "/moved")); !isErrno(err, syscall.ENOENT) {
+		t.Fatalf("remove of removed file got %v", err)
+	}
+	if err := fs.Filecmd(sftp.NewRequest("Symlink", "/dir")); err != errNotSupported {
+		t.Fatalf("symlink got %v", err)
+	}
+}
+
+func isErrno(err error, errno syscall.Errno) bool {
+	e, ok := err.(*os.PathError)
+	return ok && e.Err == errno
+}
+
+func TestSFTPError(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want syscall.Errno
+	}{
+		{&node.RemoteError{Message: "stat /a: file does not exist"}, syscall.ENOENT},
+		{&node.RemoteError{Message: "remove /a: permission denied"}, syscall.EPERM},
+		{&node.RemoteError{Message: "mkdir /a: file exists"}, syscall.EEXIST},
+	} {
+		if err := sftpError("op", "/a", c.err); !isErrno(err, c.want) {
+			t.Errorf("%v got %v, want %v", c.err, err, c.want)
+		}
+	}
+	if err := errors.New("broken"); sftpError("op", "/a", err) != err {
+		t.Error("unknown error is not passed on")
+	}
+}
@@ -0,0 +1,241 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/node"
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// minBackoff is the first wait before reconnecting
+	minBackoff = time.Second
+	// defaultMaxBackoff is used if RetryInterval is not configured
+	defaultMaxBackoff = time.Minute
+)
+
+// errNotConnected is returned to requests while reconnecting
+var errNotConnected = errors.New("not connected to remote peer")
+
+// supervisor keeps the connection to remote peer alive. It watches for
+// disconnects and reconnects with exponential backoff, replacing the whole
+// node if reconnecting through the current one keeps failing.
+type supervisor struct {
+	conf *types.Config
+
+	// nodeLock guards node and inflight only, it is never held while
+	// requests run, so a stalled request does not delay swapping the node
+	nodeLock sync.Mutex
+	node     *node.Node
+	// inflight counts requests using node, which is closed once they are
+	// finished
+	inflight *sync.WaitGroup
+
+	stateLock  sync.Mutex
+	state      types.ConnectionState
+	reconnects chan struct{}
+}
+
+func newSupervisor(c *types.Config) *supervisor {
+	return &supervisor{
+		conf:       c,
+		reconnects: make(chan struct{}, 1),
+		state:      types.ConnectionState{State: types.StateConnecting, Since: time.Now()},
+	}
+}
+
+// Do runs f with current node, or returns error if it is not connected
+func (s *supervisor) Do(f func(n *node.Node) error) error {
+	if s.State().State != types.StateConnected {
+		return errNotConnected
+	}
+	s.nodeLock.Lock()
+	n, inflight := s.node, s.inflight
+	if n == nil {
+		s.nodeLock.Unlock()
+		return errNotConnected
+	}
+	inflight.Add(1)
+	s.nodeLock.Unlock()
+
+	defer inflight.Done()
+	return f(n)
+}
+
+// State returns current connection state
+func (s *supervisor) State() types.ConnectionState {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.state
+}
+
+// Start connects to remote peer and keeps supervising the connection until
+// ctx is done
+func (s *supervisor) Start(ctx context.Context) error {
+	n, err := s.startNode(ctx)
+	if err != nil {
+		return err
+	}
+	s.swap(n)
+	s.setState(types.StateConnected, nil)
+
+	go s.run(ctx)
+	go s.ping(ctx)
+	return nil
+}
+
+// Close closes current node once its in-flight requests are finished
+func (s *supervisor) Close() {
+	s.nodeLock.Lock()
+	old, inflight := s.node, s.inflight
+	s.node, s.inflight = nil, nil
+	s.nodeLock.Unlock()
+
+	if old != nil {
+		inflight.Wait()
+		old.Close()
+	}
+}
+
+// trigger asks for reconnecting, duplicated requests are merged
+func (s *supervisor) trigger() {
+	select {
+	case s.reconnects <- struct{}{}:
+	default:
+	}
+}
+
+func (s *supervisor) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.reconnects:
+		}
+		s.reconnect(ctx)
+	}
+}
+
+// reconnect retries until connection is back. It first redials through the
+// current node, and restarts the node after RetryCount failed attempts.
+func (s *supervisor) reconnect(ctx context.Context) {
+	backoff := minBackoff
+	maxBackoff := s.conf.RetryInterval
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		s.nodeLock.Lock()
+		current := s.node
+		s.nodeLock.Unlock()
+		if current != nil && current.Connected() {
+			s.setState(types.StateConnected, nil)
+			return
+		}
+		s.setState(types.StateReconnecting, nil)
+
+		var err error
+		if current != nil && attempt <= s.conf.RetryCount {
+			err = current.FindPeer(ctx, s.conf.ServerID)
+		} else {
+			var n *node.Node
+			if n, err = s.startNode(ctx); err == nil {
+				s.swap(n)
+			}
+		}
+		if err == nil {
+			log.Printf("reconnected to %s after %d attempts", s.conf.ServerID, attempt)
+			s.setState(types.StateConnected, nil)
+			return
+		}
+
+		log.Printf("reconnect attempt %d got: %v", attempt, err)
+		s.setState(types.StateReconnecting, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// ping checks the connection periodically, since a half-open connection is
+// not always reported as disconnected
+func (s *supervisor) ping(ctx context.Context) {
+	interval := s.conf.RetryInterval
+	if interval <= 0 {
+		interval = defaultMaxBackoff
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if s.State().State != types.StateConnected {
+			continue
+		}
+		pctx, cancel := context.WithTimeout(ctx, interval)
+		err := s.Do(func(n *node.Node) error {
+			return n.PingRequest(pctx)
+		})
+		cancel()
+		if err != nil {
+			log.Printf("ping got: %v", err)
+			s.trigger()
+		}
+	}
+}
+
+func (s *supervisor) startNode(ctx context.Context) (*node.Node, error) {
+	n, err := node.StartNode(ctx, s.conf.ClientPrivateKey, s.conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.FindPeer(ctx, s.conf.ServerID); err != nil {
+		n.Close()
+		return nil, err
+	}
+	n.OnDisconnect(s.trigger)
+	return n, nil
+}
+
+// swap replaces current node at once, and closes the old one in background
+// after its in-flight requests are finished
+func (s *supervisor) swap(n *node.Node) {
+	s.nodeLock.Lock()
+	old, inflight := s.node, s.inflight
+	s.node, s.inflight = n, &sync.WaitGroup{}
+	s.nodeLock.Unlock()
+
+	if old != nil {
+		go func() {
+			inflight.Wait()
+			old.Close()
+		}()
+	}
+}
+
+func (s *supervisor) setState(state string, err error) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	if s.state.State != state {
+		if state == types.StateConnected && s.state.State == types.StateReconnecting {
+			s.state.Reconnects++
+		}
+		s.state.State = state
+		s.state.Since = time.Now()
+	}
+	if err != nil {
+		s.state.LastError = err.Error()
+	}
+}
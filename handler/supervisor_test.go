@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/node"
+	"github.com/leslie-wang/libp2p-ftp/server"
+	"github.com/leslie-wang/libp2p-ftp/storage"
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	host "github.com/libp2p/go-libp2p-host"
+)
+
+// newTestRemote serves st on a new host, and returns it with the config of a
+// connect daemon using it as both bootstrap node and server
+func newTestRemote(t *testing.T, st storage.Storage) (host.Host, *types.Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	h, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	server.New(h, server.WithStorage(st)).Register()
+
+	return h, &types.Config{
+		BootstrapNodes: []string{p2pAddr(t, h)},
+		ServerID:       h.ID().Pretty(),
+		ListenAddrs:    []string{"/ip4/127.0.0.1/tcp/0"},
+		DatastoreDir:   t.TempDir(),
+	}
+}
+
+// newTestAPI returns handler connected to a remote peer serving st
+func newTestAPI(t *testing.T, st storage.Storage, encryption *types.Encryption) *HTTPHandler {
+	_, conf := newTestRemote(t, st)
+	conf.Encryption = encryption
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	h := NewHTTPHandler(conf)
+	if err := h.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	return h
+}
+
+// serve sends request through handler, and returns the recorded reply
+func serve(handler http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, r)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// waitState waits until the supervisor is connected after at least
+// reconnects reconnects
+func waitState(t *testing.T, s *supervisor, reconnects int) {
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		state := s.State()
+		if state.State == types.StateConnected && state.Reconnects >= reconnects {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not reconnected: %+v", state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSupervisorReconnect(t *testing.T) {
+	remote, conf := newTestRemote(t, storage.NewMemory())
+	conf.RetryCount = 2
+	conf.RetryInterval = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSupervisor(conf)
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// requests keep running while the connection is dropped and restored
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.Do(func(n *node.Node) error {
+					return n.PingRequest(ctx)
+				})
+			}
+		}()
+	}
+
+	for i := 1; i <= 5; i++ {
+		var local host.Host
+		s.Do(func(n *node.Node) error {
+			local = n.Host()
+			return nil
+		})
+		if local == nil {
+			t.Fatal("not connected")
+		}
+		if err := remote.Network().ClosePeer(local.ID()); err != nil {
+			t.Fatal(err)
+		}
+		waitState(t, s, i)
+	}
+	close(stop)
+	wg.Wait()
+
+	if err := s.Do(func(n *node.Node) error {
+		return n.PingRequest(ctx)
+	}); err != nil {
+		t.Fatalf("request after reconnecting got: %v", err)
+	}
+}
+
+func TestSupervisorSwapStalledRequest(t *testing.T) {
+	_, conf := newTestRemote(t, storage.NewMemory())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSupervisor(conf)
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// a request stalled on a half-open connection keeps the old node
+	started, release, done := make(chan *node.Node), make(chan struct{}), make(chan struct{})
+	go func() {
+		s.Do(func(n *node.Node) error {
+			started <- n
+			<-release
+			return nil
+		})
+		close(done)
+	}()
+	old := <-started
+
+	n, err := s.startNode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swapped := make(chan struct{})
+	go func() {
+		s.swap(n)
+		close(swapped)
+	}()
+	select {
+	case <-swapped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("swap waits for stalled request")
+	}
+	s.Do(func(current *node.Node) error {
+		if current != n {
+			t.Error("request after swap does not use the new node")
+		}
+		return nil
+	})
+	if !old.Connected() {
+		t.Fatal("old node is closed under the stalled request")
+	}
+	close(release)
+	<-done
+}
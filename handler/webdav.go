@@ -0,0 +1,273 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/leslie-wang/libp2p-ftp/client"
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"golang.org/x/net/webdav"
+)
+
+// serveWebDAV serves WebDAV on localhost, mapping it onto the remote peer,
+// until ctx is done
+func (h *HTTPHandler) serveWebDAV(ctx context.Context) error {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", h.conf.WebDAVListenPort))
+	if err != nil {
+		return err
+	}
+	var handler http.Handler = &webdav.Handler{
+		FileSystem: &davFS{h: h},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("webdav %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	if tokens := h.tokens(); len(tokens) > 0 {
+		handler = authenticateDAV(tokens, handler)
+	}
+	srv := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("webdav: %v", err)
+		}
+	}()
+	return nil
+}
+
+// authenticateDAV passes requests bearing one of tokens on to handler.
+// File managers and davfs2 only send basic authentication, so the token is
+// taken as password of any user as well.
+func authenticateDAV(tokens []string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, given, ok := r.BasicAuth()
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			given, ok = strings.TrimPrefix(auth, "Bearer "), true
+		}
+		if ok && validToken(tokens, given) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="p2pftp"`)
+		http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+	})
+}
+
+// osError converts error reported by remote peer into os errors, which
+// webdav maps onto status codes
+func osError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch client.KindOf(err) {
+	case client.ErrNotFound:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case client.ErrExist:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	case client.ErrPermission:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+	return err
+}
+
+// davFS is webdav.FileSystem of the remote peer
+type davFS struct {
+	h *HTTPHandler
+}
+
+// Mkdir creates directory, whose parent must exist
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if _, err := fs.Stat(ctx, name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if _, err := fs.Stat(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	return osError("mkdir", name, fs.h.remoteMkdir(ctx, name))
+}
+
+// OpenFile opens remote file for reading, or a file which is uploaded on
+// close for creating or truncating. Other opens for writing, like the one
+// of PROPPATCH, only read, so closing them leaves the remote file alone.
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		f, err := ioutil.TempFile("", "p2pftp")
+		if err != nil {
+			return nil, err
+		}
+		return &davFile{name: name, w: &remoteWriter{h: fs.h, ctx: ctx, path: name, f: f}}, nil
+	}
+
+	info, err := fs.h.remoteStat(ctx, name)
+	if err != nil {
+		return nil, osError("open", name, err)
+	}
+	f := &davFile{fs: fs, ctx: ctx, name: name, info: *info}
+	if !info.IsDir {
+		f.r = &remoteReader{h: fs.h, ctx: ctx, path: name, size: info.Size}
+	}
+	return f, nil
+}
+
+// RemoveAll removes file, or directory with everything under it
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	info, err := fs.h.remoteStat(ctx, name)
+	if err != nil {
+		return osError("remove", name, err)
+	}
+	if info.IsDir {
+		files, err := fs.h.remoteList(ctx, name)
+		if err != nil {
+			return osError("remove", name, err)
+		}
+		for _, file := range files {
+			if err := fs.RemoveAll(ctx, path.Join(name, file.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	return osError("remove", name, fs.h.remoteRemove(ctx, name))
+}
+
+// Rename moves file or directory to newName
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return osError("rename", oldName, fs.h.remoteRename(ctx, oldName, newName))
+}
+
+// Stat returns metadata of remote file
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := fs.h.remoteStat(ctx, name)
+	if err != nil {
+		return nil, osError("stat", name, err)
+	}
+	return fileInfo{*info}, nil
+}
+
+// ContentType guesses type by extension, so listing directories does not
+// read every file from the remote peer
+func (fi fileInfo) ContentType(ctx context.Context) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(fi.info.Name)); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// davFile is an open remote file or directory. Written files are uploaded
+// once closed.
+type davFile struct {
+	fs   *davFS
+	ctx  context.Context
+	name string
+	info types.FileInfo
+
+	r      *remoteReader
+	offset int64
+
+	entries []os.FileInfo
+	listed  bool
+
+	w *remoteWriter
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.r == nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrInvalid}
+	}
+	n, err := f.r.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.r == nil {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Readdir returns entries of directory like os.File does
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.info.IsDir {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: os.ErrInvalid}
+	}
+	if !f.listed {
+		files, err := f.fs.h.remoteList(f.ctx, f.name)
+		if err != nil {
+			return nil, osError("readdir", f.name, err)
+		}
+		for _, file := range files {
+			f.entries = append(f.entries, fileInfo{file})
+		}
+		f.listed = true
+	}
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+	return entries, nil
+}
+
+// Stat returns metadata of file, or of written content
+func (f *davFile) Stat() (os.FileInfo, error) {
+	if f.w == nil {
+		return fileInfo{f.info}, nil
+	}
+	info, err := f.w.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{types.FileInfo{Name: path.Base(f.name), Size: info.Size(), Mode: info.Mode(), ModTime: info.ModTime()}}, nil
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	if f.w == nil {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrInvalid}
+	}
+	return f.w.f.Write(p)
+}
+
+// Close uploads written content, or stops reading
+func (f *davFile) Close() error {
+	if f.w != nil {
+		return osError("put", f.name, f.w.Close())
+	}
+	if f.r != nil {
+		return f.r.Close()
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/leslie-wang/libp2p-ftp/node"
+	"github.com/leslie-wang/libp2p-ftp/storage"
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestOSError(t *testing.T) {
+	other := errors.New("broken")
+	for _, c := range []struct {
+		err  error
+		want error
+	}{
+		{&node.RemoteError{Message: "stat /a: file does not exist"}, os.ErrNotExist},
+		{&node.RemoteError{Message: "mkdir /a: file exists"}, os.ErrExist},
+		{&node.RemoteError{Message: "remove /a: permission denied"}, os.ErrPermission},
+		{other, other},
+	} {
+		err := osError("op", "/a", c.err)
+		if e, ok := err.(*os.PathError); ok {
+			err = e.Err
+		}
+		if err != c.want {
+			t.Errorf("%v got %v, want %v", c.err, err, c.want)
+		}
+	}
+	if err := osError("op", "/a", nil); err != nil {
+		t.Errorf("nil got %v", err)
+	}
+}
+
+func TestDavFileSeek(t *testing.T) {
+	f := &davFile{name: "/a", info: types.FileInfo{Size: 10}, r: &remoteReader{}}
+	for _, c := range []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{3, io.SeekStart, 3},
+		{2, io.SeekCurrent, 5},
+		{-1, io.SeekCurrent, 4},
+		{-2, io.SeekEnd, 8},
+		{0, io.SeekEnd, 10},
+		// beyond the end is allowed, reads return EOF there
+		{5, io.SeekEnd, 15},
+	} {
+		got, err := f.Seek(c.offset, c.whence)
+		if err != nil || got != c.want {
+			t.Errorf("seek %d from %d got %d, %v, want %d", c.offset, c.whence, got, err, c.want)
+		}
+	}
+	if _, err := f.Seek(-16, io.SeekEnd); err == nil {
+		t.Error("seek before start succeeded")
+	}
+	if f.offset != 15 {
+		t.Errorf("failed seek moved offset to %d", f.offset)
+	}
+
+	dir := &davFile{name: "/dir", info: types.FileInfo{IsDir: true}}
+	if _, err := dir.Seek(0, io.SeekStart); err == nil {
+		t.Error("seek of directory succeeded")
+	}
+}
+
+func TestDavFileReaddir(t *testing.T) {
+	ctx := context.Background()
+	fs := &davFS{h: newTestAPI(t, storage.NewMemory(), nil)}
+	for _, name := range []string{"/dir/a", "/dir/b", "/dir/c"} {
+		if err := fs.h.remotePut(ctx, name, strings.NewReader("x"), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := func() *davFile {
+		f, err := fs.OpenFile(ctx, "/dir", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f.(*davFile)
+	}
+
+	// with count, entries come in batches until EOF
+	f := open()
+	for _, want := range []int{2, 1} {
+		entries, err := f.Readdir(2)
+		if err != nil || len(entries) != want {
+			t.Fatalf("readdir 2 got %d, %v, want %d", len(entries), err, want)
+		}
+	}
+	if entries, err := f.Readdir(2); len(entries) != 0 || err != io.EOF {
+		t.Fatalf("readdir past end got %d, %v", len(entries), err)
+	}
+
+	// without count, all remaining entries come at once and never EOF
+	f = open()
+	if entries, err := f.Readdir(1); err != nil || len(entries) != 1 || entries[0].Name() != "a" {
+		t.Fatalf("readdir 1 got %v, %v", entries, err)
+	}
+	if entries, err := f.Readdir(0); err != nil || len(entries) != 2 {
+		t.Fatalf("readdir 0 got %d, %v", len(entries), err)
+	}
+	if entries, err := f.Readdir(-1); err != nil || len(entries) != 0 {
+		t.Fatalf("readdir -1 past end got %d, %v", len(entries), err)
+	}
+
+	file, err := fs.OpenFile(ctx, "/dir/a", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Readdir(0); err == nil {
+		t.Fatal("readdir of file succeeded")
+	}
+	if _, err := fs.OpenFile(ctx, "/missing", os.O_RDONLY, 0); !os.IsNotExist(err) {
+		t.Fatalf("open of missing file got %v", err)
+	}
+}
+
+func TestDavPropPatch(t *testing.T) {
+	h := newTestAPI(t, storage.NewMemory(), nil)
+	dav := &webdav.Handler{FileSystem: &davFS{h: h}, LockSystem: webdav.NewMemLS()}
+
+	if w := serve(dav, http.MethodPut, "/a.txt", "hello"); w.Code != http.StatusCreated {
+		t.Fatalf("put got %d %s", w.Code, w.Body.String())
+	}
+	// clients set properties right after uploading
+	w := serve(dav, "PROPPATCH", "/a.txt", `<?xml version="1.0" encoding="utf-8"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:">
+<D:set><D:prop><Z:Win32LastModifiedTime>Mon, 01 Jan 2024 00:00:00 GMT</Z:Win32LastModifiedTime></D:prop></D:set>
+</D:propertyupdate>`)
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("proppatch got %d %s", w.Code, w.Body.String())
+	}
+	if w := serve(dav, http.MethodGet, "/a.txt", ""); w.Body.String() != "hello" {
+		t.Fatalf("get after proppatch %q", w.Body.String())
+	}
+}
@@ -0,0 +1,235 @@
+package node
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-peer"
+
+	ifconnmgr "github.com/libp2p/go-libp2p-interface-connmgr"
+	inet "github.com/libp2p/go-libp2p-net"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// connInfo tracks tags and connections of one peer
+type connInfo struct {
+	firstSeen time.Time
+	value     int
+	tags      map[string]int
+	conns     map[inet.Conn]time.Time
+}
+
+// ConnManager keeps number of open connections between low and high
+// watermarks. Once high watermark is exceeded, connections of least valuable
+// peers are closed until low watermark is reached. Peers are never trimmed
+// during grace period after connecting or if they are protected.
+type ConnManager struct {
+	lowWater    int
+	highWater   int
+	gracePeriod time.Duration
+
+	lock      sync.Mutex
+	peers     map[peer.ID]*connInfo
+	protected map[peer.ID]struct{}
+	connCount int
+
+	trimming int32
+}
+
+var _ ifconnmgr.ConnManager = (*ConnManager)(nil)
+
+// NewConnManager creates a connection manager with given limits
+func NewConnManager(low, high int, grace time.Duration) *ConnManager {
+	return &ConnManager{
+		lowWater:    low,
+		highWater:   high,
+		gracePeriod: grace,
+		peers:       map[peer.ID]*connInfo{},
+		protected:   map[peer.ID]struct{}{},
+	}
+}
+
+// Protect prevents connections of given peer from being trimmed
+func (cm *ConnManager) Protect(p peer.ID) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.protected[p] = struct{}{}
+}
+
+// Unprotect allows connections of given peer to be trimmed again
+func (cm *ConnManager) Unprotect(p peer.ID) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	delete(cm.protected, p)
+}
+
+// TagPeer tags a peer with a string, associating a weight with the tag
+func (cm *ConnManager) TagPeer(p peer.ID, tag string, value int) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	ci, ok := cm.peers[p]
+	if !ok {
+		return
+	}
+	ci.value += value - ci.tags[tag]
+	ci.tags[tag] = value
+}
+
+// UntagPeer removes the tagged value from the peer
+func (cm *ConnManager) UntagPeer(p peer.ID, tag string) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	ci, ok := cm.peers[p]
+	if !ok {
+		return
+	}
+	ci.value -= ci.tags[tag]
+	delete(ci.tags, tag)
+}
+
+// GetTagInfo returns the metadata associated with the peer
+func (cm *ConnManager) GetTagInfo(p peer.ID) *ifconnmgr.TagInfo {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	ci, ok := cm.peers[p]
+	if !ok {
+		return nil
+	}
+	info := &ifconnmgr.TagInfo{
+		FirstSeen: ci.firstSeen,
+		Value:     ci.value,
+		Tags:      map[string]int{},
+		Conns:     map[string]time.Time{},
+	}
+	for tag, value := range ci.tags {
+		info.Tags[tag] = value
+	}
+	for c, t := range ci.conns {
+		info.Conns[c.RemoteMultiaddr().String()] = t
+	}
+	return info
+}
+
+// TrimOpenConns closes connections of least valuable peers until the number
+// of open connections drops to low watermark
+func (cm *ConnManager) TrimOpenConns(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&cm.trimming, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&cm.trimming, 0)
+
+	for _, c := range cm.connsToClose() {
+		if ctx.Err() != nil {
+			return
+		}
+		c.Close()
+	}
+}
+
+// connsToClose picks connections to close for trimming
+func (cm *ConnManager) connsToClose() []inet.Conn {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	// low watermark 0 trims every unprotected connection out of grace period
+	if cm.connCount <= cm.lowWater {
+		return nil
+	}
+
+	candidates := make([]*connInfo, 0, len(cm.peers))
+	now := time.Now()
+	for p, ci := range cm.peers {
+		if _, ok := cm.protected[p]; ok {
+			continue
+		}
+		if ci.firstSeen.Add(cm.gracePeriod).After(now) {
+			continue
+		}
+		candidates = append(candidates, ci)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].value < candidates[j].value
+	})
+
+	target := cm.connCount - cm.lowWater
+	closed := []inet.Conn{}
+	for _, ci := range candidates {
+		if target <= 0 {
+			break
+		}
+		for c := range ci.conns {
+			closed = append(closed, c)
+		}
+		target -= len(ci.conns)
+	}
+	return closed
+}
+
+// Notifee returns the network notifee tracking opened and closed connections
+func (cm *ConnManager) Notifee() inet.Notifiee {
+	return (*cmNotifee)(cm)
+}
+
+type cmNotifee ConnManager
+
+func (nn *cmNotifee) cm() *ConnManager {
+	return (*ConnManager)(nn)
+}
+
+func (nn *cmNotifee) Connected(n inet.Network, c inet.Conn) {
+	cm := nn.cm()
+
+	cm.lock.Lock()
+	p := c.RemotePeer()
+	ci, ok := cm.peers[p]
+	if !ok {
+		ci = &connInfo{
+			firstSeen: time.Now(),
+			tags:      map[string]int{},
+			conns:     map[inet.Conn]time.Time{},
+		}
+		cm.peers[p] = ci
+	}
+	if _, ok := ci.conns[c]; !ok {
+		ci.conns[c] = time.Now()
+		cm.connCount++
+	}
+	exceeded := cm.highWater > 0 && cm.connCount > cm.highWater
+	cm.lock.Unlock()
+
+	if exceeded {
+		go cm.TrimOpenConns(context.Background())
+	}
+}
+
+func (nn *cmNotifee) Disconnected(n inet.Network, c inet.Conn) {
+	cm := nn.cm()
+
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	p := c.RemotePeer()
+	ci, ok := cm.peers[p]
+	if !ok {
+		return
+	}
+	if _, ok := ci.conns[c]; !ok {
+		return
+	}
+	delete(ci.conns, c)
+	cm.connCount--
+	if len(ci.conns) == 0 {
+		delete(cm.peers, p)
+	}
+}
+
+func (nn *cmNotifee) Listen(n inet.Network, addr ma.Multiaddr)      {}
+func (nn *cmNotifee) ListenClose(n inet.Network, addr ma.Multiaddr) {}
+func (nn *cmNotifee) OpenedStream(inet.Network, inet.Stream)        {}
+func (nn *cmNotifee) ClosedStream(inet.Network, inet.Stream)        {}
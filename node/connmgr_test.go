@@ -0,0 +1,63 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p-peer"
+
+	inet "github.com/libp2p/go-libp2p-net"
+)
+
+// fakeConn is a connection which only knows its remote peer
+type fakeConn struct {
+	inet.Conn
+	peer peer.ID
+}
+
+func (c *fakeConn) RemotePeer() peer.ID {
+	return c.peer
+}
+
+// connect adds one connection to each peer, and returns them by peer
+func connect(cm *ConnManager, peers ...peer.ID) map[inet.Conn]peer.ID {
+	conns := map[inet.Conn]peer.ID{}
+	for _, p := range peers {
+		c := &fakeConn{peer: p}
+		cm.Notifee().Connected(nil, c)
+		conns[c] = p
+	}
+	return conns
+}
+
+func TestConnsToClose(t *testing.T) {
+	cm := NewConnManager(1, 10, 0)
+	conns := connect(cm, "a", "b", "c")
+	cm.TagPeer("a", "tag", 10)
+	cm.TagPeer("c", "tag", 5)
+
+	closed := cm.connsToClose()
+	if len(closed) != 2 {
+		t.Fatalf("closes %d connections, want 2", len(closed))
+	}
+	for _, c := range closed {
+		if conns[c] == "a" {
+			t.Fatal("closes the most valuable peer")
+		}
+	}
+}
+
+func TestConnsToCloseLowWaterZero(t *testing.T) {
+	cm := NewConnManager(0, 10, 0)
+	conns := connect(cm, "a", "b", "c")
+	cm.Protect("b")
+
+	closed := cm.connsToClose()
+	if len(closed) != 2 {
+		t.Fatalf("closes %d connections, want 2", len(closed))
+	}
+	for _, c := range closed {
+		if conns[c] == "b" {
+			t.Fatal("closes protected peer")
+		}
+	}
+}
@@ -1,14 +1,8 @@
 package node
 
 import (
-	"bufio"
 	"context"
-	"fmt"
-	"io"
-	"path"
-	"strconv"
-	"strings"
-	"time"
+	"sync"
 
 	"github.com/libp2p/go-libp2p-crypto"
 
@@ -19,17 +13,41 @@ import (
 	"github.com/pkg/errors"
 
 	iaddr "github.com/ipfs/go-ipfs-addr"
+	logging "github.com/ipfs/go-log"
 	libp2p "github.com/libp2p/go-libp2p"
+	circuit "github.com/libp2p/go-libp2p-circuit"
 	host "github.com/libp2p/go-libp2p-host"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
+	inet "github.com/libp2p/go-libp2p-net"
 	pstore "github.com/libp2p/go-libp2p-peerstore"
+	swarm "github.com/libp2p/go-libp2p-swarm"
+	basichost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
+var log = logging.Logger("p2pftp")
+
 // Node is the structure for current node
 type Node struct {
 	host   host.Host
-	pid    peer.ID
 	kadDHT *dht.IpfsDHT
+	relays []ma.Multiaddr
+
+	// pidLock guards pid, which FindPeer may change while requests and
+	// notifications read it
+	pidLock sync.RWMutex
+	pid     peer.ID
+
+	natmgr     basichost.NATManager
+	bootstraps []peer.ID
+
+	datastoreDir string
+	// saveLock serializes saving peerstore, saved is what was saved last
+	saveLock sync.Mutex
+	saved    []byte
+
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 // Host returns node's host
@@ -39,32 +57,138 @@ func (n *Node) Host() host.Host {
 
 // FindPeer discover remote peer in the DHT network
 func (n *Node) FindPeer(ctx context.Context, peerID string) (err error) {
-	n.pid, err = peer.IDB58Decode(peerID)
+	pid, err := peer.IDB58Decode(peerID)
 	if err != nil {
 		return
 	}
-	pi, err := n.kadDHT.FindPeer(ctx, n.pid)
+	n.pidLock.Lock()
+	n.pid = pid
+	n.pidLock.Unlock()
+
+	// try addresses remembered from previous runs before walking the DHT
+	if len(n.host.Peerstore().Addrs(pid)) > 0 {
+		kctx, cancel := context.WithTimeout(ctx, knownPeerTimeout)
+		err = n.host.Connect(kctx, pstore.PeerInfo{ID: pid})
+		cancel()
+		if err == nil {
+			log.Infof("Connected to %s with known addresses", peerID)
+			return n.savePeerstore()
+		}
+		n.clearBackoff(pid)
+	}
+
+	pi, err := n.kadDHT.FindPeer(ctx, pid)
 	if err != nil {
 		return
 	}
-	fmt.Printf("Found peers: %v!\n", pi)
+	log.Infof("Found peers: %v", pi)
+	if err = n.connect(ctx, pi); err != nil {
+		return
+	}
+	return n.savePeerstore()
+}
+
+// remotePeer returns the remote peer found by FindPeer
+func (n *Node) remotePeer() peer.ID {
+	n.pidLock.RLock()
+	defer n.pidLock.RUnlock()
+	return n.pid
+}
+
+// connect connects to remote peer directly, and falls back to relays if
+// direct connection fails
+func (n *Node) connect(ctx context.Context, pi pstore.PeerInfo) (err error) {
+	direct, relayed := splitRelayAddrs(pi.Addrs)
+	err = n.host.Connect(ctx, pstore.PeerInfo{ID: pi.ID, Addrs: direct})
+	if err == nil || (len(relayed) == 0 && len(n.relays) == 0) {
+		return
+	}
 
-	return n.host.Connect(ctx, pi)
+	// the remote peer is probably behind NAT, so try to reach it via relays
+	log.Infof("Direct connection failed: %v, falling back to relay", err)
+	n.host.Peerstore().ClearAddrs(pi.ID)
+	n.clearBackoff(pi.ID)
+	relayed = append(relayed, n.relays...)
+	if err = n.host.Connect(ctx, pstore.PeerInfo{ID: pi.ID, Addrs: relayed}); err != nil {
+		return
+	}
+	log.Warning("connected through relay, throughput will be reduced")
+	return nil
+}
+
+// clearBackoff allows redialing a peer immediately after a failed dial
+func (n *Node) clearBackoff(pid peer.ID) {
+	if s, ok := n.host.Network().(*swarm.Swarm); ok {
+		s.Backoff().Clear(pid)
+	}
+}
+
+// splitRelayAddrs separates circuit relay addresses from direct addresses
+func splitRelayAddrs(addrs []ma.Multiaddr) (direct, relayed []ma.Multiaddr) {
+	for _, addr := range addrs {
+		if _, err := addr.ValueForProtocol(circuit.P_CIRCUIT); err == nil {
+			relayed = append(relayed, addr)
+		} else {
+			direct = append(direct, addr)
+		}
+	}
+	return
+}
+
+// relayAddrsFactory advertises circuit addresses through given relays besides
+// the host's own listen addresses
+func relayAddrsFactory(relays []ma.Multiaddr) basichost.AddrsFactory {
+	return func(addrs []ma.Multiaddr) []ma.Multiaddr {
+		return append(addrs, relays...)
+	}
+}
+
+// parsePeerAddr parses multiaddr ending with /ipfs/<peer id>
+func parsePeerAddr(s string) (*pstore.PeerInfo, error) {
+	addr, err := iaddr.ParseString(s)
+	if err != nil {
+		return nil, err
+	}
+	return pstore.InfoFromP2pAddr(addr.Multiaddr())
 }
 
 // Close close current node and its handler
 func (n *Node) Close() error {
+	n.closeOnce.Do(func() { close(n.closed) })
+	if err := n.savePeerstore(); err != nil {
+		log.Errorf("save peerstore got: %v", err)
+	}
 	return n.host.Close()
 }
 
-// StartNode starts current node and connect to dht network
-func StartNode(ctx context.Context, privateKey string, bootstrapNodes []string) (*Node, error) {
+// StartNode starts current node and connect to dht network. Extra libp2p
+// options can be given to customize the underlying host.
+func StartNode(ctx context.Context, privateKey string, conf *types.Config, extra ...libp2p.Option) (*Node, error) {
 	// libp2p.New constructs a new libp2p Host.
 	// Other options can be added here.
 	var err error
-	node := &Node{}
+	node := &Node{datastoreDir: conf.DatastoreDir, closed: make(chan struct{})}
 
-	opts := []libp2p.Option{}
+	opts, err := transportOptions(conf)
+	if err != nil {
+		return nil, err
+	}
+	var relayInfos []*pstore.PeerInfo
+	for _, relay := range conf.RelayNodes {
+		peerinfo, err := parsePeerAddr(relay)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid relay address %s", relay)
+		}
+		relayInfos = append(relayInfos, peerinfo)
+		addr, err := ma.NewMultiaddr(relay + "/p2p-circuit")
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid relay node %s", relay)
+		}
+		node.relays = append(node.relays, addr)
+	}
+	if len(node.relays) > 0 {
+		opts = append(opts, libp2p.EnableRelay(), libp2p.AddrsFactory(relayAddrsFactory(node.relays)))
+	}
 	if privateKey != "" {
 		privBytes, err := crypto.ConfigDecodeKey(privateKey)
 		if err != nil {
@@ -76,6 +200,30 @@ func StartNode(ctx context.Context, privateKey string, bootstrapNodes []string)
 		}
 		opts = append(opts, libp2p.Identity(priv))
 	}
+	if conf.EnableNATPortMap {
+		opts = append(opts, libp2p.NATManager(func(net inet.Network) basichost.NATManager {
+			node.natmgr = basichost.NewNATManager(net)
+			return node.natmgr
+		}))
+	}
+	if conf.ConnMgrHighWater > 0 {
+		cm := NewConnManager(conf.ConnMgrLowWater, conf.ConnMgrHighWater, conf.ConnMgrGracePeriod)
+		// never trim connections to the server, allowed clients and relays
+		for _, id := range append([]string{conf.ServerID}, conf.AllowedClients...) {
+			if pid, err := peer.IDB58Decode(id); err == nil {
+				cm.Protect(pid)
+			}
+		}
+		for _, relay := range node.relays {
+			if pid, err := relay.ValueForProtocol(ma.P_IPFS); err == nil {
+				if id, err := peer.IDB58Decode(pid); err == nil {
+					cm.Protect(id)
+				}
+			}
+		}
+		opts = append(opts, libp2p.ConnectionManager(cm))
+	}
+	opts = append(opts, extra...)
 	node.host, err = libp2p.New(ctx, opts...)
 	if err != nil {
 		return nil, err
@@ -83,239 +231,50 @@ func StartNode(ctx context.Context, privateKey string, bootstrapNodes []string)
 
 	node.kadDHT, err = dht.New(ctx, node.host)
 	if err != nil {
+		node.host.Close()
 		return nil, err
 	}
 
+	if err := node.loadPeerstore(ctx); err != nil {
+		log.Errorf("load peerstore got: %v", err)
+	}
+
 	// Let's connect to the bootstrap nodes first. They will tell us about the other nodes in the network.
 	ok := false
-	for _, peerAddr := range bootstrapNodes {
-		addr, _ := iaddr.ParseString(peerAddr)
-		peerinfo, _ := pstore.InfoFromP2pAddr(addr.Multiaddr())
+	for _, peerAddr := range conf.BootstrapNodes {
+		peerinfo, err := parsePeerAddr(peerAddr)
+		if err != nil {
+			node.host.Close()
+			return nil, errors.Wrapf(err, "invalid bootstrap address %s", peerAddr)
+		}
 
+		node.bootstraps = append(node.bootstraps, peerinfo.ID)
 		if err := node.host.Connect(ctx, *peerinfo); err != nil {
-			fmt.Println(err)
+			log.Warning(err)
 		} else {
-			fmt.Println("Connection established with bootstrap node: ", *peerinfo)
+			log.Info("Connection established with bootstrap node: ", *peerinfo)
 			ok = true
 		}
 	}
 	if !ok {
+		node.host.Close()
 		return nil, errors.New("Unable to connect any bootstrap nodes")
 	}
 
-	fmt.Printf("Announcing ourselves: %s (%s)\n", node.host.ID().String(), node.host.ID().Pretty())
-	return node, nil
-}
-
-// PingRequest sends ping request to remote peer
-func (n *Node) PingRequest(ctx context.Context)  error {
-	stream, err := n.host.NewStream(ctx, n.pid, types.PingURL)
-	if err != nil {
-		return err
-	}
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-
-	pong, err := rw.ReadString('\n');
-	if err != nil {
-		return err
-	}
-	fmt.Printf("%s is received\n", strings.TrimSpace(pong))
-	return rw.Flush()
-}
-
-// ListRequest sends list request to remote peer
-func (n *Node) ListRequest(ctx context.Context, dir string) (files []string, err error) {
-	if !path.IsAbs(dir) {
-		return nil, errors.New("please use absolute path")
-	}
-	stream, err := n.host.NewStream(ctx, n.pid, types.ListURL)
-	if err != nil {
-		return nil, err
-	}
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-
-	if _, err := rw.WriteString(fmt.Sprintf("%s\n", dir)); err != nil {
-		return nil, err
-	}
-	if err := rw.Flush(); err != nil {
-		return nil, err
-	}
-
-	ch := make(chan []string)
-	e := make(chan error)
-
-	go func() {
-		l := []string{}
-		for {
-			file, err := rw.ReadString('\n')
-			if err != nil {
-				e <- err
-			}
-			if file == "\n" {
-				ch <- l
-				break
-			} else {
-				l = append(l, strings.TrimSpace(file))
-			}
-		}
-		close(ch)
-		close(e)
-	}()
-
-	select {
-	case files = <-ch:
-		return files, nil
-	case err = <-e:
-		return nil, err
-	case <-time.After(types.ReadTimeout):
-		return nil, errors.New("Read Timeout")
-	}
-}
-
-// DeleteRequest sends delete request to remote peer
-func (n *Node) DeleteRequest(ctx context.Context, dir string) error {
-	if !path.IsAbs(dir) {
-		return errors.New("please use absolute path")
-	}
-	stream, err := n.host.NewStream(ctx, n.pid, types.DeleteURL)
-	if err != nil {
-		return err
-	}
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-
-	if _, err := rw.WriteString(fmt.Sprintf("%s\n", dir)); err != nil {
-		return err
-	}
-	if err := rw.Flush(); err != nil {
-		return err
-	}
-
-	e := make(chan error)
-
-	go func() {
-		for i := 0; i < 2; i++ {
-			_, err := rw.ReadString('\n')
-			if err != nil {
-				e <- err
-			}
-		}
-		close(e)
-	}()
-
-	select {
-	case err := <-e:
-		return err
-	case <-time.After(types.ReadTimeout):
-		return errors.New("Read Timeout")
-	}
-}
-
-// GetRequest sends get request to remote peer
-func (n *Node) GetRequest(ctx context.Context, filename string, dst io.Writer) error {
-	if !path.IsAbs(filename) {
-		return errors.New("please use absolute path")
-	}
-	stream, err := n.host.NewStream(ctx, n.pid, types.GetURL)
-	if err != nil {
-		return err
-	}
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-
-	if _, err := rw.WriteString(fmt.Sprintf("%s\n", filename)); err != nil {
-		return err
-	}
-	if err := rw.Flush(); err != nil {
-		return err
-	}
-
-	s := make(chan string)
-	e := make(chan error)
-
-	go func() {
-		size, err := rw.ReadString('\n')
-		if err != nil {
-			e <- err
+	// keep connections to relays open, so that they can relay inbound
+	// connections to us
+	for i, peerinfo := range relayInfos {
+		if err := node.host.Connect(ctx, *peerinfo); err != nil {
+			log.Warningf("Unable to connect relay node %s: %v", conf.RelayNodes[i], err)
 		} else {
-			s <- size
-		}
-		close(s)
-	}()
-
-	size := 0
-	select {
-	case err := <-e:
-		return err
-	case str := <-s:
-		str = strings.TrimSpace(str)
-		parts := strings.SplitN(str, " ", 2)
-		if len(parts) > 1 {
-			return errors.Errorf("got error reply: %s", str)
+			log.Info("Connection established with relay node: ", *peerinfo)
 		}
-		size, err = strconv.Atoi(str)
-		if err != nil {
-			return err
-		}
-	case <-time.After(types.ReadTimeout):
-		return errors.New("Read Timeout")
 	}
 
-	fmt.Printf("file size: %d\n", size)
-	go func() {
-		buf := make([]byte, size)
-		remaining := size
-		for {
-			len, err := rw.Read(buf)
-			if err != nil {
-				e <- err
-			}
-			fmt.Printf("read %d bytes\n", len)
-			if _, err := dst.Write(buf[:len]); err != nil {
-				e <- err
-			}
-			remaining = remaining - len
-			if remaining == 0 {
-				break
-			}
-		}
-		close(e)
-	}()
-
-	select {
-	case err := <-e:
-		return err
-	case <-time.After(types.ReadTimeout):
-		return errors.New("Read Timeout")
-	}
-	return nil
-}
-
-// PutRequest sends get request to remote peer
-func (n *Node) PutRequest(ctx context.Context, content []byte, remoteDir string) error {
-	if !path.IsAbs(remoteDir) {
-		return errors.New("please use absolute path for remote path")
-	}
-	stream, err := n.host.NewStream(ctx, n.pid, types.PutURL)
-	if err != nil {
-		return err
+	if node.datastoreDir != "" {
+		go node.savePeerstoreLoop(ctx, peerstoreSaveInterval)
 	}
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-	defer rw.Flush()
 
-	if _, err := rw.WriteString(fmt.Sprintf("%d %s\n", len(content), remoteDir)); err != nil {
-		return err
-	}
-	remaining := len(content)
-	for {
-		size, err := rw.Write(content)
-		if err != nil {
-			return err
-		}
-		fmt.Printf("Total legnth %d, write %d bytes\n", remaining, size)
-		if size == remaining {
-			return nil
-		}
-		remaining = remaining - size
-		content = content[size:]
-	}
-	return nil
+	log.Infof("Announcing ourselves: %s (%s)", node.host.ID().String(), node.host.ID().Pretty())
+	return node, nil
 }
@@ -0,0 +1,80 @@
+package node
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	host "github.com/libp2p/go-libp2p-host"
+)
+
+// p2pAddr returns IPv4 address of h with its peer ID
+func p2pAddr(t *testing.T, h host.Host) string {
+	for _, addr := range h.Addrs() {
+		if strings.HasPrefix(addr.String(), "/ip4/") {
+			return addr.String() + "/ipfs/" + h.ID().Pretty()
+		}
+	}
+	t.Fatalf("%s listens on no IPv4 address: %v", h.ID().Pretty(), h.Addrs())
+	return ""
+}
+
+func TestStartNodeClosesHostOnError(t *testing.T) {
+	ctx := context.Background()
+
+	// a bootstrap node that is gone
+	gone, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bootstrap := p2pAddr(t, gone)
+	gone.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	port := addr[len("127.0.0.1:"):]
+
+	_, err = StartNode(ctx, "", &types.Config{
+		BootstrapNodes: []string{bootstrap},
+		ListenAddrs:    []string{"/ip4/127.0.0.1/tcp/" + port},
+		DatastoreDir:   t.TempDir(),
+	})
+	if err == nil {
+		t.Fatal("started without reachable bootstrap node")
+	}
+	// the listener of the failed node is closed
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
+
+func TestStartNodeInvalidAddress(t *testing.T) {
+	ctx := context.Background()
+	bootstrap, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bootstrap.Close()
+	valid := p2pAddr(t, bootstrap)
+
+	for name, conf := range map[string]*types.Config{
+		"bootstrap": {BootstrapNodes: []string{"/ip4/127.0.0.1/tcp/4001"}},
+		"relay":     {BootstrapNodes: []string{valid}, RelayNodes: []string{"/ip4/127.0.0.1/tcp/4002"}},
+	} {
+		conf.ListenAddrs = []string{"/ip4/127.0.0.1/tcp/0"}
+		conf.DatastoreDir = t.TempDir()
+		if _, err := StartNode(ctx, "", conf); err == nil || !strings.Contains(err.Error(), "invalid "+name+" address") {
+			t.Errorf("%s address without peer ID got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package node
+
+import (
+	inet "github.com/libp2p/go-libp2p-net"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Connected tells whether there is any open connection to remote peer
+func (n *Node) Connected() bool {
+	pid := n.remotePeer()
+	return pid != "" && n.host.Network().Connectedness(pid) == inet.Connected
+}
+
+// OnDisconnect registers a callback invoked when the last connection to the
+// remote peer found by FindPeer is closed
+func (n *Node) OnDisconnect(f func()) {
+	n.host.Network().Notify(&disconnectNotifee{node: n, f: f})
+}
+
+type disconnectNotifee struct {
+	node *Node
+	f    func()
+}
+
+func (dn *disconnectNotifee) Disconnected(net inet.Network, c inet.Conn) {
+	pid := dn.node.remotePeer()
+	if c.RemotePeer() != pid || len(net.ConnsToPeer(pid)) > 0 {
+		return
+	}
+	// notifications are delivered synchronously, never block the network
+	go dn.f()
+}
+
+func (dn *disconnectNotifee) Connected(inet.Network, inet.Conn)      {}
+func (dn *disconnectNotifee) Listen(inet.Network, ma.Multiaddr)      {}
+func (dn *disconnectNotifee) ListenClose(inet.Network, ma.Multiaddr) {}
+func (dn *disconnectNotifee) OpenedStream(inet.Network, inet.Stream) {}
+func (dn *disconnectNotifee) ClosedStream(inet.Network, inet.Stream) {}
@@ -0,0 +1,182 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/libp2p/go-libp2p-crypto"
+	"github.com/libp2p/go-libp2p-peer"
+
+	dhtopts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	peerstoreFile = "peerstore.json"
+	// knownPeerTimeout limits how long remembered addresses are tried
+	// before falling back to a DHT lookup
+	knownPeerTimeout = 10 * time.Second
+)
+
+// peerstoreSaveInterval is how often peerstore is saved while node runs, so
+// peers learned since start survive a crash
+var peerstoreSaveInterval = time.Minute
+
+// savedPeer is one peerstore entry persisted on disk
+type savedPeer struct {
+	ID     string
+	Addrs  []string
+	PubKey string `json:",omitempty"`
+}
+
+// savedPeerstore is the on-disk format of peerstore and routing table
+type savedPeerstore struct {
+	Peers        []savedPeer
+	RoutingTable []string
+}
+
+// loadPeerstore restores peer addresses, public keys and routing table saved
+// by previous run
+func (n *Node) loadPeerstore(ctx context.Context) error {
+	if n.datastoreDir == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(filepath.Join(n.datastoreDir, peerstoreFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	saved := savedPeerstore{}
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return err
+	}
+
+	ps := n.host.Peerstore()
+	for _, sp := range saved.Peers {
+		pid, err := peer.IDB58Decode(sp.ID)
+		if err != nil || pid == n.host.ID() {
+			continue
+		}
+		for _, a := range sp.Addrs {
+			if addr, err := ma.NewMultiaddr(a); err == nil {
+				ps.AddAddr(pid, addr, pstore.RecentlyConnectedAddrTTL)
+			}
+		}
+		if sp.PubKey == "" {
+			continue
+		}
+		if pubBytes, err := crypto.ConfigDecodeKey(sp.PubKey); err == nil {
+			if pub, err := crypto.UnmarshalPublicKey(pubBytes); err == nil {
+				ps.AddPubKey(pid, pub)
+			}
+		}
+	}
+	for _, id := range saved.RoutingTable {
+		if pid, err := peer.IDB58Decode(id); err == nil {
+			n.kadDHT.Update(ctx, pid)
+		}
+	}
+	return nil
+}
+
+// savePeerstoreLoop saves peerstore every interval until node is closed
+func (n *Node) savePeerstoreLoop(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.closed:
+			return
+		case <-time.After(interval):
+		}
+		if err := n.savePeerstore(); err != nil {
+			log.Errorf("save peerstore got: %v", err)
+		}
+	}
+}
+
+// savePeerstore writes peer addresses, public keys and DHT routing table
+// into datastore directory, unless they are unchanged since last save
+func (n *Node) savePeerstore() error {
+	if n.datastoreDir == "" {
+		return nil
+	}
+	saved := savedPeerstore{}
+	ps := n.host.Peerstore()
+	for _, pid := range ps.PeersWithAddrs() {
+		if pid == n.host.ID() {
+			continue
+		}
+		sp := savedPeer{ID: peer.IDB58Encode(pid)}
+		for _, addr := range ps.Addrs(pid) {
+			sp.Addrs = append(sp.Addrs, addr.String())
+		}
+		if pub := ps.PubKey(pid); pub != nil {
+			if pubBytes, err := crypto.MarshalPublicKey(pub); err == nil {
+				sp.PubKey = crypto.ConfigEncodeKey(pubBytes)
+			}
+		}
+		saved.Peers = append(saved.Peers, sp)
+	}
+	for _, pid := range n.routingTablePeers() {
+		saved.RoutingTable = append(saved.RoutingTable, peer.IDB58Encode(pid))
+	}
+
+	content, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	n.saveLock.Lock()
+	defer n.saveLock.Unlock()
+	if bytes.Equal(content, n.saved) {
+		return nil
+	}
+	if err := os.MkdirAll(n.datastoreDir, 0700); err != nil {
+		return err
+	}
+	// write to temporary file first, so a crash never leaves a truncated one
+	tmp, err := ioutil.TempFile(n.datastoreDir, peerstoreFile+".")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(n.datastoreDir, peerstoreFile))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	n.saved = content
+	return nil
+}
+
+// routingTablePeers returns peers of DHT routing table. The DHT does not
+// expose its table, which holds exactly the connected peers serving the DHT
+// protocol, so they are selected the same way.
+func (n *Node) routingTablePeers() []peer.ID {
+	protos := make([]string, 0, len(dhtopts.DefaultProtocols))
+	for _, proto := range dhtopts.DefaultProtocols {
+		protos = append(protos, string(proto))
+	}
+	var peers []peer.ID
+	ps := n.host.Peerstore()
+	for _, pid := range n.host.Network().Peers() {
+		if supported, err := ps.SupportsProtocols(pid, protos...); err == nil && len(supported) > 0 {
+			peers = append(peers, pid)
+		}
+	}
+	return peers
+}
@@ -0,0 +1,130 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+func TestSavePeerstoreRoutingTable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a peer without DHT is connected, but not in the routing table
+	plain, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+
+	first, err := StartNode(ctx, "", &types.Config{
+		BootstrapNodes: []string{p2pAddr(t, plain)},
+		ListenAddrs:    []string{"/ip4/127.0.0.1/tcp/0"},
+		DatastoreDir:   t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	dir := t.TempDir()
+	n, err := StartNode(ctx, "", &types.Config{
+		BootstrapNodes: []string{p2pAddr(t, first.Host())},
+		ListenAddrs:    []string{"/ip4/127.0.0.1/tcp/0"},
+		DatastoreDir:   dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Host().Connect(ctx, pstore.PeerInfo{ID: plain.ID(), Addrs: plain.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	// DHT support of the first node may be learned after connecting
+	for deadline := time.Now().Add(5 * time.Second); len(n.routingTablePeers()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("first node is not in the routing table")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, peerstoreFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := savedPeerstore{}
+	if err := json.Unmarshal(content, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.RoutingTable) != 1 || saved.RoutingTable[0] != first.Host().ID().Pretty() {
+		t.Fatalf("routing table %v, want only %s", saved.RoutingTable, first.Host().ID().Pretty())
+	}
+	found := false
+	for _, sp := range saved.Peers {
+		found = found || sp.ID == plain.ID().Pretty()
+	}
+	if !found {
+		t.Fatal("addresses of peer without DHT are not saved")
+	}
+}
+
+func TestSavePeerstorePeriodically(t *testing.T) {
+	defer func(interval time.Duration) { peerstoreSaveInterval = interval }(peerstoreSaveInterval)
+	peerstoreSaveInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bootstrap, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bootstrap.Close()
+
+	dir := t.TempDir()
+	n, err := StartNode(ctx, "", &types.Config{
+		BootstrapNodes: []string{p2pAddr(t, bootstrap)},
+		ListenAddrs:    []string{"/ip4/127.0.0.1/tcp/0"},
+		DatastoreDir:   dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	// the bootstrap peer is saved without FindPeer or Close
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		content, err := ioutil.ReadFile(filepath.Join(dir, peerstoreFile))
+		if err == nil && strings.Contains(string(content), bootstrap.ID().Pretty()) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peerstore is not saved: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// a periodic save may still be writing its temporary file
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d files in datastore directory, want only %s", len(files), peerstoreFile)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
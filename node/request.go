@@ -0,0 +1,432 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/errors"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+)
+
+// ErrNotAbsolute is returned for relative remote paths
+var ErrNotAbsolute = errors.New("please use absolute path")
+
+// RemoteError is an error reported by remote peer
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// request is one stream to the remote peer. The stream is reset once ctx
+// is done, so blocking reads and writes return.
+type request struct {
+	stream inet.Stream
+	*bufio.ReadWriter
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+func (n *Node) newRequest(ctx context.Context, protos ...protocol.ID) (*request, error) {
+	ctx, cancel := context.WithTimeout(ctx, types.ReadTimeout)
+	stream, err := n.host.NewStream(ctx, n.remotePeer(), protos...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req := &request{
+		stream:     stream,
+		ReadWriter: bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream)),
+		done:       make(chan struct{}),
+		cancel:     cancel,
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			// close cancels ctx as well, the stream is only reset if it
+			// is still in use
+			select {
+			case <-req.done:
+			default:
+				stream.Reset()
+			}
+		case <-req.done:
+		}
+	}()
+	return req, nil
+}
+
+// writeLine sends one request line
+func (r *request) writeLine(format string, args ...interface{}) error {
+	if _, err := r.WriteString(fmt.Sprintf(format+"\n", args...)); err != nil {
+		return err
+	}
+	return r.Flush()
+}
+
+// readLine reads one reply line without line break
+func (r *request) readLine() (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// close closes the stream, and stops watching the context
+func (r *request) close() {
+	close(r.done)
+	r.stream.Close()
+	r.cancel()
+}
+
+// PingRequest sends ping request to remote peer
+func (n *Node) PingRequest(ctx context.Context) error {
+	req, err := n.newRequest(ctx, types.PingURL)
+	if err != nil {
+		return err
+	}
+	defer req.close()
+
+	pong, err := req.readLine()
+	if err != nil {
+		return err
+	}
+	log.Debugf("%s is received", strings.TrimSpace(pong))
+	return nil
+}
+
+// ListRequest sends list request to remote peer
+func (n *Node) ListRequest(ctx context.Context, dir string) ([]string, error) {
+	if !path.IsAbs(dir) {
+		return nil, ErrNotAbsolute
+	}
+	req, err := n.newRequest(ctx, types.ListURL)
+	if err != nil {
+		return nil, err
+	}
+	defer req.close()
+
+	if err := req.writeLine("%s", dir); err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for {
+		file, err := req.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if file == "" {
+			return files, nil
+		}
+		files = append(files, strings.TrimSpace(file))
+	}
+}
+
+// ListDetailRequest sends list request to remote peer, and returns metadata
+// of every file under the directory
+func (n *Node) ListDetailRequest(ctx context.Context, dir string) ([]types.FileInfo, error) {
+	reply, err := n.jsonRequest(ctx, types.ListDetailURL, dir)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Files, nil
+}
+
+// StatRequest asks remote peer for metadata of one file
+func (n *Node) StatRequest(ctx context.Context, filename string) (*types.FileInfo, error) {
+	reply, err := n.jsonRequest(ctx, types.StatURL, filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Files) != 1 {
+		return nil, errors.New("invalid stat reply")
+	}
+	return &reply.Files[0], nil
+}
+
+// VersionsRequest asks remote peer for previous versions of file, newest
+// first
+func (n *Node) VersionsRequest(ctx context.Context, filename string) ([]types.FileInfo, error) {
+	reply, err := n.jsonRequest(ctx, types.VersionsURL, filename)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Files, nil
+}
+
+// RestoreRequest asks remote peer to make version the current content of
+// file, and returns metadata of the restored file
+func (n *Node) RestoreRequest(ctx context.Context, filename, version string) (*types.FileInfo, error) {
+	if !path.IsAbs(filename) {
+		return nil, ErrNotAbsolute
+	}
+	reply, err := n.jsonLineRequest(ctx, types.RestoreURL, version+" "+filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Files) != 1 {
+		return nil, errors.New("invalid restore reply")
+	}
+	return &reply.Files[0], nil
+}
+
+// TrashRequest asks remote peer for files deleted from under dir, newest
+// first
+func (n *Node) TrashRequest(ctx context.Context, dir string) ([]types.TrashEntry, error) {
+	reply, err := n.jsonRequest(ctx, types.TrashURL, dir)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Trash, nil
+}
+
+// UndeleteRequest asks remote peer to move trash entry back to the path it
+// was deleted from, and returns metadata of the restored file
+func (n *Node) UndeleteRequest(ctx context.Context, filename, id string) (*types.FileInfo, error) {
+	if !path.IsAbs(filename) {
+		return nil, ErrNotAbsolute
+	}
+	reply, err := n.jsonLineRequest(ctx, types.UndeleteURL, id+" "+filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Files) != 1 {
+		return nil, errors.New("invalid undelete reply")
+	}
+	return &reply.Files[0], nil
+}
+
+// PurgeRequest asks remote peer to delete file permanently instead of into
+// trash
+func (n *Node) PurgeRequest(ctx context.Context, filename string) error {
+	_, err := n.jsonRequest(ctx, types.PurgeURL, filename)
+	return err
+}
+
+// QuotaRequest asks remote peer for storage quota of this peer
+func (n *Node) QuotaRequest(ctx context.Context) (*types.QuotaStatus, error) {
+	req, err := n.newRequest(ctx, types.QuotaURL)
+	if err != nil {
+		return nil, err
+	}
+	defer req.close()
+
+	reply := &types.Reply{}
+	if err := json.NewDecoder(req).Decode(reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return nil, &RemoteError{Message: reply.Error}
+	}
+	return reply.Quota, nil
+}
+
+// MkdirRequest asks remote peer to create directory and its parents, and
+// returns metadata of the directory
+func (n *Node) MkdirRequest(ctx context.Context, dir string) (*types.FileInfo, error) {
+	reply, err := n.jsonRequest(ctx, types.MkdirURL, dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Files) != 1 {
+		return nil, errors.New("invalid mkdir reply")
+	}
+	return &reply.Files[0], nil
+}
+
+// RenameRequest asks remote peer to move file or directory to newname, and
+// returns metadata of it at the new path
+func (n *Node) RenameRequest(ctx context.Context, oldname, newname string) (*types.FileInfo, error) {
+	if !path.IsAbs(oldname) || !path.IsAbs(newname) {
+		return nil, ErrNotAbsolute
+	}
+	reply, err := n.jsonLineRequest(ctx, types.RenameURL, oldname+"\n"+newname)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Files) != 1 {
+		return nil, errors.New("invalid rename reply")
+	}
+	return &reply.Files[0], nil
+}
+
+// jsonRequest sends path to remote peer and decodes its JSON reply
+func (n *Node) jsonRequest(ctx context.Context, proto protocol.ID, p string) (*types.Reply, error) {
+	if !path.IsAbs(p) {
+		return nil, ErrNotAbsolute
+	}
+	return n.jsonLineRequest(ctx, proto, p)
+}
+
+// jsonLineRequest sends request line to remote peer and decodes its JSON
+// reply
+func (n *Node) jsonLineRequest(ctx context.Context, proto protocol.ID, line string) (*types.Reply, error) {
+	req, err := n.newRequest(ctx, proto)
+	if err != nil {
+		return nil, err
+	}
+	defer req.close()
+
+	if err := req.writeLine("%s", line); err != nil {
+		return nil, err
+	}
+	reply := &types.Reply{}
+	if err := json.NewDecoder(req).Decode(reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return nil, &RemoteError{Message: reply.Error}
+	}
+	return reply, nil
+}
+
+// DeleteRequest sends delete request to remote peer
+func (n *Node) DeleteRequest(ctx context.Context, filename string) error {
+	if !path.IsAbs(filename) {
+		return ErrNotAbsolute
+	}
+	req, err := n.newRequest(ctx, types.DeleteV2URL, types.DeleteURL)
+	if err != nil {
+		return err
+	}
+	defer req.close()
+
+	if err := req.writeLine("%s", filename); err != nil {
+		return err
+	}
+	msg, err := req.readLine()
+	if err == io.EOF && req.stream.Protocol() == types.DeleteURL {
+		// v1 peers may close without reply
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if msg != "" {
+		return &RemoteError{Message: msg}
+	}
+	return nil
+}
+
+// GetRequest sends get request to remote peer, and writes file content into
+// dst. It returns number of bytes written.
+func (n *Node) GetRequest(ctx context.Context, filename string, dst io.Writer) (int64, error) {
+	if !path.IsAbs(filename) {
+		return 0, ErrNotAbsolute
+	}
+	return n.getRequest(ctx, types.GetURL, filename, dst)
+}
+
+// GetVersionRequest sends get request of previous version of file to remote
+// peer, and writes its content into dst. It returns number of bytes
+// written.
+func (n *Node) GetVersionRequest(ctx context.Context, filename, version string, dst io.Writer) (int64, error) {
+	if !path.IsAbs(filename) {
+		return 0, ErrNotAbsolute
+	}
+	return n.getRequest(ctx, types.GetVersionURL, version+" "+filename, dst)
+}
+
+// GetRangeRequest sends get request of file content from offset on to
+// remote peer, and writes it into dst. It returns number of bytes written.
+func (n *Node) GetRangeRequest(ctx context.Context, filename string, offset int64, dst io.Writer) (int64, error) {
+	if !path.IsAbs(filename) {
+		return 0, ErrNotAbsolute
+	}
+	return n.getRequest(ctx, types.GetRangeURL, fmt.Sprintf("%d %s", offset, filename), dst)
+}
+
+// getRequest sends request line, and copies content of reply into dst
+func (n *Node) getRequest(ctx context.Context, proto protocol.ID, line string, dst io.Writer) (int64, error) {
+	req, err := n.newRequest(ctx, proto)
+	if err != nil {
+		return 0, err
+	}
+	defer req.close()
+
+	if err := req.writeLine("%s", line); err != nil {
+		return 0, err
+	}
+	line, err = req.readLine()
+	if err != nil {
+		return 0, err
+	}
+	parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	if len(parts) > 1 {
+		return 0, &RemoteError{Message: parts[1]}
+	}
+	size, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Debugf("file size: %d", size)
+	return io.CopyN(dst, req, size)
+}
+
+// PutRequest sends put request to remote peer with size bytes read from src
+func (n *Node) PutRequest(ctx context.Context, src io.Reader, size int64, remoteFile string) error {
+	if !path.IsAbs(remoteFile) {
+		return ErrNotAbsolute
+	}
+	req, err := n.newRequest(ctx, types.PutV2URL, types.PutURL)
+	if err != nil {
+		return err
+	}
+	defer req.close()
+
+	if _, err := req.WriteString(fmt.Sprintf("%d %s\n", size, remoteFile)); err != nil {
+		return err
+	}
+	if req.stream.Protocol() == types.PutURL {
+		// v1 peers never reply
+		written, err := io.CopyN(req, src, size)
+		if err != nil {
+			return err
+		}
+		log.Debugf("Total length %d, write %d bytes", size, written)
+		return req.Flush()
+	}
+
+	// the peer may reject the put before reading the content, e.g. for
+	// quota, so the reply is read while the content is still sent
+	replied := make(chan error, 1)
+	go func() {
+		msg, err := req.readLine()
+		if err == nil && msg != "" {
+			err = &RemoteError{Message: msg}
+			// stop sending content nobody reads
+			req.stream.Reset()
+		}
+		replied <- err
+	}()
+	written, err := io.CopyN(req, src, size)
+	log.Debugf("Total length %d, write %d bytes", size, written)
+	if err == nil {
+		err = req.Flush()
+	}
+	if err != nil {
+		// unblock reading the reply, unless it came already
+		req.stream.Reset()
+	}
+	// the reason of rejection wins over failing to send the rest
+	reply := <-replied
+	if _, ok := reply.(*RemoteError); ok || err == nil {
+		return reply
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	inet "github.com/libp2p/go-libp2p-net"
+)
+
+// TestV1Peer checks put and delete against a listener speaking the first
+// protocol version, which never replies to put, and may close delete
+// streams without reply
+func TestV1Peer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	h, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	received := make(chan string, 1)
+	h.SetStreamHandler(types.PutURL, func(stream inet.Stream) {
+		r := bufio.NewReader(stream)
+		line, _ := r.ReadString('\n')
+		parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		size, _ := strconv.ParseInt(parts[0], 10, 64)
+		data, _ := ioutil.ReadAll(io.LimitReader(r, size))
+		// the stream is left open without reply
+		received <- string(data)
+	})
+	h.SetStreamHandler(types.DeleteURL, func(stream inet.Stream) {
+		bufio.NewReader(stream).ReadString('\n')
+		stream.Close()
+	})
+
+	n, err := StartNode(ctx, "", &types.Config{
+		BootstrapNodes: []string{p2pAddr(t, h)},
+		ListenAddrs:    []string{"/ip4/127.0.0.1/tcp/0"},
+		DatastoreDir:   t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if err := n.FindPeer(ctx, h.ID().Pretty()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.PutRequest(ctx, strings.NewReader("hello"), 5, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != "hello" {
+		t.Fatalf("received %q", got)
+	}
+	if err := n.DeleteRequest(ctx, "/a"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,127 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	basichost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	identify "github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Status reports the network status of current node
+func (n *Node) Status() *types.Status {
+	s := &types.Status{
+		ID:          n.host.ID().Pretty(),
+		MappedPorts: map[string]string{},
+	}
+
+	addrs, _ := n.host.Network().InterfaceListenAddresses()
+	for _, addr := range addrs {
+		s.ListenAddrs = append(s.ListenAddrs, addr.String())
+	}
+
+	var observed []ma.Multiaddr
+	if ids := n.idService(); ids != nil {
+		observed = ids.OwnObservedAddrs()
+		for _, addr := range observed {
+			s.ObservedAddrs = append(s.ObservedAddrs, addr.String())
+		}
+	}
+
+	var mapped []ma.Multiaddr
+	if n.natmgr != nil && n.natmgr.NAT() != nil {
+		for internal, external := range n.natmgr.NAT().MappedAddrs() {
+			if external == nil {
+				continue
+			}
+			s.MappedPorts[internal.String()] = external.String()
+			mapped = append(mapped, external)
+		}
+	}
+	s.BehindNAT, s.Reachable = natStatus(addrs, observed, mapped)
+
+	for _, pid := range n.bootstraps {
+		if n.host.Network().Connectedness(pid) == inet.Connected {
+			s.BootstrapPeers = append(s.BootstrapPeers, pid.Pretty())
+		}
+	}
+	return s
+}
+
+// natStatus compares the addresses other peers observed for us with the local
+// ones. Node is behind NAT unless some peer observed one of its local IPs, and
+// it is reachable if such an IP, or an address mapped by the NAT, is public.
+// Node which is not observed yet is taken as behind NAT.
+func natStatus(local, observed, mapped []ma.Multiaddr) (behindNAT, reachable bool) {
+	ips := map[string]bool{}
+	for _, addr := range local {
+		if ip := addrIP(addr); ip != nil {
+			ips[ip.String()] = true
+		}
+	}
+
+	behindNAT = true
+	for _, addr := range observed {
+		if ip := addrIP(addr); ip != nil && ips[ip.String()] {
+			behindNAT = false
+			reachable = reachable || isPublicAddr(addr)
+		}
+	}
+	for _, addr := range mapped {
+		reachable = reachable || isPublicAddr(addr)
+	}
+	return behindNAT, reachable
+}
+
+// StatusRequest asks remote peer for its network status
+func (n *Node) StatusRequest(ctx context.Context) (*types.Status, error) {
+	req, err := n.newRequest(ctx, types.StatusURL)
+	if err != nil {
+		return nil, err
+	}
+	defer req.close()
+
+	s := &types.Status{}
+	if err := json.NewDecoder(req).Decode(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// isPublicAddr checks whether the IP part of given address is routable on
+// the internet
+func isPublicAddr(addr ma.Multiaddr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddrSpace.Contains(ip)
+}
+
+// addrIP returns the IP part of given address, or nil if it has none
+func addrIP(addr ma.Multiaddr) net.IP {
+	value, err := addr.ValueForProtocol(ma.P_IP4)
+	if err != nil {
+		if value, err = addr.ValueForProtocol(ma.P_IP6); err != nil {
+			return nil
+		}
+	}
+	return net.ParseIP(value)
+}
+
+// sharedAddrSpace is used by carrier-grade NAT (RFC 6598)
+var sharedAddrSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// idService returns identify service of the host, which tracks the addresses
+// other peers observed for us
+func (n *Node) idService() *identify.IDService {
+	if bh, ok := n.host.(*basichost.BasicHost); ok {
+		return bh.IDService()
+	}
+	return nil
+}
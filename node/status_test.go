@@ -0,0 +1,108 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	inet "github.com/libp2p/go-libp2p-net"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func addrs(t *testing.T, ss ...string) []ma.Multiaddr {
+	var addrs []ma.Multiaddr
+	for _, s := range ss {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func TestNATStatus(t *testing.T) {
+	local := addrs(t, "/ip4/192.168.1.2/tcp/4001", "/ip4/8.8.8.8/tcp/4001")
+	for _, c := range []struct {
+		name                 string
+		observed, mapped     []ma.Multiaddr
+		behindNAT, reachable bool
+	}{
+		{"not observed", nil, nil, true, false},
+		{"observed on other IP", addrs(t, "/ip4/1.2.3.4/tcp/5000"), nil, true, false},
+		{"observed on private IP", addrs(t, "/ip4/192.168.1.2/tcp/4001"), nil, false, false},
+		{"observed on public IP", addrs(t, "/ip4/8.8.8.8/tcp/4001"), nil, false, true},
+		{"mapped", addrs(t, "/ip4/1.2.3.4/tcp/5000"), addrs(t, "/ip4/1.2.3.4/tcp/4001"), true, true},
+		{"mapped to shared address", nil, addrs(t, "/ip4/100.64.0.1/tcp/4001"), true, false},
+	} {
+		behindNAT, reachable := natStatus(local, c.observed, c.mapped)
+		if behindNAT != c.behindNAT || reachable != c.reachable {
+			t.Errorf("%s: behind NAT %v, reachable %v, want %v, %v", c.name, behindNAT, reachable, c.behindNAT, c.reachable)
+		}
+	}
+}
+
+func TestStatusRequestUnresponsive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	remote, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	release := make(chan struct{})
+	defer close(release)
+	remote.SetStreamHandler(types.StatusURL, func(s inet.Stream) {
+		<-release
+		s.Close()
+	})
+
+	h, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Connect(ctx, pstore.PeerInfo{ID: remote.ID(), Addrs: remote.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	n := &Node{host: h, pid: remote.ID()}
+
+	rctx, rcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer rcancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := n.StatusRequest(rctx)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("status of unresponsive peer is received")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("status request hangs on unresponsive peer")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	s := (&Node{host: h}).Status()
+	if s.ID != h.ID().Pretty() || len(s.ListenAddrs) == 0 {
+		t.Fatalf("unexpected status %+v", s)
+	}
+	if !s.BehindNAT || s.Reachable {
+		t.Fatal("node which is not observed is not taken as behind NAT")
+	}
+}
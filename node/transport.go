@@ -0,0 +1,46 @@
+package node
+
+import (
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/errors"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	tcp "github.com/libp2p/go-tcp-transport"
+	ws "github.com/libp2p/go-ws-transport"
+)
+
+// transports maps names usable in config to libp2p transports
+var transports = map[string]interface{}{
+	types.TransportTCP:       tcp.NewTCPTransport,
+	types.TransportWebSocket: ws.New,
+}
+
+// defaultWebSocketListenAddr is listened on when only WebSocket is enabled
+// and no listen address is configured
+const defaultWebSocketListenAddr = "/ip4/0.0.0.0/tcp/0/ws"
+
+// transportOptions returns libp2p options enabling configured transports and
+// listen addresses, libp2p defaults are kept for those not configured.
+// WebSocket connections are dialed by the default dialer of gorilla/websocket,
+// which takes its proxy from the environment like http.ProxyFromEnvironment.
+func transportOptions(conf *types.Config) ([]libp2p.Option, error) {
+	opts := []libp2p.Option{}
+	tcpEnabled := len(conf.Transports) == 0
+	for _, name := range conf.Transports {
+		tpt, ok := transports[name]
+		if !ok {
+			return nil, errors.Errorf("unknown transport %s", name)
+		}
+		opts = append(opts, libp2p.Transport(tpt))
+		tcpEnabled = tcpEnabled || name == types.TransportTCP
+	}
+
+	switch {
+	case len(conf.ListenAddrs) > 0:
+		opts = append(opts, libp2p.ListenAddrStrings(conf.ListenAddrs...))
+	case !tcpEnabled:
+		opts = append(opts, libp2p.ListenAddrStrings(defaultWebSocketListenAddr))
+	}
+	return opts, nil
+}
@@ -0,0 +1,67 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/leslie-wang/libp2p-ftp/server"
+	"github.com/leslie-wang/libp2p-ftp/storage"
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	ws "github.com/libp2p/go-ws-transport"
+)
+
+const wsListenAddr = "/ip4/127.0.0.1/tcp/0/ws"
+
+func startWebSocketNode(t *testing.T, ctx context.Context, bootstrap string) *Node {
+	n, err := StartNode(ctx, "", &types.Config{
+		BootstrapNodes: []string{bootstrap},
+		ListenAddrs:    []string{wsListenAddr},
+		Transports:     []string{types.TransportWebSocket},
+		DatastoreDir:   t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bootstrap, err := libp2p.New(ctx, libp2p.Transport(ws.New), libp2p.ListenAddrStrings(wsListenAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bootstrap.Close()
+
+	srv := startWebSocketNode(t, ctx, p2pAddr(t, bootstrap))
+	server.New(srv.Host(), server.WithStorage(storage.NewMemory())).Register()
+
+	cli := startWebSocketNode(t, ctx, p2pAddr(t, srv.Host()))
+	if err := cli.FindPeer(ctx, srv.Host().ID().Pretty()); err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range cli.Host().Network().ConnsToPeer(srv.Host().ID()) {
+		if !strings.HasSuffix(conn.RemoteMultiaddr().String(), "/ws") {
+			t.Fatalf("connection to server on %s is not WebSocket", conn.RemoteMultiaddr())
+		}
+	}
+
+	data := []byte("hello over websocket")
+	if err := cli.PutRequest(ctx, bytes.NewReader(data), int64(len(data)), "/hello"); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if _, err := cli.GetRequest(ctx, "/hello", &got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("got %q, want %q", got.Bytes(), data)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-peer"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+)
+
+// Logging logs remote peer, protocol and duration of every stream
+func Logging(logf func(format string, args ...interface{})) Middleware {
+	return func(proto protocol.ID, next inet.StreamHandler) inet.StreamHandler {
+		return func(stream inet.Stream) {
+			start := time.Now()
+			next(stream)
+			logf("%s %s took %v", stream.Conn().RemotePeer().Pretty(), proto, time.Since(start))
+		}
+	}
+}
+
+// AllowPeers resets streams from peers not in the list
+func AllowPeers(ids ...peer.ID) Middleware {
+	allowed := map[peer.ID]struct{}{}
+	for _, id := range ids {
+		allowed[id] = struct{}{}
+	}
+	return func(proto protocol.ID, next inet.StreamHandler) inet.StreamHandler {
+		return func(stream inet.Stream) {
+			if _, ok := allowed[stream.Conn().RemotePeer()]; !ok {
+				stream.Reset()
+				return
+			}
+			next(stream)
+		}
+	}
+}
+
+// ProtocolMetrics are the counters of one protocol
+type ProtocolMetrics struct {
+	Requests int64
+	InFlight int64
+	BytesIn  int64
+	BytesOut int64
+}
+
+// Metrics counts requests and transferred bytes per protocol
+type Metrics struct {
+	lock      sync.Mutex
+	protocols map[protocol.ID]*ProtocolMetrics
+}
+
+// NewMetrics creates empty metrics
+func NewMetrics() *Metrics {
+	return &Metrics{protocols: map[protocol.ID]*ProtocolMetrics{}}
+}
+
+// Snapshot returns a copy of current counters
+func (m *Metrics) Snapshot() map[protocol.ID]ProtocolMetrics {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	snapshot := make(map[protocol.ID]ProtocolMetrics, len(m.protocols))
+	for proto, pm := range m.protocols {
+		snapshot[proto] = ProtocolMetrics{
+			Requests: atomic.LoadInt64(&pm.Requests),
+			InFlight: atomic.LoadInt64(&pm.InFlight),
+			BytesIn:  atomic.LoadInt64(&pm.BytesIn),
+			BytesOut: atomic.LoadInt64(&pm.BytesOut),
+		}
+	}
+	return snapshot
+}
+
+func (m *Metrics) get(proto protocol.ID) *ProtocolMetrics {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	pm, ok := m.protocols[proto]
+	if !ok {
+		pm = &ProtocolMetrics{}
+		m.protocols[proto] = pm
+	}
+	return pm
+}
+
+// Middleware returns the middleware updating the metrics
+func (m *Metrics) Middleware() Middleware {
+	return func(proto protocol.ID, next inet.StreamHandler) inet.StreamHandler {
+		pm := m.get(proto)
+		return func(stream inet.Stream) {
+			atomic.AddInt64(&pm.Requests, 1)
+			atomic.AddInt64(&pm.InFlight, 1)
+			defer atomic.AddInt64(&pm.InFlight, -1)
+			next(&countingStream{Stream: stream, pm: pm})
+		}
+	}
+}
+
+// countingStream counts bytes read from and written to the stream
+type countingStream struct {
+	inet.Stream
+	pm *ProtocolMetrics
+}
+
+func (s *countingStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	atomic.AddInt64(&s.pm.BytesIn, int64(n))
+	return n, err
+}
+
+func (s *countingStream) Write(p []byte) (int, error) {
+	n, err := s.Stream.Write(p)
+	atomic.AddInt64(&s.pm.BytesOut, int64(n))
+	return n, err
+}
@@ -0,0 +1,541 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/leslie-wang/libp2p-ftp/storage"
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/errors"
+
+	inet "github.com/libp2p/go-libp2p-net"
+)
+
+// context returns the context of operations on behalf of stream, it is done
+// when serving stops
+func (s *Server) context(stream inet.Stream) context.Context {
+	s.lock.Lock()
+	ctx := s.ctx
+	s.lock.Unlock()
+	return storage.WithPeer(ctx, stream.Conn().RemotePeer().Pretty())
+}
+
+func (s *Server) ping(stream inet.Stream) {
+	// Create a buffer stream for non blocking read and write.
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	defer rw.Flush()
+
+	_, err := rw.WriteString("pong\n")
+	if err != nil {
+		s.logf("%v", err)
+	}
+}
+
+func (s *Server) status(stream inet.Stream) {
+	if s.statusFunc == nil {
+		return
+	}
+	if err := json.NewEncoder(stream).Encode(s.statusFunc()); err != nil {
+		s.logf("%v", err)
+	}
+}
+
+func (s *Server) list(stream inet.Stream) {
+	// Create a buffer stream for non blocking read and write.
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	defer rw.Flush()
+
+	dir, err := rw.ReadString('\n')
+	if err != nil {
+		s.logf("%v", err)
+		return
+	}
+	dir = strings.TrimSpace(dir)
+
+	files, err := s.storage.List(s.context(stream), dir)
+	if err != nil {
+		if _, err := rw.WriteString(fmt.Sprintf("%s\n", err.Error())); err != nil {
+			s.logf("%v", err)
+		}
+	} else {
+		for _, file := range files {
+			if _, err := rw.WriteString(fmt.Sprintf("%s\n", file.Name)); err != nil {
+				s.logf("%v", err)
+			}
+		}
+	}
+
+	if _, err := rw.WriteString("\n"); err != nil {
+		s.logf("%v", err)
+	}
+}
+
+func (s *Server) listDetail(stream inet.Stream) {
+	dir, err := readPath(stream)
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+
+	files, err := s.storage.List(s.context(stream), dir)
+	s.writeReply(stream, files, err)
+}
+
+func (s *Server) stat(stream inet.Stream) {
+	file, err := readPath(stream)
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+
+	info, err := s.storage.Stat(s.context(stream), file)
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+	s.writeReply(stream, []types.FileInfo{*info}, nil)
+}
+
+// readPath reads the path of a request
+func readPath(stream inet.Stream) (string, error) {
+	p, err := bufio.NewReader(stream).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(p), nil
+}
+
+// writeReply writes JSON reply with either files or error
+func (s *Server) writeReply(stream inet.Stream, files []types.FileInfo, err error) {
+	reply := types.Reply{Files: files}
+	if err != nil {
+		reply.Error = err.Error()
+		reply.Files = nil
+	}
+	if err := json.NewEncoder(stream).Encode(reply); err != nil {
+		s.logf("%v", err)
+	}
+}
+
+func (s *Server) remove(stream inet.Stream) {
+	// Create a buffer stream for non blocking read and write.
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	defer rw.Flush()
+
+	dir, err := rw.ReadString('\n')
+	if err != nil {
+		s.logf("%v", err)
+		return
+	}
+	dir = strings.TrimSpace(dir)
+
+	if err := s.storage.Remove(s.context(stream), dir); err != nil {
+		if _, err := rw.WriteString(fmt.Sprintf("%s\n\n", err.Error())); err != nil {
+			s.logf("%v", err)
+		}
+		return
+	}
+	if _, err := rw.WriteString("\n\n"); err != nil {
+		s.logf("%v", err)
+	}
+}
+
+func (s *Server) get(stream inet.Stream) {
+	// Create a buffer stream for non blocking read and write.
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	defer rw.Flush()
+
+	file, err := rw.ReadString('\n')
+	if err != nil {
+		s.logf("%v", err)
+		if _, err := rw.WriteString(fmt.Sprintf("-1 %s\n", err.Error())); err != nil {
+			s.logf("%v", err)
+		}
+		return
+	}
+	file = strings.TrimSpace(file)
+
+	if err := s.send(s.context(stream), rw, file); err != nil {
+		s.logf("%v", err)
+	}
+}
+
+// send writes size line followed by file content, or error line if file
+// cannot be read
+func (s *Server) send(ctx context.Context, rw *bufio.ReadWriter, file string) error {
+	info, err := s.storage.Stat(ctx, file)
+	if err == nil && info.IsDir {
+		err = storage.ErrNotRegular
+	}
+	var r io.ReadCloser
+	if err == nil {
+		r, err = s.storage.Open(ctx, file, 0, -1)
+	}
+	return sendContent(rw, info, r, err)
+}
+
+// sendContent writes size line followed by content of r, or error line if
+// opening failed
+func sendContent(rw *bufio.ReadWriter, info *types.FileInfo, r io.ReadCloser, err error) error {
+	if err != nil {
+		if _, err := rw.WriteString(fmt.Sprintf("-1 %s\n", err.Error())); err != nil {
+			return err
+		}
+		return err
+	}
+	defer r.Close()
+
+	if _, err := rw.WriteString(fmt.Sprintf("%d\n", info.Size)); err != nil {
+		return err
+	}
+	_, err = io.CopyN(rw, r, info.Size)
+	return err
+}
+
+func (s *Server) put(stream inet.Stream) {
+	// Create a buffer stream for non blocking read and write.
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	defer rw.Flush()
+
+	line, err := rw.ReadString('\n')
+	if err != nil {
+		s.logf("%v", err)
+		return
+	}
+	line = strings.TrimSpace(line)
+
+	if err := s.receive(s.context(stream), rw, line); err != nil {
+		s.logf("%v", err)
+		if _, err := rw.WriteString(fmt.Sprintf("%s\n", err.Error())); err != nil {
+			s.logf("%v", err)
+		}
+		// content may still be coming, e.g. if the put was rejected before
+		// reading it. It is drained, so the client is not blocked sending
+		// it before reading the reply, until it stops sending.
+		if err := rw.Flush(); err == nil {
+			io.Copy(ioutil.Discard, rw)
+		}
+		return
+	}
+	if _, err := rw.WriteString("\n"); err != nil {
+		s.logf("%v", err)
+	}
+}
+
+// receive stores uploaded content of put request
+func (s *Server) receive(ctx context.Context, rw *bufio.ReadWriter, line string) error {
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 {
+		return errors.Errorf("invalid put request: %s", line)
+	}
+	size, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	w, err := s.storage.Create(ctx, parts[1], size)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, rw, size); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// versioner returns storage as Versioner if it keeps versions
+func (s *Server) versioner() (storage.Versioner, error) {
+	v, ok := s.storage.(storage.Versioner)
+	if !ok {
+		return nil, storage.ErrNoVersioning
+	}
+	return v, nil
+}
+
+// readVersion reads request line of version and path
+func readVersion(stream inet.Stream) (string, string, error) {
+	line, err := readPath(stream)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 {
+		return "", "", errors.Errorf("invalid version request: %s", line)
+	}
+	return parts[0], parts[1], nil
+}
+
+func (s *Server) versions(stream inet.Stream) {
+	file, err := readPath(stream)
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+
+	v, err := s.versioner()
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+	versions, err := v.Versions(s.context(stream), file)
+	s.writeReply(stream, versions, err)
+}
+
+func (s *Server) getVersion(stream inet.Stream) {
+	// Create a buffer stream for non blocking read and write.
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	defer rw.Flush()
+
+	line, err := rw.ReadString('\n')
+	if err != nil {
+		s.logf("%v", err)
+		return
+	}
+	line = strings.TrimSpace(line)
+
+	ctx := s.context(stream)
+	var info *types.FileInfo
+	var r io.ReadCloser
+	parts := strings.SplitN(line, " ", 2)
+	v, err := s.versioner()
+	if err == nil && len(parts) != 2 {
+		err = errors.Errorf("invalid version request: %s", line)
+	}
+	if err == nil {
+		info, err = findVersion(ctx, v, parts[1], parts[0])
+	}
+	if err == nil {
+		r, err = v.OpenVersion(ctx, parts[1], parts[0], 0, -1)
+	}
+	if err := sendContent(rw, info, r, err); err != nil {
+		s.logf("%v", err)
+	}
+}
+
+// findVersion returns metadata of one version of file
+func findVersion(ctx context.Context, v storage.Versioner, file, version string) (*types.FileInfo, error) {
+	versions, err := v.Versions(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range versions {
+		if info.Version == version {
+			return &info, nil
+		}
+	}
+	return nil, &os.PathError{Op: "open", Path: file, Err: errors.Errorf("no version %s", version)}
+}
+
+func (s *Server) restore(stream inet.Stream) {
+	version, file, err := readVersion(stream)
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+
+	ctx := s.context(stream)
+	v, err := s.versioner()
+	if err == nil {
+		err = v.Restore(ctx, file, version)
+	}
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+	info, err := s.storage.Stat(ctx, file)
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+	s.writeReply(stream, []types.FileInfo{*info}, nil)
+}
+
+// trasher returns storage as Trasher if it has trash
+func (s *Server) trasher() (storage.Trasher, error) {
+	t, ok := s.storage.(storage.Trasher)
+	if !ok {
+		return nil, storage.ErrNoTrash
+	}
+	return t, nil
+}
+
+func (s *Server) trash(stream inet.Stream) {
+	dir, err := readPath(stream)
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+
+	t, err := s.trasher()
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+	entries, err := t.Trash(s.context(stream), dir)
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+	if err := json.NewEncoder(stream).Encode(types.Reply{Trash: entries}); err != nil {
+		s.logf("%v", err)
+	}
+}
+
+func (s *Server) undelete(stream inet.Stream) {
+	id, file, err := readVersion(stream)
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+
+	t, err := s.trasher()
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+	info, err := t.Undelete(s.context(stream), file, id)
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+	s.writeReply(stream, []types.FileInfo{*info}, nil)
+}
+
+// purge removes permanently, storage without trash removes that way anyway
+func (s *Server) purge(stream inet.Stream) {
+	file, err := readPath(stream)
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+
+	ctx := s.context(stream)
+	t, err := s.trasher()
+	if err == nil {
+		err = t.Purge(ctx, file)
+	}
+	if err == storage.ErrNoTrash {
+		err = s.storage.Remove(ctx, file)
+	}
+	s.writeReply(stream, nil, err)
+}
+
+func (s *Server) quota(stream inet.Stream) {
+	reply := types.Reply{}
+	q, ok := s.storage.(storage.QuotaReporter)
+	if !ok {
+		reply.Error = "quota is not enabled"
+	} else if status, err := q.Quota(s.context(stream)); err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.Quota = status
+	}
+	if err := json.NewEncoder(stream).Encode(reply); err != nil {
+		s.logf("%v", err)
+	}
+}
+
+func (s *Server) mkdir(stream inet.Stream) {
+	dir, err := readPath(stream)
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+
+	ctx := s.context(stream)
+	if err := s.storage.Mkdir(ctx, dir); err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+	info, err := s.storage.Stat(ctx, dir)
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+	s.writeReply(stream, []types.FileInfo{*info}, nil)
+}
+
+// rename reads old and new path on separate lines, since both may contain
+// spaces
+func (s *Server) rename(stream inet.Stream) {
+	r := bufio.NewReader(stream)
+	oldname, err := r.ReadString('\n')
+	var newname string
+	if err == nil {
+		newname, err = r.ReadString('\n')
+	}
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+	oldname, newname = strings.TrimSpace(oldname), strings.TrimSpace(newname)
+
+	ctx := s.context(stream)
+	if err := s.storage.Rename(ctx, oldname, newname); err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+	info, err := s.storage.Stat(ctx, newname)
+	if err != nil {
+		s.writeReply(stream, nil, err)
+		return
+	}
+	s.writeReply(stream, []types.FileInfo{*info}, nil)
+}
+
+// getRange sends content of file from offset on, request line is offset
+// and path
+func (s *Server) getRange(stream inet.Stream) {
+	// Create a buffer stream for non blocking read and write.
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	defer rw.Flush()
+
+	line, err := rw.ReadString('\n')
+	if err != nil {
+		s.logf("%v", err)
+		return
+	}
+	line = strings.TrimSpace(line)
+
+	ctx := s.context(stream)
+	var info *types.FileInfo
+	var r io.ReadCloser
+	var offset int64
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 {
+		err = errors.Errorf("invalid range request: %s", line)
+	}
+	if err == nil {
+		offset, err = strconv.ParseInt(parts[0], 10, 64)
+	}
+	if err == nil {
+		info, err = s.storage.Stat(ctx, parts[1])
+	}
+	if err == nil && info.IsDir {
+		err = storage.ErrNotRegular
+	}
+	if err == nil && (offset < 0 || offset > info.Size) {
+		err = &os.PathError{Op: "open", Path: parts[1], Err: errors.Errorf("invalid offset %d", offset)}
+	}
+	if err == nil {
+		r, err = s.storage.Open(ctx, parts[1], offset, -1)
+	}
+	if err == nil {
+		// only the remainder is sent
+		remainder := *info
+		remainder.Size -= offset
+		info = &remainder
+	}
+	if err := sendContent(rw, info, r, err); err != nil {
+		s.logf("%v", err)
+	}
+}
@@ -0,0 +1,268 @@
+// Package server serves p2pftp protocols on a libp2p host. It can attach to
+// the host of an existing daemon, and is shut down by cancelling the context
+// given to Serve.
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/storage"
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	host "github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+)
+
+const (
+	// DefaultDrainTimeout is how long in-flight streams are waited for on
+	// shutdown before they are reset
+	DefaultDrainTimeout = 30 * time.Second
+	// DefaultExpireInterval is how often expired content, like trash past
+	// its retention, is removed
+	DefaultExpireInterval = time.Hour
+)
+
+// Middleware wraps the stream handler of given protocol, it can reject
+// streams, or observe them before and after next is called
+type Middleware func(proto protocol.ID, next inet.StreamHandler) inet.StreamHandler
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithMiddleware appends middlewares, the first one is the outermost
+func WithMiddleware(mws ...Middleware) Option {
+	return func(s *Server) {
+		s.middlewares = append(s.middlewares, mws...)
+	}
+}
+
+// WithStatus sets the function reporting network status of the server
+func WithStatus(f func() *types.Status) Option {
+	return func(s *Server) {
+		s.statusFunc = f
+	}
+}
+
+// WithStorage sets where files are served from, default is the whole local
+// filesystem
+func WithStorage(st storage.Storage) Option {
+	return func(s *Server) {
+		s.storage = st
+	}
+}
+
+// WithLogger sets where errors of serving streams are logged, they are
+// dropped by default
+func WithLogger(logf func(format string, args ...interface{})) Option {
+	return func(s *Server) {
+		s.logger = logf
+	}
+}
+
+// WithDrainTimeout sets how long in-flight streams are waited for on
+// shutdown
+func WithDrainTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.drainTimeout = d
+	}
+}
+
+// WithExpireInterval sets how often expired content of storage is removed
+// while serving
+func WithExpireInterval(d time.Duration) Option {
+	return func(s *Server) {
+		s.expireInterval = d
+	}
+}
+
+// Server serves p2pftp protocols on a libp2p host
+type Server struct {
+	host           host.Host
+	storage        storage.Storage
+	middlewares    []Middleware
+	statusFunc     func() *types.Status
+	drainTimeout   time.Duration
+	expireInterval time.Duration
+	logger         func(format string, args ...interface{})
+
+	lock    sync.Mutex
+	closing bool
+	// ctx is the context of storage operations, it is only done when
+	// in-flight streams are not drained in time
+	ctx     context.Context
+	cancel  context.CancelFunc
+	streams map[inet.Stream]struct{}
+	wg      sync.WaitGroup
+}
+
+// New creates a server on given host
+func New(h host.Host, opts ...Option) *Server {
+	s := &Server{
+		host:           h,
+		storage:        storage.NewLocal("/"),
+		drainTimeout:   DefaultDrainTimeout,
+		expireInterval: DefaultExpireInterval,
+		streams:        map[inet.Stream]struct{}{},
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// logf logs with the logger, if one is set
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.logger != nil {
+		s.logger(format, args...)
+	}
+}
+
+// handlers returns stream handler of every protocol
+func (s *Server) handlers() map[protocol.ID]inet.StreamHandler {
+	return map[protocol.ID]inet.StreamHandler{
+		types.PingURL:       s.ping,
+		types.ListURL:       s.list,
+		types.ListDetailURL: s.listDetail,
+		types.StatURL:       s.stat,
+		types.DeleteURL:     s.remove,
+		types.DeleteV2URL:   s.remove,
+		types.GetURL:        s.get,
+		types.PutURL:        s.put,
+		types.PutV2URL:      s.put,
+		types.StatusURL:     s.status,
+		types.VersionsURL:   s.versions,
+		types.GetVersionURL: s.getVersion,
+		types.RestoreURL:    s.restore,
+		types.TrashURL:      s.trash,
+		types.UndeleteURL:   s.undelete,
+		types.PurgeURL:      s.purge,
+		types.QuotaURL:      s.quota,
+		types.MkdirURL:      s.mkdir,
+		types.RenameURL:     s.rename,
+		types.GetRangeURL:   s.getRange,
+	}
+}
+
+// Register sets protocol handlers on the host
+func (s *Server) Register() {
+	s.lock.Lock()
+	s.closing = false
+	s.lock.Unlock()
+
+	for proto, handler := range s.handlers() {
+		for i := len(s.middlewares) - 1; i >= 0; i-- {
+			handler = s.middlewares[i](proto, handler)
+		}
+		s.host.SetStreamHandler(proto, s.track(handler))
+	}
+}
+
+// Unregister removes protocol handlers from the host, in-flight streams are
+// not affected
+func (s *Server) Unregister() {
+	s.lock.Lock()
+	s.closing = true
+	s.lock.Unlock()
+
+	for proto := range s.handlers() {
+		s.host.RemoveStreamHandler(proto)
+	}
+}
+
+// Serve registers protocol handlers and serves until ctx is done, removing
+// expired content of storage periodically. Then it unregisters them, drains
+// in-flight streams for the drain timeout, and flushes changes storage
+// collected in memory.
+func (s *Server) Serve(ctx context.Context) error {
+	s.lock.Lock()
+	if s.ctx.Err() != nil {
+		// cancelled by an earlier shutdown
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	s.lock.Unlock()
+	s.Register()
+	if e, ok := s.storage.(storage.Expirer); ok {
+		go s.expire(ctx, e)
+	}
+	<-ctx.Done()
+
+	dctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	err := s.Shutdown(dctx)
+	if f, ok := s.storage.(storage.Flusher); ok {
+		if ferr := f.Flush(); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// expire removes expired content every expire interval until ctx is done
+func (s *Server) expire(ctx context.Context, e storage.Expirer) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.expireInterval):
+		}
+		if err := e.Expire(ctx); err != nil && ctx.Err() == nil {
+			s.logf("expire got: %v", err)
+		}
+	}
+}
+
+// Shutdown unregisters protocol handlers and waits for in-flight streams to
+// finish. Streams still running when ctx is done are reset, and their storage
+// operations cancelled.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Unregister()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.lock.Lock()
+	s.cancel()
+	for stream := range s.streams {
+		stream.Reset()
+	}
+	s.lock.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+// track counts in-flight streams, and closes them once handled
+func (s *Server) track(next inet.StreamHandler) inet.StreamHandler {
+	return func(stream inet.Stream) {
+		s.lock.Lock()
+		if s.closing {
+			s.lock.Unlock()
+			stream.Reset()
+			return
+		}
+		s.wg.Add(1)
+		s.streams[stream] = struct{}{}
+		s.lock.Unlock()
+
+		defer func() {
+			s.lock.Lock()
+			delete(s.streams, stream)
+			s.lock.Unlock()
+			stream.Close()
+			s.wg.Done()
+		}()
+		next(stream)
+	}
+}
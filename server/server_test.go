@@ -0,0 +1,434 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/client"
+	"github.com/leslie-wang/libp2p-ftp/node"
+	"github.com/leslie-wang/libp2p-ftp/storage"
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	host "github.com/libp2p/go-libp2p-host"
+)
+
+const listenAddr = "/ip4/127.0.0.1/tcp/0"
+
+// newTestServer serves st on a new host, and returns a node connected to it
+func newTestServer(t *testing.T, st storage.Storage) *node.Node {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	h, err := libp2p.New(ctx, libp2p.ListenAddrStrings(listenAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	New(h, WithStorage(st)).Register()
+	return dialTestServer(t, ctx, h)
+}
+
+// dialTestServer returns a node connected to host h
+func dialTestServer(t *testing.T, ctx context.Context, h host.Host) *node.Node {
+	var addr string
+	for _, a := range h.Addrs() {
+		if strings.HasPrefix(a.String(), "/ip4/") {
+			addr = a.String() + "/ipfs/" + h.ID().Pretty()
+		}
+	}
+	n, err := node.StartNode(ctx, "", &types.Config{
+		BootstrapNodes: []string{addr},
+		ListenAddrs:    []string{listenAddr},
+		DatastoreDir:   t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+	if err := n.FindPeer(ctx, h.ID().Pretty()); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func putString(t *testing.T, n *node.Node, name, content string) {
+	if err := n.PutRequest(context.Background(), strings.NewReader(content), int64(len(content)), name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func isRemote(err error) bool {
+	_, ok := err.(*node.RemoteError)
+	return ok
+}
+
+func TestPing(t *testing.T) {
+	n := newTestServer(t, storage.NewMemory())
+	if err := n.PingRequest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	ctx := context.Background()
+	n := newTestServer(t, storage.NewMemory())
+	putString(t, n, "/dir/file with space", "0123456789")
+
+	var buf bytes.Buffer
+	if _, err := n.GetRequest(ctx, "/dir/file with space", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "0123456789" {
+		t.Fatalf("get %q", buf.String())
+	}
+	buf.Reset()
+	if _, err := n.GetRangeRequest(ctx, "/dir/file with space", 4, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "456789" {
+		t.Fatalf("get range %q", buf.String())
+	}
+	if _, err := n.GetRangeRequest(ctx, "/dir/file with space", 11, &buf); !isRemote(err) {
+		t.Fatalf("get beyond end got %v", err)
+	}
+
+	info, err := n.StatRequest(ctx, "/dir/file with space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 10 || info.IsDir {
+		t.Fatalf("stat %+v", info)
+	}
+	names, err := n.ListRequest(ctx, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "file with space" {
+		t.Fatalf("list %v", names)
+	}
+	files, err := n.ListDetailRequest(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "dir" || !files[0].IsDir {
+		t.Fatalf("list detail %+v", files)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	n := newTestServer(t, storage.NewMemory())
+
+	var buf bytes.Buffer
+	if _, err := n.GetRequest(ctx, "/missing", &buf); !isRemote(err) {
+		t.Errorf("get got %v", err)
+	}
+	if _, err := n.StatRequest(ctx, "/missing"); !isRemote(err) {
+		t.Errorf("stat got %v", err)
+	}
+	if _, err := n.ListDetailRequest(ctx, "/missing"); !isRemote(err) {
+		t.Errorf("list got %v", err)
+	}
+	if err := n.DeleteRequest(ctx, "/missing"); !isRemote(err) {
+		t.Errorf("delete got %v", err)
+	}
+	if _, err := n.VersionsRequest(ctx, "/missing"); !isRemote(err) {
+		t.Errorf("versions without versioning got %v", err)
+	}
+	if _, err := n.TrashRequest(ctx, "/"); !isRemote(err) {
+		t.Errorf("trash without trash got %v", err)
+	}
+	if _, err := n.QuotaRequest(ctx); !isRemote(err) {
+		t.Errorf("quota without quota got %v", err)
+	}
+	putString(t, n, "/file", "x")
+	if _, err := n.GetRequest(ctx, "/", &buf); !isRemote(err) {
+		t.Errorf("get of directory got %v", err)
+	}
+	// the server keeps serving after errors
+	if err := n.PingRequest(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutRejected(t *testing.T) {
+	ctx := context.Background()
+	q, err := storage.NewQuota(ctx, storage.NewMemory(), types.Quota{Default: types.Limit{Bytes: 10}}, nil,
+		filepath.Join(t.TempDir(), "quota.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := newTestServer(t, q)
+
+	// far more than the stream window, the server rejects it before
+	// reading any of it
+	size := int64(64 << 20)
+	done := make(chan error, 1)
+	go func() {
+		done <- n.PutRequest(ctx, io.LimitReader(zeros{}, size), size, "/big")
+	}()
+	select {
+	case err := <-done:
+		if client.KindOf(err) != client.ErrQuota {
+			t.Fatalf("put beyond quota got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("rejected put is still sending")
+	}
+	// the server keeps serving after rejecting
+	putString(t, n, "/small", "x")
+}
+
+// zeros reads endless zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestMkdirRenameDelete(t *testing.T) {
+	ctx := context.Background()
+	n := newTestServer(t, storage.NewMemory())
+
+	info, err := n.MkdirRequest(ctx, "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir || info.Name != "b" {
+		t.Fatalf("mkdir %+v", info)
+	}
+	putString(t, n, "/a/b/file", "x")
+	info, err = n.RenameRequest(ctx, "/a/b", "/c d/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir || info.Name != "e" {
+		t.Fatalf("rename %+v", info)
+	}
+	if _, err := n.StatRequest(ctx, "/c d/e/file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.DeleteRequest(ctx, "/c d/e"); !isRemote(err) {
+		t.Fatalf("delete of non-empty directory got %v", err)
+	}
+	if err := n.DeleteRequest(ctx, "/c d/e/file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.StatRequest(ctx, "/c d/e/file"); !isRemote(err) {
+		t.Fatalf("stat of deleted file got %v", err)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	n := newTestServer(t, storage.NewVersioned(storage.NewMemory(), storage.NewMemory(), 0, 0))
+	putString(t, n, "/file", "first")
+	putString(t, n, "/file", "second")
+
+	versions, err := n.VersionsRequest(ctx, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Fatalf("versions %+v", versions)
+	}
+	var buf bytes.Buffer
+	if _, err := n.GetVersionRequest(ctx, "/file", versions[0].Version, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "first" {
+		t.Fatalf("get version %q", buf.String())
+	}
+	info, err := n.RestoreRequest(ctx, "/file", versions[0].Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len("first")) {
+		t.Fatalf("restore %+v", info)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	ctx := context.Background()
+	n := newTestServer(t, storage.NewTrash(storage.NewMemory(), 0))
+	putString(t, n, "/file", "content")
+
+	if err := n.DeleteRequest(ctx, "/file"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := n.TrashRequest(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("trash %+v", entries)
+	}
+	if _, err := n.UndeleteRequest(ctx, "/file", entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.StatRequest(ctx, "/file"); err != nil {
+		t.Fatal(err)
+	}
+	// only configured purgers may remove permanently
+	if err := n.PurgeRequest(ctx, "/file"); !isRemote(err) {
+		t.Fatalf("purge by other peer got %v", err)
+	}
+}
+
+func TestServeExpiresTrash(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h, err := libp2p.New(ctx, libp2p.ListenAddrStrings(listenAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	inner := storage.NewMemory()
+	tr := storage.NewTrash(inner, 50*time.Millisecond)
+	w, err := tr.Create(ctx, "/file", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("x"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Remove(ctx, "/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	go New(h, WithStorage(tr), WithExpireInterval(10*time.Millisecond)).Serve(ctx)
+	// nothing else is removed, the server purges on its own
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		files, err := inner.List(ctx, "/.trash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expired trash is kept: %+v", files)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// blockingStorage blocks Stat until it is released or its context is done
+type blockingStorage struct {
+	storage.Storage
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingStorage() *blockingStorage {
+	return &blockingStorage{Storage: storage.NewMemory(), started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (s *blockingStorage) Stat(ctx context.Context, name string) (*types.FileInfo, error) {
+	close(s.started)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.release:
+		return &types.FileInfo{Name: "file"}, nil
+	}
+}
+
+// serveBlocking serves st until stopped, with a stat request in flight
+func serveBlocking(t *testing.T, ctx context.Context, st *blockingStorage, drainTimeout time.Duration) (stop func(), served, requested chan error) {
+	h, err := libp2p.New(ctx, libp2p.ListenAddrStrings(listenAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+
+	sctx, stop := context.WithCancel(ctx)
+	served, requested = make(chan error, 1), make(chan error, 1)
+	go func() {
+		served <- New(h, WithStorage(st), WithDrainTimeout(drainTimeout)).Serve(sctx)
+	}()
+	n := dialTestServer(t, ctx, h)
+	go func() {
+		_, err := n.StatRequest(ctx, "/file")
+		requested <- err
+	}()
+	<-st.started
+	return stop, served, requested
+}
+
+func TestServeDrainsOperations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	st := newBlockingStorage()
+	stop, served, requested := serveBlocking(t, ctx, st, 10*time.Second)
+
+	// the in-flight operation keeps running after serving stopped, and
+	// finishes within the drain timeout
+	stop()
+	time.Sleep(100 * time.Millisecond)
+	close(st.release)
+	if err := <-requested; err != nil {
+		t.Fatalf("in-flight request got %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeCancelsOperations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	st := newBlockingStorage()
+	stop, served, _ := serveBlocking(t, ctx, st, 100*time.Millisecond)
+
+	stop()
+	start := time.Now()
+	if err := <-served; err != context.DeadlineExceeded {
+		t.Fatalf("serve got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 4*time.Second {
+		t.Fatalf("in-flight operation kept running %v after the drain timeout", d)
+	}
+}
+
+// flushingStorage counts flushes
+type flushingStorage struct {
+	storage.Storage
+	flushes int
+}
+
+func (s *flushingStorage) Flush() error {
+	s.flushes++
+	return nil
+}
+
+func TestServeFlushes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h, err := libp2p.New(ctx, libp2p.ListenAddrStrings(listenAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	st := &flushingStorage{Storage: storage.NewMemory()}
+	sctx, stop := context.WithCancel(ctx)
+	stop()
+	if err := New(h, WithStorage(st)).Serve(sctx); err != nil {
+		t.Fatal(err)
+	}
+	if st.flushes != 1 {
+		t.Fatalf("flushed %d times when serving stopped, want 1", st.flushes)
+	}
+}
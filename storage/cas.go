@@ -0,0 +1,439 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultChunkSize is the size content is split into by CAS
+	DefaultChunkSize = 1 << 20
+	// DefaultGCGrace is how old unreferenced chunks must be before GC
+	// removes them, it has to be longer than the longest upload
+	DefaultGCGrace = 24 * time.Hour
+
+	// ChunkRefreshAge is how old reused chunks may get before uploads
+	// rewrite them, so that GC of other processes leaves them alone. GC
+	// grace must exceed it by the longest upload, or reused chunks may be
+	// removed before the manifest referencing them is written.
+	ChunkRefreshAge = DefaultGCGrace / 2
+
+	casTree   = "/tree"
+	casChunks = "/chunks"
+)
+
+// CAS stores file content split into chunks, which are addressed by their
+// CID so identical chunks are stored once. Files are manifests listing
+// their chunks. Both are kept in inner storage: manifests mirror the file
+// tree under /tree, chunks live under /chunks. Removing files leaves their
+// chunks behind until GC.
+type CAS struct {
+	inner     Storage
+	chunkSize int
+	prefix    cid.Prefix
+}
+
+var _ Storage = (*CAS)(nil)
+
+// manifest is the content of files in tree
+type manifest struct {
+	Size   int64
+	Chunks []chunkRef
+}
+
+type chunkRef struct {
+	CID  string
+	Size int64
+}
+
+// NewCAS creates content addressed storage on top of inner storage
+func NewCAS(inner Storage) *CAS {
+	return &CAS{
+		inner:     inner,
+		chunkSize: DefaultChunkSize,
+		prefix: cid.Prefix{
+			Version:  1,
+			Codec:    cid.Raw,
+			MhType:   mh.SHA2_256,
+			MhLength: -1,
+		},
+	}
+}
+
+// tree returns name of manifest of file
+func (c *CAS) tree(name string) (string, error) {
+	name, err := Clean(name)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(casTree, name), nil
+}
+
+// chunk returns name of chunk, chunks are spread over directories by the
+// end of their CID since the beginning is the same for all of them
+func chunk(id string) string {
+	return path.Join(casChunks, id[len(id)-2:], id)
+}
+
+func (c *CAS) readManifest(ctx context.Context, name string) (*manifest, error) {
+	r, err := c.inner.Open(ctx, name, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	m := &manifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, errors.Wrapf(err, "invalid manifest %s", name)
+	}
+	return m, nil
+}
+
+// Stat returns metadata of one file or directory
+func (c *CAS) Stat(ctx context.Context, name string) (*types.FileInfo, error) {
+	t, err := c.tree(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.inner.Stat(ctx, t)
+	if os.IsNotExist(err) && t == casTree {
+		// nothing is stored yet
+		return &types.FileInfo{Name: "/", Mode: os.ModeDir | 0700, ModTime: time.Now(), IsDir: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t == casTree {
+		info.Name = "/"
+	}
+	if !info.IsDir {
+		m, err := c.readManifest(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+		info.Size = m.Size
+	}
+	return info, nil
+}
+
+// List returns metadata of entries under directory
+func (c *CAS) List(ctx context.Context, dir string) ([]types.FileInfo, error) {
+	t, err := c.tree(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := c.inner.List(ctx, t)
+	if os.IsNotExist(err) && t == casTree {
+		return []types.FileInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range infos {
+		if infos[i].IsDir {
+			continue
+		}
+		m, err := c.readManifest(ctx, path.Join(t, infos[i].Name))
+		if err != nil {
+			return nil, err
+		}
+		infos[i].Size = m.Size
+	}
+	return infos, nil
+}
+
+// Open reads length bytes of file starting at offset
+func (c *CAS) Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	t, err := c.tree(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.inner.Stat(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrNotRegular}
+	}
+	m, err := c.readManifest(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 || offset+length > m.Size {
+		length = m.Size - offset
+	}
+	if length < 0 {
+		length = 0
+	}
+
+	// skip chunks before offset
+	chunks := m.Chunks
+	for len(chunks) > 0 && offset >= chunks[0].Size {
+		offset -= chunks[0].Size
+		chunks = chunks[1:]
+	}
+	return &casReader{ctx: ctx, inner: c.inner, chunks: chunks, offset: offset, remain: length}, nil
+}
+
+// casReader reads chunks one after another
+type casReader struct {
+	ctx    context.Context
+	inner  Storage
+	chunks []chunkRef
+	// offset into the first chunk
+	offset int64
+	remain int64
+	cur    io.ReadCloser
+}
+
+func (r *casReader) Read(p []byte) (int, error) {
+	for r.remain > 0 {
+		if r.cur == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			cur, err := r.inner.Open(r.ctx, chunk(r.chunks[0].CID), r.offset, -1)
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.chunks, r.offset = cur, r.chunks[1:], 0
+		}
+		if int64(len(p)) > r.remain {
+			p = p[:r.remain]
+		}
+		n, err := r.cur.Read(p)
+		r.remain -= int64(n)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+func (r *casReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+// Create splits content into chunks while it is written, and writes the
+// manifest on Close
+func (c *CAS) Create(ctx context.Context, name string, size int64) (Writer, error) {
+	t, err := c.tree(name)
+	if err != nil {
+		return nil, err
+	}
+	if t == casTree {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	if info, err := c.inner.Stat(ctx, t); err == nil && info.IsDir {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	return &casWriter{c: c, ctx: ctx, tree: t}, nil
+}
+
+type casWriter struct {
+	c    *CAS
+	ctx  context.Context
+	tree string
+	buf  bytes.Buffer
+	m    manifest
+}
+
+func (w *casWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := w.c.chunkSize - w.buf.Len()
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf.Write(p[:n])
+		written += n
+		p = p[n:]
+		if w.buf.Len() == w.c.chunkSize {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush stores buffered chunk unless it is stored already
+func (w *casWriter) flush() error {
+	data := w.buf.Bytes()
+	id, err := w.c.prefix.Sum(data)
+	if err != nil {
+		return err
+	}
+	ref := chunkRef{CID: id.String(), Size: int64(len(data))}
+	name := chunk(ref.CID)
+
+	info, err := w.c.inner.Stat(w.ctx, name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err != nil || time.Since(info.ModTime) > ChunkRefreshAge {
+		cw, err := w.c.inner.Create(w.ctx, name, ref.Size)
+		if err != nil {
+			return err
+		}
+		if _, err := cw.Write(data); err != nil {
+			cw.Abort()
+			return err
+		}
+		if err := cw.Close(); err != nil {
+			return err
+		}
+	}
+
+	w.m.Chunks = append(w.m.Chunks, ref)
+	w.m.Size += ref.Size
+	w.buf.Reset()
+	return nil
+}
+
+func (w *casWriter) Close() error {
+	if w.buf.Len() > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(w.m)
+	if err != nil {
+		return err
+	}
+	mw, err := w.c.inner.Create(w.ctx, w.tree, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	if _, err := mw.Write(data); err != nil {
+		mw.Abort()
+		return err
+	}
+	return mw.Close()
+}
+
+// Abort drops the file, chunks already stored are left for GC
+func (w *casWriter) Abort() error {
+	w.buf.Reset()
+	return nil
+}
+
+// Remove removes file or empty directory, its chunks are left for GC
+func (c *CAS) Remove(ctx context.Context, name string) error {
+	t, err := c.tree(name)
+	if err != nil {
+		return err
+	}
+	if t == casTree {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	return c.inner.Remove(ctx, t)
+}
+
+// Rename moves file or directory to newname
+func (c *CAS) Rename(ctx context.Context, oldname, newname string) error {
+	oldtree, err := c.tree(oldname)
+	if err != nil {
+		return err
+	}
+	newtree, err := c.tree(newname)
+	if err != nil {
+		return err
+	}
+	return c.inner.Rename(ctx, oldtree, newtree)
+}
+
+// Mkdir creates directory and its parents
+func (c *CAS) Mkdir(ctx context.Context, name string) error {
+	t, err := c.tree(name)
+	if err != nil {
+		return err
+	}
+	return c.inner.Mkdir(ctx, t)
+}
+
+// GCStats reports what GC reclaimed
+type GCStats struct {
+	Referenced int
+	Removed    int
+	Freed      int64
+}
+
+// GC removes chunks which are not referenced by any file. Chunks younger
+// than grace are kept, since uploads in progress may not have written
+// their manifest yet.
+func (c *CAS) GC(ctx context.Context, grace time.Duration) (*GCStats, error) {
+	refs := map[string]bool{}
+	if err := c.walk(ctx, casTree, func(name string) error {
+		m, err := c.readManifest(ctx, name)
+		if err != nil {
+			return err
+		}
+		for _, ref := range m.Chunks {
+			refs[ref.CID] = true
+		}
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	stats := &GCStats{Referenced: len(refs)}
+	deadline := time.Now().Add(-grace)
+	err := c.walk(ctx, casChunks, func(name string) error {
+		info, err := c.inner.Stat(ctx, name)
+		if err != nil {
+			return err
+		}
+		if refs[info.Name] || info.ModTime.After(deadline) {
+			return nil
+		}
+		if err := c.inner.Remove(ctx, name); err != nil {
+			return err
+		}
+		stats.Removed++
+		stats.Freed += info.Size
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// walk calls f for each file under dir of inner storage
+func (c *CAS) walk(ctx context.Context, dir string, f func(name string) error) error {
+	infos, err := c.inner.List(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := path.Join(dir, info.Name)
+		if info.IsDir {
+			err = c.walk(ctx, name, f)
+		} else {
+			err = f(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newTestCAS creates CAS splitting content into 4 byte chunks
+func newTestCAS(inner Storage) *CAS {
+	c := NewCAS(inner)
+	c.chunkSize = 4
+	return c
+}
+
+func countChunks(t *testing.T, ctx context.Context, c *CAS) int {
+	n := 0
+	if err := c.walk(ctx, casChunks, func(string) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestCASDedup(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCAS(NewMemory())
+	write(t, ctx, c, "/a", "aaaabbbb")
+	write(t, ctx, c, "/b", "aaaacccc")
+	if n := countChunks(t, ctx, c); n != 3 {
+		t.Fatalf("%d chunks stored, want 3", n)
+	}
+
+	if err := c.Remove(ctx, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := c.GC(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Referenced != 2 || stats.Removed != 1 || stats.Freed != 4 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if got := read(t, ctx, c, "/b", 0, -1); got != "aaaacccc" {
+		t.Fatalf("read %q after GC", got)
+	}
+}
+
+func TestCASGCGrace(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCAS(NewMemory())
+	write(t, ctx, c, "/a", "aaaabbbb")
+	if err := c.Remove(ctx, "/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := c.GC(ctx, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 0 || countChunks(t, ctx, c) != 2 {
+		t.Fatal("chunks within grace period are removed")
+	}
+	if stats, err = c.GC(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 2 || countChunks(t, ctx, c) != 0 {
+		t.Fatalf("unreferenced chunks are kept, stats %+v", stats)
+	}
+}
+
+func TestCASReusesChunks(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCAS(NewMemory())
+	write(t, ctx, c, "/a", "aaaa")
+	modTimes := func() []time.Time {
+		var times []time.Time
+		if err := c.walk(ctx, casChunks, func(name string) error {
+			info, err := c.inner.Stat(ctx, name)
+			if err == nil {
+				times = append(times, info.ModTime)
+			}
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return times
+	}
+	before := modTimes()
+
+	// chunks younger than the refresh age are not written again
+	time.Sleep(10 * time.Millisecond)
+	write(t, ctx, c, "/b", "aaaa")
+	if after := modTimes(); len(after) != 1 || !after[0].Equal(before[0]) {
+		t.Fatalf("reused chunk is rewritten, modified %v, then %v", before, after)
+	}
+}
+
+func TestCASTempFiles(t *testing.T) {
+	ctx := context.Background()
+	inner := NewLocal(t.TempDir())
+	c := newTestCAS(inner)
+	write(t, ctx, c, "/dir/a", "aaaa")
+
+	// unfinished writes of manifest and chunk
+	for _, name := range []string{"/tree/dir/b", "/chunks/xx/b"} {
+		w, err := inner.Create(ctx, name, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Abort()
+		if _, err := w.Write([]byte("{")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	infos, err := c.List(ctx, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name != "a" {
+		t.Fatalf("list %v, want only a", infos)
+	}
+	stats, err := c.GC(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Referenced != 1 || stats.Removed != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,17 @@
+package storage
+
+import "context"
+
+type peerKey struct{}
+
+// WithPeer returns context of operations on behalf of remote peer
+func WithPeer(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, peerKey{}, id)
+}
+
+// Peer returns the remote peer operations are done for, or empty string if
+// they are done locally
+func Peer(ctx context.Context) string {
+	id, _ := ctx.Value(peerKey{}).(string)
+	return id
+}
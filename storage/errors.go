@@ -0,0 +1,22 @@
+package storage
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotAbsolute is returned for relative paths
+var ErrNotAbsolute = errors.New("please use absolute path")
+
+// ErrNotRegular is returned when reading something other than a file
+var ErrNotRegular = errors.New("remote path is not regular file")
+
+// errors matching the ones of local filesystem, so that they are reported
+// the same way by every backend
+var (
+	errNotDir   error = syscall.ENOTDIR
+	errIsDir    error = syscall.EISDIR
+	errNotEmpty error = syscall.ENOTEMPTY
+	errQuota    error = syscall.EDQUOT
+)
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+// Local stores files on local disk under root directory
+type Local struct {
+	root string
+}
+
+var _ Storage = (*Local)(nil)
+
+// NewLocal creates local disk storage, names are resolved under root. Root
+// "/" serves the whole filesystem.
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+// path converts storage name into local filesystem path
+func (l *Local) path(name string) (string, error) {
+	name, err := Clean(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.root, filepath.FromSlash(name)), nil
+}
+
+// Stat returns metadata of one file or directory
+func (l *Local) Stat(ctx context.Context, name string) (*types.FileInfo, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo(info), nil
+}
+
+// List returns metadata of entries under directory
+func (l *Local) List(ctx context.Context, dir string) ([]types.FileInfo, error) {
+	p, err := l.path(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]types.FileInfo, 0, len(files))
+	for _, file := range files {
+		if isTemp(file.Name()) {
+			continue
+		}
+		infos = append(infos, *fileInfo(file))
+	}
+	return infos, nil
+}
+
+// Open reads length bytes of file starting at offset
+func (l *Local) Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrNotRegular}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+// Create writes into a temporary file next to the target, and renames it
+// into place on Close
+func (l *Local) Create(ctx context.Context, name string, size int64) (Writer, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".*"+tempSuffix)
+	if err != nil {
+		return nil, err
+	}
+	// temporary files are private, created files get the usual permissions
+	if err := f.Chmod(0666 &^ umask); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &localWriter{File: f, target: p}, nil
+}
+
+// tempSuffix ends names of temporary files written by Create, which are left
+// out of listings
+const tempSuffix = ".partial"
+
+func isTemp(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempSuffix)
+}
+
+// Remove removes file or empty directory
+func (l *Local) Remove(ctx context.Context, name string) error {
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// Rename moves file or directory to newname
+func (l *Local) Rename(ctx context.Context, oldname, newname string) error {
+	oldpath, err := l.path(oldname)
+	if err != nil {
+		return err
+	}
+	newpath, err := l.path(newname)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(newpath), 0700); err != nil {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+// Mkdir creates directory and its parents
+func (l *Local) Mkdir(ctx context.Context, name string) error {
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, 0700)
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type localWriter struct {
+	*os.File
+	target string
+}
+
+func (w *localWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	if err := os.Rename(w.File.Name(), w.target); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *localWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
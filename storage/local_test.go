@@ -0,0 +1,22 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalCreateMode(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	write(t, ctx, NewLocal(root), "/a", "a")
+
+	info, err := os.Stat(filepath.Join(root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0666&^umask {
+		t.Fatalf("file mode %v, want %v", mode, 0666&^umask)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// umask is the file mode creation mask of the process. It is read once,
+// since setting it is the only way to read it.
+var umask = func() os.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return os.FileMode(mask)
+}()
@@ -0,0 +1,6 @@
+package storage
+
+import "os"
+
+// umask is always empty on Windows, which has no file mode creation mask
+var umask os.FileMode
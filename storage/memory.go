@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+// Memory keeps files in memory, it is meant for tests
+type Memory struct {
+	lock  sync.RWMutex
+	files map[string]*memFile
+}
+
+var _ Storage = (*Memory)(nil)
+
+type memFile struct {
+	data    []byte
+	dir     bool
+	modTime time.Time
+}
+
+// NewMemory creates empty in-memory storage
+func NewMemory() *Memory {
+	return &Memory{files: map[string]*memFile{
+		"/": {dir: true, modTime: time.Now()},
+	}}
+}
+
+func (m *Memory) info(name string, f *memFile) *types.FileInfo {
+	info := &types.FileInfo{
+		Name:    path.Base(name),
+		Size:    int64(len(f.data)),
+		Mode:    0600,
+		ModTime: f.modTime,
+		IsDir:   f.dir,
+	}
+	if f.dir {
+		info.Mode = os.ModeDir | 0700
+	}
+	return info
+}
+
+// Stat returns metadata of one file or directory
+func (m *Memory) Stat(ctx context.Context, name string) (*types.FileInfo, error) {
+	name, err := Clean(name)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	f, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return m.info(name, f), nil
+}
+
+// List returns metadata of entries under directory
+func (m *Memory) List(ctx context.Context, dir string) ([]types.FileInfo, error) {
+	dir, err := Clean(dir)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	f, ok := m.files[dir]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	if !f.dir {
+		return nil, &os.PathError{Op: "readdirent", Path: dir, Err: errNotDir}
+	}
+	infos := []types.FileInfo{}
+	for name, f := range m.files {
+		if name != dir && path.Dir(name) == dir {
+			infos = append(infos, *m.info(name, f))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// Open reads length bytes of file starting at offset
+func (m *Memory) Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	name, err := Clean(name)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	f, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if f.dir {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrNotRegular}
+	}
+	data := f.data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Create creates or truncates file, and its parent directories
+func (m *Memory) Create(ctx context.Context, name string, size int64) (Writer, error) {
+	name, err := Clean(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Mkdir(ctx, path.Dir(name)); err != nil {
+		return nil, err
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if f, ok := m.files[name]; ok && f.dir {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	return &memWriter{m: m, name: name}, nil
+}
+
+// Remove removes file or empty directory
+func (m *Memory) Remove(ctx context.Context, name string) error {
+	name, err := Clean(name)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	f, ok := m.files[name]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if f.dir {
+		for other := range m.files {
+			if other != name && path.Dir(other) == name {
+				return &os.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+			}
+		}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+// Rename moves file or directory to newname
+func (m *Memory) Rename(ctx context.Context, oldname, newname string) error {
+	oldname, err := Clean(oldname)
+	if err != nil {
+		return err
+	}
+	newname, err = Clean(newname)
+	if err != nil {
+		return err
+	}
+	if err := m.Mkdir(ctx, path.Dir(newname)); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.files[oldname]; !ok {
+		return &os.PathError{Op: "rename", Path: oldname, Err: os.ErrNotExist}
+	}
+	moved := map[string]*memFile{}
+	for name, f := range m.files {
+		if name == oldname || strings.HasPrefix(name, oldname+"/") {
+			moved[newname+strings.TrimPrefix(name, oldname)] = f
+			delete(m.files, name)
+		}
+	}
+	for name, f := range moved {
+		m.files[name] = f
+	}
+	return nil
+}
+
+// Mkdir creates directory and its parents
+func (m *Memory) Mkdir(ctx context.Context, name string) error {
+	name, err := Clean(name)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for p := name; ; p = path.Dir(p) {
+		if f, ok := m.files[p]; ok {
+			if !f.dir {
+				return &os.PathError{Op: "mkdir", Path: p, Err: errNotDir}
+			}
+		} else {
+			m.files[p] = &memFile{dir: true, modTime: time.Now()}
+		}
+		if p == "/" {
+			return nil
+		}
+	}
+}
+
+type memWriter struct {
+	bytes.Buffer
+	m    *Memory
+	name string
+}
+
+func (w *memWriter) Close() error {
+	w.m.lock.Lock()
+	defer w.m.lock.Unlock()
+	w.m.files[w.name] = &memFile{data: w.Bytes(), modTime: time.Now()}
+	return nil
+}
+
+func (w *memWriter) Abort() error {
+	w.Reset()
+	return nil
+}
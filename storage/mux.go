@@ -0,0 +1,409 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/errors"
+)
+
+// errCrossShare is returned when renaming between shares
+var errCrossShare error = syscall.EXDEV
+
+// Mux mounts several storages at remote directories. Names are routed to
+// the storage with the longest matching mount point, which sees them
+// relative to its mount point.
+type Mux struct {
+	mounts []mount
+}
+
+var (
+	_ Storage = (*Mux)(nil)
+	_ Trasher = (*Mux)(nil)
+	_ Expirer = (*Mux)(nil)
+)
+
+type mount struct {
+	dir     string
+	storage Storage
+}
+
+// NewMux creates empty mux, storages are added with Mount
+func NewMux() *Mux {
+	return &Mux{}
+}
+
+// Mount mounts storage at dir, replacing storage already mounted there
+func (m *Mux) Mount(dir string, s Storage) error {
+	dir, err := Clean(dir)
+	if err != nil {
+		return err
+	}
+	for i := range m.mounts {
+		if m.mounts[i].dir == dir {
+			m.mounts[i].storage = s
+			return nil
+		}
+	}
+	m.mounts = append(m.mounts, mount{dir: dir, storage: s})
+	// longest mount point first
+	sort.Slice(m.mounts, func(i, j int) bool { return len(m.mounts[i].dir) > len(m.mounts[j].dir) })
+	return nil
+}
+
+// route returns storage serving name, and name relative to its mount point
+func (m *Mux) route(name string) (Storage, string, error) {
+	name, err := Clean(name)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, mnt := range m.mounts {
+		if mnt.dir == "/" {
+			return mnt.storage, name, nil
+		}
+		if name == mnt.dir {
+			return mnt.storage, "/", nil
+		}
+		if strings.HasPrefix(name, mnt.dir+"/") {
+			return mnt.storage, strings.TrimPrefix(name, mnt.dir), nil
+		}
+	}
+	return nil, name, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
+
+// children returns names of mount points directly under dir
+func (m *Mux) children(dir string) []string {
+	names := []string{}
+	for _, mnt := range m.mounts {
+		if mnt.dir != dir && mnt.dir != "/" && path.Dir(mnt.dir) == dir {
+			names = append(names, path.Base(mnt.dir))
+		}
+	}
+	return names
+}
+
+// virtualDir reports whether dir only exists as parent of mount points
+func (m *Mux) virtualDir(dir string) bool {
+	for _, mnt := range m.mounts {
+		if dir == "/" || strings.HasPrefix(mnt.dir, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Stat returns metadata of one file or directory
+func (m *Mux) Stat(ctx context.Context, name string) (*types.FileInfo, error) {
+	s, rel, err := m.route(name)
+	if err != nil {
+		if os.IsNotExist(err) && m.virtualDir(rel) {
+			return &types.FileInfo{Name: path.Base(rel), Mode: os.ModeDir | 0500, ModTime: time.Now(), IsDir: true}, nil
+		}
+		return nil, err
+	}
+	info, err := s.Stat(ctx, rel)
+	if err != nil {
+		return nil, err
+	}
+	// mount points are named after the remote directory
+	if rel == "/" {
+		clean, _ := Clean(name)
+		info.Name = path.Base(clean)
+	}
+	return info, nil
+}
+
+// List returns metadata of entries under directory, including mount points
+func (m *Mux) List(ctx context.Context, dir string) ([]types.FileInfo, error) {
+	s, rel, err := m.route(dir)
+	if err != nil && !(os.IsNotExist(err) && m.virtualDir(rel)) {
+		return nil, err
+	}
+	infos := []types.FileInfo{}
+	if s != nil {
+		if infos, err = s.List(ctx, rel); err != nil {
+			return nil, err
+		}
+	} else {
+		dir = rel
+	}
+	if dir, err = Clean(dir); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, info := range infos {
+		seen[info.Name] = true
+	}
+	for _, name := range m.children(dir) {
+		if seen[name] {
+			continue
+		}
+		info, err := m.Stat(ctx, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, *info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// Open reads length bytes of file starting at offset
+func (m *Mux) Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	s, rel, err := m.route(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.Open(ctx, rel, offset, length)
+}
+
+// Create creates or truncates file, and its parent directories
+func (m *Mux) Create(ctx context.Context, name string, size int64) (Writer, error) {
+	s, rel, err := m.route(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.Create(ctx, rel, size)
+}
+
+// Remove removes file or empty directory, mount points cannot be removed
+func (m *Mux) Remove(ctx context.Context, name string) error {
+	s, rel, err := m.route(name)
+	if err != nil {
+		return err
+	}
+	if rel == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	return s.Remove(ctx, rel)
+}
+
+// Rename moves file or directory to newname within one share
+func (m *Mux) Rename(ctx context.Context, oldname, newname string) error {
+	olds, oldrel, err := m.route(oldname)
+	if err != nil {
+		return err
+	}
+	news, newrel, err := m.route(newname)
+	if err != nil {
+		return err
+	}
+	if olds != news {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errCrossShare}
+	}
+	return olds.Rename(ctx, oldrel, newrel)
+}
+
+// Mkdir creates directory and its parents
+func (m *Mux) Mkdir(ctx context.Context, name string) error {
+	s, rel, err := m.route(name)
+	if err != nil {
+		return err
+	}
+	return s.Mkdir(ctx, rel)
+}
+
+// SetKeeper tells keeper about content kept by shares, with names as seen
+// through the mux
+func (m *Mux) SetKeeper(k Keeper) {
+	for _, mnt := range m.mounts {
+		if ks, ok := mnt.storage.(keeperSetter); ok {
+			ks.SetKeeper(&mountKeeper{Keeper: k, dir: mnt.dir})
+		}
+	}
+}
+
+// mountKeeper prefixes names of a share with its mount point
+type mountKeeper struct {
+	Keeper
+	dir string
+}
+
+func (k *mountKeeper) Keep(ctx context.Context, key, name string, size int64) error {
+	return k.Keeper.Keep(ctx, key, path.Join(k.dir, name), size)
+}
+
+// Trash returns entries removed from under dir from every share with trash
+func (m *Mux) Trash(ctx context.Context, dir string) ([]types.TrashEntry, error) {
+	dir, err := Clean(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := []types.TrashEntry{}
+	found := false
+	for _, mnt := range m.mounts {
+		t, ok := mnt.storage.(Trasher)
+		if !ok {
+			continue
+		}
+		var rel string
+		switch {
+		case mnt.dir == "/":
+			rel = dir
+		case dir == mnt.dir || strings.HasPrefix(dir, mnt.dir+"/"):
+			rel = "/" + strings.TrimPrefix(strings.TrimPrefix(dir, mnt.dir), "/")
+		case dir == "/" || strings.HasPrefix(mnt.dir, dir+"/"):
+			rel = "/"
+		default:
+			continue
+		}
+		found = true
+		shared, err := t.Trash(ctx, rel)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range shared {
+			entry.Path = path.Join(mnt.dir, entry.Path)
+			entries = append(entries, entry)
+		}
+	}
+	if !found {
+		return nil, ErrNoTrash
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DeletedAt.After(entries[j].DeletedAt) })
+	return entries, nil
+}
+
+// Expire removes expired content of every share
+func (m *Mux) Expire(ctx context.Context) error {
+	for _, mnt := range m.mounts {
+		if e, ok := mnt.storage.(Expirer); ok {
+			if err := e.Expire(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// trasher returns share of name if it has trash
+func (m *Mux) trasher(name string) (Trasher, string, error) {
+	s, rel, err := m.route(name)
+	if err != nil {
+		return nil, "", err
+	}
+	t, ok := s.(Trasher)
+	if !ok {
+		return nil, "", ErrNoTrash
+	}
+	return t, rel, nil
+}
+
+// Undelete moves entry back to the path it was removed from
+func (m *Mux) Undelete(ctx context.Context, name, id string) (*types.FileInfo, error) {
+	t, rel, err := m.trasher(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.Undelete(ctx, rel, id)
+}
+
+// Purge removes file or directory permanently
+func (m *Mux) Purge(ctx context.Context, name string) error {
+	t, rel, err := m.trasher(name)
+	if err != nil {
+		return err
+	}
+	return t.Purge(ctx, rel)
+}
+
+// New creates storage of one share
+func New(share types.Share) (Storage, error) {
+	s, err := NewBackend(share)
+	if err != nil {
+		return nil, err
+	}
+	if share.ContentAddressed {
+		s = NewCAS(s)
+	}
+	if share.Trash != nil {
+		s = NewTrash(s, share.Trash.Retention, share.Trash.PurgePeers...)
+	}
+	return s, nil
+}
+
+// NewBackend creates backend of one share, without the layers configured on
+// top of it
+func NewBackend(share types.Share) (Storage, error) {
+	switch share.Backend {
+	case "", types.BackendLocal:
+		if share.Root == "" {
+			return nil, errors.Errorf("share %s: root is not configured", share.Path)
+		}
+		return NewLocal(share.Root), nil
+	case types.BackendS3:
+		if share.S3 == nil {
+			return nil, errors.Errorf("share %s: s3 is not configured", share.Path)
+		}
+		return NewS3(*share.S3)
+	}
+	return nil, errors.Errorf("share %s: unknown backend %s", share.Path, share.Backend)
+}
+
+// FromConfig creates storage of configured shares, or of the whole local
+// filesystem if there is no share, with versioning and quotas if configured
+func FromConfig(ctx context.Context, conf *types.Config) (Storage, error) {
+	s, err := fromShares(conf.Shares)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Versioning != nil {
+		if conf.Versioning.Dir == "" {
+			return nil, errors.New("versioning: dir is not configured")
+		}
+		s = NewVersioned(s, NewLocal(conf.Versioning.Dir), conf.Versioning.Keep, conf.Versioning.MaxAge)
+	}
+
+	limits := map[string]types.Limit{}
+	for _, share := range conf.Shares {
+		if share.Quota != nil {
+			dir, err := Clean(share.Path)
+			if err != nil {
+				return nil, err
+			}
+			limits[dir] = *share.Quota
+		}
+	}
+	if conf.Quota == nil && len(limits) == 0 {
+		return s, nil
+	}
+	quota := types.Quota{}
+	if conf.Quota != nil {
+		quota = *conf.Quota
+	}
+	ledger := quota.Ledger
+	if ledger == "" {
+		if conf.DatastoreDir == "" {
+			return nil, errors.New("quota: neither ledger nor datastore dir is configured")
+		}
+		ledger = filepath.Join(conf.DatastoreDir, "quota.json")
+	}
+	return NewQuota(ctx, s, quota, limits, ledger)
+}
+
+func fromShares(shares []types.Share) (Storage, error) {
+	if len(shares) == 0 {
+		return NewLocal("/"), nil
+	}
+	mux := NewMux()
+	for _, share := range shares {
+		s, err := New(share)
+		if err != nil {
+			return nil, err
+		}
+		if err := mux.Mount(share.Path, s); err != nil {
+			return nil, err
+		}
+	}
+	return mux, nil
+}
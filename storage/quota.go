@@ -0,0 +1,693 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+// ledgerSaveDelay is how long changes of the ledger are collected before it
+// is written
+const ledgerSaveDelay = 10 * time.Second
+
+// QuotaReporter is implemented by storages enforcing quotas
+type QuotaReporter interface {
+	// Quota returns usage and limits of the peer of ctx, and of shares
+	Quota(ctx context.Context) (*types.QuotaStatus, error)
+}
+
+// Keeper is told about content which trash or versioning keep after it was
+// removed or replaced, so that it is counted until it is released
+type Keeper interface {
+	// Keep counts size bytes kept under key for the peer of ctx, name is
+	// the path the content was removed from
+	Keep(ctx context.Context, key, name string, size int64) error
+	// Release stops counting bytes kept under key
+	Release(ctx context.Context, key string) error
+}
+
+// Flusher is implemented by storages collecting changes of their state in
+// memory, Flush writes them out and is called by the server when it stops
+type Flusher interface {
+	Flush() error
+}
+
+// keeperSetter is implemented by storages keeping removed content, or
+// containing such storages
+type keeperSetter interface {
+	SetKeeper(k Keeper)
+}
+
+// Quota limits bytes and files stored by each peer and under each share.
+// Usage is tracked in a ledger of files with their size and the peer which
+// uploaded them. Files which existed before the ledger are counted for
+// their share, but not for any peer. Content kept in trash or as previous
+// version counts in bytes for the peer which removed or replaced it, until
+// it is purged, expires or is pruned. Changes are collected for a while
+// before the ledger is written, Flush writes them right away.
+type Quota struct {
+	inner  Storage
+	conf   types.Quota
+	shares map[string]types.Limit
+	ledger string
+	// archives tells whether inner storage keeps replaced content as
+	// previous version
+	archives bool
+
+	lock    sync.Mutex
+	files   map[string]ledgerEntry
+	writers map[*quotaWriter]bool
+	// dirty tells if files changed since the ledger was written, timer
+	// writes it after ledgerSaveDelay
+	dirty bool
+	timer *time.Timer
+}
+
+var (
+	_ Storage       = (*Quota)(nil)
+	_ QuotaReporter = (*Quota)(nil)
+	_ Versioner     = (*Quota)(nil)
+	_ Trasher       = (*Quota)(nil)
+	_ Expirer       = (*Quota)(nil)
+	_ Flusher       = (*Quota)(nil)
+)
+
+// ledgerEntry is keyed by path of file, or by key of kept content, which
+// has the path it was removed from
+type ledgerEntry struct {
+	Peer string `json:",omitempty"`
+	Size int64
+	Path string `json:",omitempty"`
+}
+
+// kept tells whether ledger key names kept content rather than a file
+func kept(key string) bool {
+	return !strings.HasPrefix(key, "/")
+}
+
+// NewQuota creates storage enforcing quotas of conf on peers, and limits of
+// shares mapped by their path. The ledger is seeded from shares if it does
+// not exist yet.
+func NewQuota(ctx context.Context, inner Storage, conf types.Quota, shares map[string]types.Limit, ledger string) (*Quota, error) {
+	q := &Quota{
+		inner:   inner,
+		conf:    conf,
+		shares:  shares,
+		ledger:  ledger,
+		files:   map[string]ledgerEntry{},
+		writers: map[*quotaWriter]bool{},
+	}
+	_, q.archives = inner.(Versioner)
+	if ks, ok := inner.(keeperSetter); ok {
+		ks.SetKeeper(q)
+	}
+	data, err := ioutil.ReadFile(ledger)
+	if err == nil {
+		return q, json.Unmarshal(data, &q.files)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for dir := range shares {
+		if err := q.seed(ctx, dir); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return q, q.save()
+}
+
+// seed adds files under dir to the ledger
+func (q *Quota) seed(ctx context.Context, dir string) error {
+	infos, err := q.inner.List(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := strings.TrimSuffix(dir, "/") + "/" + info.Name
+		if info.IsDir {
+			if err := q.seed(ctx, name); err != nil {
+				return err
+			}
+			continue
+		}
+		q.files[name] = ledgerEntry{Size: info.Size}
+	}
+	return nil
+}
+
+// save writes the ledger, lock must be held or q not shared yet
+func (q *Quota) save() error {
+	data, err := json.Marshal(q.files)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(q.ledger), 0700); err != nil {
+		return err
+	}
+	// quotas sharing a directory must not write the same temporary file
+	tmp, err := ioutil.TempFile(filepath.Dir(q.ledger), filepath.Base(q.ledger)+".")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), q.ledger)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// changed marks the ledger dirty, and schedules writing it. Lock must be
+// held.
+func (q *Quota) changed() {
+	q.dirty = true
+	if q.timer == nil {
+		q.timer = time.AfterFunc(ledgerSaveDelay, q.saveLater)
+	}
+}
+
+// saveLater writes the ledger if it is dirty, and retries later if it fails
+func (q *Quota) saveLater() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.timer = nil
+	if !q.dirty {
+		return
+	}
+	if err := q.save(); err != nil {
+		q.timer = time.AfterFunc(ledgerSaveDelay, q.saveLater)
+		return
+	}
+	q.dirty = false
+}
+
+// Flush writes the ledger now if it changed
+func (q *Quota) Flush() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.dirty {
+		return nil
+	}
+	if err := q.save(); err != nil {
+		return err
+	}
+	q.dirty = false
+	return nil
+}
+
+// peerLimit returns limit of peer, local operations are not limited
+func (q *Quota) peerLimit(peer string) types.Limit {
+	if peer == "" {
+		return types.Limit{}
+	}
+	if limit, ok := q.conf.Peers[peer]; ok {
+		return limit
+	}
+	return q.conf.Default
+}
+
+// share returns path of the share name belongs to, empty if none
+func (q *Quota) share(name string) string {
+	share := ""
+	for dir := range q.shares {
+		if (dir == "/" || name == dir || strings.HasPrefix(name, dir+"/")) && len(dir) > len(share) {
+			share = dir
+		}
+	}
+	return share
+}
+
+func under(name, dir string) bool {
+	return dir == "/" || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// usage sums files matching f and in-flight uploads of writers matching f,
+// kept content only counts in bytes. Lock must be held.
+func (q *Quota) usage(f func(name, peer string) bool) types.Limit {
+	used := types.Limit{}
+	for name, entry := range q.files {
+		if kept(name) {
+			if f(entry.Path, entry.Peer) {
+				used.Bytes += entry.Size
+			}
+			continue
+		}
+		if f(name, entry.Peer) {
+			used.Bytes += entry.Size
+			used.Files++
+		}
+	}
+	for w := range q.writers {
+		if f(w.name, w.peer) {
+			used.Bytes += w.reserved()
+		}
+	}
+	return used
+}
+
+// allowance returns how many bytes may still be written into name by peer,
+// -1 if unlimited, and error if no more files or bytes are allowed. Lock
+// must be held.
+func (q *Quota) allowance(name, peer string, size int64) (int64, error) {
+	old, replaced := q.files[name]
+	allowance := int64(-1)
+	check := func(limit types.Limit, f func(name, peer string) bool) error {
+		if limit.Bytes == 0 && limit.Files == 0 {
+			return nil
+		}
+		used := q.usage(f)
+		if replaced && f(name, old.Peer) {
+			used.Bytes -= old.Size
+			used.Files--
+		}
+		// replaced content is kept as version of the writing peer
+		if replaced && q.archives && f(name, peer) {
+			used.Bytes += old.Size
+		}
+		if limit.Files > 0 && used.Files+1 > limit.Files {
+			return &os.PathError{Op: "open", Path: name, Err: errQuota}
+		}
+		if limit.Bytes == 0 {
+			return nil
+		}
+		left := limit.Bytes - used.Bytes
+		if left < 0 || (size >= 0 && size > left) {
+			return &os.PathError{Op: "open", Path: name, Err: errQuota}
+		}
+		if allowance < 0 || left < allowance {
+			allowance = left
+		}
+		return nil
+	}
+
+	if err := check(q.peerLimit(peer), func(_, p string) bool { return p == peer }); err != nil {
+		return 0, err
+	}
+	if share := q.share(name); share != "" {
+		if err := check(q.shares[share], func(n, _ string) bool { return under(n, share) }); err != nil {
+			return 0, err
+		}
+	}
+	return allowance, nil
+}
+
+// Stat returns metadata of one file or directory
+func (q *Quota) Stat(ctx context.Context, name string) (*types.FileInfo, error) {
+	return q.inner.Stat(ctx, name)
+}
+
+// List returns metadata of entries under directory
+func (q *Quota) List(ctx context.Context, dir string) ([]types.FileInfo, error) {
+	return q.inner.List(ctx, dir)
+}
+
+// Open reads length bytes of file starting at offset
+func (q *Quota) Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	return q.inner.Open(ctx, name, offset, length)
+}
+
+// Create checks declared size against quotas before creating file, and
+// fails writes beyond them
+func (q *Quota) Create(ctx context.Context, name string, size int64) (Writer, error) {
+	name, err := Clean(name)
+	if err != nil {
+		return nil, err
+	}
+	peer := Peer(ctx)
+
+	q.lock.Lock()
+	allowance, err := q.allowance(name, peer, size)
+	if err != nil {
+		q.lock.Unlock()
+		return nil, err
+	}
+	w := &quotaWriter{q: q, name: name, peer: peer, size: size, allowance: allowance}
+	q.writers[w] = true
+	q.lock.Unlock()
+
+	w.Writer, err = q.inner.Create(ctx, name, size)
+	if err != nil {
+		w.done()
+		return nil, err
+	}
+	return w, nil
+}
+
+type quotaWriter struct {
+	Writer
+	q         *Quota
+	name      string
+	peer      string
+	size      int64
+	allowance int64
+	// written is only accessed with lock of q held
+	written int64
+}
+
+// reserved returns bytes counted for upload in progress, lock must be held
+func (w *quotaWriter) reserved() int64 {
+	if w.size > w.written {
+		return w.size
+	}
+	return w.written
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	w.q.lock.Lock()
+	if w.allowance >= 0 && w.written+int64(len(p)) > w.allowance {
+		w.q.lock.Unlock()
+		return 0, &os.PathError{Op: "write", Path: w.name, Err: errQuota}
+	}
+	w.written += int64(len(p))
+	w.q.lock.Unlock()
+	return w.Writer.Write(p)
+}
+
+func (w *quotaWriter) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		w.done()
+		return err
+	}
+	w.q.lock.Lock()
+	defer w.q.lock.Unlock()
+	delete(w.q.writers, w)
+	w.q.files[w.name] = ledgerEntry{Peer: w.peer, Size: w.written}
+	w.q.changed()
+	return nil
+}
+
+func (w *quotaWriter) Abort() error {
+	defer w.done()
+	return w.Writer.Abort()
+}
+
+// done drops reservation of upload
+func (w *quotaWriter) done() {
+	w.q.lock.Lock()
+	defer w.q.lock.Unlock()
+	delete(w.q.writers, w)
+}
+
+// forget drops ledger entries of name and everything under it
+func (q *Quota) forget(name string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for file := range q.files {
+		if !kept(file) && under(file, name) {
+			delete(q.files, file)
+		}
+	}
+	q.changed()
+	return nil
+}
+
+// Keep counts content kept under key for the peer of ctx
+func (q *Quota) Keep(ctx context.Context, key, name string, size int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.files[key] = ledgerEntry{Peer: Peer(ctx), Size: size, Path: name}
+	q.changed()
+	return nil
+}
+
+// Release stops counting content kept under key
+func (q *Quota) Release(ctx context.Context, key string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.files[key]; !ok {
+		return nil
+	}
+	delete(q.files, key)
+	q.changed()
+	return nil
+}
+
+// admit checks that peer of ctx may store size bytes into name
+func (q *Quota) admit(ctx context.Context, name string, size int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	_, err := q.allowance(name, Peer(ctx), size)
+	return err
+}
+
+// record sets ledger entries of file or directory tree from their current
+// size, keeping owners if known
+func (q *Quota) record(ctx context.Context, name string) error {
+	name, err := Clean(name)
+	if err != nil {
+		return err
+	}
+	info, err := q.inner.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		infos, err := q.inner.List(ctx, name)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if err := q.record(ctx, strings.TrimSuffix(name, "/")+"/"+info.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	entry, ok := q.files[name]
+	if !ok {
+		entry.Peer = Peer(ctx)
+	}
+	entry.Size = info.Size
+	q.files[name] = entry
+	q.changed()
+	return nil
+}
+
+// Remove removes file or empty directory, and frees its usage unless trash
+// or versioning keep it
+func (q *Quota) Remove(ctx context.Context, name string) error {
+	name, err := Clean(name)
+	if err != nil {
+		return err
+	}
+	if err := q.inner.Remove(ctx, name); err != nil {
+		return err
+	}
+	return q.forget(name)
+}
+
+// Rename moves file or directory to newname, usage moves along
+func (q *Quota) Rename(ctx context.Context, oldname, newname string) error {
+	oldname, err := Clean(oldname)
+	if err != nil {
+		return err
+	}
+	newname, err = Clean(newname)
+	if err != nil {
+		return err
+	}
+	if err := q.inner.Rename(ctx, oldname, newname); err != nil {
+		return err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	moved := map[string]ledgerEntry{}
+	for file, entry := range q.files {
+		if kept(file) {
+			continue
+		}
+		if under(file, newname) {
+			// replaced by the move
+			delete(q.files, file)
+		}
+		if under(file, oldname) {
+			moved[newname+strings.TrimPrefix(file, oldname)] = entry
+			delete(q.files, file)
+		}
+	}
+	for file, entry := range moved {
+		q.files[file] = entry
+	}
+	q.changed()
+	return nil
+}
+
+// Mkdir creates directory and its parents
+func (q *Quota) Mkdir(ctx context.Context, name string) error {
+	return q.inner.Mkdir(ctx, name)
+}
+
+// Quota returns usage and limits of the peer of ctx, and of shares
+func (q *Quota) Quota(ctx context.Context) (*types.QuotaStatus, error) {
+	peer := Peer(ctx)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	status := &types.QuotaStatus{
+		Peer:  peer,
+		Used:  q.usage(func(_, p string) bool { return p == peer }),
+		Limit: q.peerLimit(peer),
+	}
+	for dir, limit := range q.shares {
+		status.Shares = append(status.Shares, types.ShareQuota{
+			Path:  dir,
+			Used:  q.usage(func(n, _ string) bool { return under(n, dir) }),
+			Limit: limit,
+		})
+	}
+	return status, nil
+}
+
+// Versions returns previous versions of file, if inner storage keeps them
+func (q *Quota) Versions(ctx context.Context, name string) ([]types.FileInfo, error) {
+	v, ok := q.inner.(Versioner)
+	if !ok {
+		return nil, ErrNoVersioning
+	}
+	return v.Versions(ctx, name)
+}
+
+// OpenVersion reads length bytes of version starting at offset
+func (q *Quota) OpenVersion(ctx context.Context, name, version string, offset, length int64) (io.ReadCloser, error) {
+	v, ok := q.inner.(Versioner)
+	if !ok {
+		return nil, ErrNoVersioning
+	}
+	return v.OpenVersion(ctx, name, version, offset, length)
+}
+
+// Restore makes version the current content of file, and updates its usage.
+// The version must fit into the quota of the restoring peer.
+func (q *Quota) Restore(ctx context.Context, name, version string) error {
+	v, ok := q.inner.(Versioner)
+	if !ok {
+		return ErrNoVersioning
+	}
+	name, err := Clean(name)
+	if err != nil {
+		return err
+	}
+	versions, err := v.Versions(ctx, name)
+	if err != nil {
+		return err
+	}
+	size := int64(-1)
+	for _, info := range versions {
+		if info.Version == version {
+			size = info.Size
+		}
+	}
+	if size < 0 {
+		return &os.PathError{Op: "open", Path: name + "@" + version, Err: os.ErrNotExist}
+	}
+	if err := q.admit(ctx, name, size); err != nil {
+		return err
+	}
+	if err := v.Restore(ctx, name, version); err != nil {
+		return err
+	}
+	return q.record(ctx, name)
+}
+
+// Trash returns entries removed from under dir, if inner storage has trash
+func (q *Quota) Trash(ctx context.Context, dir string) ([]types.TrashEntry, error) {
+	t, ok := q.inner.(Trasher)
+	if !ok {
+		return nil, ErrNoTrash
+	}
+	return t.Trash(ctx, dir)
+}
+
+// Undelete moves entry back to the path it was removed from, the restoring
+// peer is charged for it and must have room for it
+func (q *Quota) Undelete(ctx context.Context, name, id string) (*types.FileInfo, error) {
+	t, ok := q.inner.(Trasher)
+	if !ok {
+		return nil, ErrNoTrash
+	}
+	name, err := Clean(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.admitUndelete(ctx, t, name, id); err != nil {
+		return nil, err
+	}
+	info, err := t.Undelete(ctx, name, id)
+	if err != nil {
+		return nil, err
+	}
+	return info, q.record(ctx, name)
+}
+
+// admitUndelete checks that the peer of ctx may store trash entry id at
+// name. Bytes kept for the entry are not counted, they are released by the
+// undelete.
+func (q *Quota) admitUndelete(ctx context.Context, t Trasher, name, id string) error {
+	q.lock.Lock()
+	entry, ok := q.files[trashKey(id)]
+	q.lock.Unlock()
+	size := entry.Size
+	if !ok {
+		// removed before the ledger kept trash entries
+		entries, err := t.Trash(ctx, name)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.ID == id {
+				size = e.Size
+			}
+		}
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if ok {
+		delete(q.files, trashKey(id))
+		defer func() { q.files[trashKey(id)] = entry }()
+	}
+	_, err := q.allowance(name, Peer(ctx), size)
+	return err
+}
+
+// Expire removes expired content of inner storage, kept content frees its
+// usage through the keeper
+func (q *Quota) Expire(ctx context.Context) error {
+	if e, ok := q.inner.(Expirer); ok {
+		return e.Expire(ctx)
+	}
+	return nil
+}
+
+// Purge removes file or directory permanently, and frees its usage
+func (q *Quota) Purge(ctx context.Context, name string) error {
+	t, ok := q.inner.(Trasher)
+	if !ok {
+		return ErrNoTrash
+	}
+	name, err := Clean(name)
+	if err != nil {
+		return err
+	}
+	if err := t.Purge(ctx, name); err != nil {
+		return err
+	}
+	return q.forget(name)
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+func put(ctx context.Context, s Storage, name string, size int) error {
+	w, err := s.Create(ctx, name, int64(size))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(bytes.Repeat([]byte("x"), size)); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+func isQuota(err error) bool {
+	e, ok := err.(*os.PathError)
+	return ok && e.Err == errQuota
+}
+
+func newTestQuota(t *testing.T, inner Storage, conf types.Quota) *Quota {
+	q, err := NewQuota(context.Background(), inner, conf, nil, filepath.Join(t.TempDir(), "quota.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func usedBytes(t *testing.T, ctx context.Context, q *Quota) int64 {
+	status, err := q.Quota(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status.Used.Bytes
+}
+
+func TestQuotaCountsTrash(t *testing.T) {
+	ctx := WithPeer(context.Background(), "peer")
+	mux := NewMux()
+	mux.Mount("/", NewTrash(NewMemory(), 0))
+	q := newTestQuota(t, mux, types.Quota{Default: types.Limit{Bytes: 100}})
+
+	if err := put(ctx, q, "/a", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Remove(ctx, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if used := usedBytes(t, ctx, q); used != 60 {
+		t.Fatalf("used %d bytes after remove, want 60", used)
+	}
+	if err := put(ctx, q, "/b", 60); !isQuota(err) {
+		t.Fatalf("put beyond quota got %v", err)
+	}
+}
+
+func TestQuotaReleasesExpiredTrash(t *testing.T) {
+	ctx := WithPeer(context.Background(), "peer")
+	q := newTestQuota(t, NewTrash(NewMemory(), time.Nanosecond), types.Quota{Default: types.Limit{Bytes: 100}})
+
+	if err := put(ctx, q, "/a", 60); err != nil {
+		t.Fatal(err)
+	}
+	// the entry expires right away
+	if err := q.Remove(ctx, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Expire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if used := usedBytes(t, ctx, q); used != 0 {
+		t.Fatalf("used %d bytes after expiry, want 0", used)
+	}
+}
+
+func TestQuotaCountsVersions(t *testing.T) {
+	ctx := WithPeer(context.Background(), "peer")
+	q := newTestQuota(t, NewVersioned(NewMemory(), NewMemory(), 1, 0), types.Quota{Default: types.Limit{Bytes: 100}})
+
+	if err := put(ctx, q, "/a", 40); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(ctx, q, "/a", 40); err != nil {
+		t.Fatal(err)
+	}
+	if used := usedBytes(t, ctx, q); used != 80 {
+		t.Fatalf("used %d bytes with one version, want 80", used)
+	}
+	if err := put(ctx, q, "/a", 30); !isQuota(err) {
+		t.Fatalf("overwrite beyond quota got %v", err)
+	}
+	// the oldest version is pruned, only one is kept
+	if err := put(ctx, q, "/a", 10); err != nil {
+		t.Fatal(err)
+	}
+	if used := usedBytes(t, ctx, q); used != 50 {
+		t.Fatalf("used %d bytes after pruning, want 50", used)
+	}
+}
+
+func TestQuotaRestoreChecksAllowance(t *testing.T) {
+	ctx := WithPeer(context.Background(), "peer")
+	q := newTestQuota(t, NewVersioned(NewMemory(), NewMemory(), 0, 0), types.Quota{Default: types.Limit{Bytes: 100}})
+
+	if err := put(ctx, q, "/a", 70); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(ctx, q, "/a", 10); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := q.Versions(ctx, "/a")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("versions %v, %v", versions, err)
+	}
+	if err := q.Restore(ctx, "/a", versions[0].Version); !isQuota(err) {
+		t.Fatalf("restore beyond quota got %v", err)
+	}
+	if info, err := q.Stat(ctx, "/a"); err != nil || info.Size != 10 {
+		t.Fatalf("file changed by failed restore: %v, %v", info, err)
+	}
+}
+
+func TestQuotaUndeleteChecksAllowance(t *testing.T) {
+	owner := WithPeer(context.Background(), "owner")
+	other := WithPeer(context.Background(), "other")
+	q := newTestQuota(t, NewTrash(NewMemory(), 0), types.Quota{
+		Default: types.Limit{Bytes: 100},
+		Peers:   map[string]types.Limit{"other": {Bytes: 50}},
+	})
+
+	if err := put(owner, q, "/a", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Remove(owner, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := q.Trash(owner, "/")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("trash %v, %v", entries, err)
+	}
+	if _, err := q.Undelete(other, "/a", entries[0].ID); !isQuota(err) {
+		t.Fatalf("undelete beyond quota got %v", err)
+	}
+	// bytes kept for the owner move back to the file
+	if _, err := q.Undelete(owner, "/a", entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if used := usedBytes(t, owner, q); used != 60 {
+		t.Fatalf("used %d bytes after undelete, want 60", used)
+	}
+}
+
+func TestQuotaSaveConcurrently(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// e.g. two daemons started with the same configuration
+	var quotas []*Quota
+	for i := 0; i < 2; i++ {
+		q, err := NewQuota(ctx, NewMemory(), types.Quota{}, nil, filepath.Join(dir, "quota.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		quotas = append(quotas, q)
+	}
+
+	done := make(chan error)
+	for _, q := range quotas {
+		go func(q *Quota) {
+			var err error
+			for i := 0; i < 50 && err == nil; i++ {
+				q.lock.Lock()
+				err = q.save()
+				q.lock.Unlock()
+			}
+			done <- err
+		}(q)
+	}
+	for range quotas {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("%d files are left, want 1", len(files))
+	}
+}
+
+func TestQuotaFlush(t *testing.T) {
+	ctx := WithPeer(context.Background(), "peer")
+	inner := NewMemory()
+	ledger := filepath.Join(t.TempDir(), "quota.json")
+	q, err := NewQuota(ctx, inner, types.Quota{}, nil, ledger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a", "/b"} {
+		if err := put(ctx, q, name, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// changes are collected instead of being written on every put
+	if data, err := ioutil.ReadFile(ledger); err != nil || string(data) != "{}" {
+		t.Fatalf("ledger %q, %v before flush", data, err)
+	}
+
+	if err := q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewQuota(ctx, inner, types.Quota{}, nil, ledger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := usedBytes(t, ctx, reopened); used != 20 {
+		t.Fatalf("used %d bytes after reopening, want 20", used)
+	}
+}
@@ -0,0 +1,621 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultPartSize is the multipart upload part size if not configured
+	DefaultPartSize = 8 << 20
+	// minPartSize is the smallest part size S3 accepts
+	minPartSize = 5 << 20
+	// dirMode is the mode reported for prefixes
+	dirMode = os.ModeDir | 0700
+)
+
+// S3 serves a bucket of S3 compatible object storage as directory tree.
+// Object keys are paths without leading slash, directories are key prefixes
+// ending with slash, and empty directories are kept as zero sized objects
+// named like the prefix.
+type S3 struct {
+	conf   types.S3Config
+	base   *url.URL
+	client *http.Client
+}
+
+var _ Storage = (*S3)(nil)
+
+// NewS3 creates S3 storage
+func NewS3(conf types.S3Config) (*S3, error) {
+	base, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Bucket == "" {
+		return nil, errors.New("bucket is not configured")
+	}
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	if conf.PartSize == 0 {
+		conf.PartSize = DefaultPartSize
+	}
+	if conf.PartSize < minPartSize {
+		conf.PartSize = minPartSize
+	}
+	conf.Prefix = strings.Trim(conf.Prefix, "/")
+	return &S3{conf: conf, base: base, client: http.DefaultClient}, nil
+}
+
+// key converts storage name into object key
+func (s *S3) key(name string) (string, error) {
+	name, err := Clean(name)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimPrefix(name, "/")
+	if s.conf.Prefix != "" {
+		key = strings.TrimSuffix(s.conf.Prefix+"/"+key, "/")
+	}
+	return key, nil
+}
+
+// dirKey returns the key prefix of directory
+func (s *S3) dirKey(name string) (string, error) {
+	key, err := s.key(name)
+	if err != nil || key == "" {
+		return key, err
+	}
+	return key + "/", nil
+}
+
+// isRoot reports whether name is the root of the storage, which is the
+// bucket or its Prefix. It is always a directory, even without objects.
+func isRoot(name string) bool {
+	name, err := Clean(name)
+	return err == nil && name == "/"
+}
+
+// newRequest builds a signed request for object key
+func (s *S3) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader, payloadHash string) (*http.Request, error) {
+	u := *s.base
+	p := "/" + s.conf.Bucket + "/" + key
+	if s.conf.VirtualHost {
+		u.Host = s.conf.Bucket + "." + u.Host
+		p = "/" + key
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + p
+	u.RawPath = uriEncode(u.Path, false)
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	signV4(req, s.conf.AccessKey, s.conf.SecretKey, s.conf.Region, payloadHash, time.Now())
+	return req, nil
+}
+
+// do sends request, and converts error replies into errors
+func (s *S3) do(req *http.Request, name string) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	s3err := &s3Error{}
+	data, _ := ioutil.ReadAll(resp.Body)
+	xml.Unmarshal(data, s3err)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, &os.PathError{Op: strings.ToLower(req.Method), Path: name, Err: os.ErrNotExist}
+	case resp.StatusCode == http.StatusForbidden:
+		return nil, &os.PathError{Op: strings.ToLower(req.Method), Path: name, Err: os.ErrPermission}
+	case s3err.Code != "":
+		return nil, errors.Errorf("%s %s: %s: %s", req.Method, name, s3err.Code, s3err.Message)
+	}
+	return nil, errors.Errorf("%s %s: %s", req.Method, name, resp.Status)
+}
+
+// Stat returns metadata of object, or of prefix if there is no object
+func (s *S3) Stat(ctx context.Context, name string) (*types.FileInfo, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	if isRoot(name) || strings.HasSuffix(name, "/") {
+		return s.statDir(ctx, name)
+	}
+
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil, nil, hashHex(nil))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, name)
+	if os.IsNotExist(err) {
+		return s.statDir(ctx, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &types.FileInfo{
+		Name:    path.Base(name),
+		Size:    resp.ContentLength,
+		Mode:    0600,
+		ModTime: modTime,
+	}, nil
+}
+
+// statDir reports prefix as directory if any object has it
+func (s *S3) statDir(ctx context.Context, name string) (*types.FileInfo, error) {
+	prefix, err := s.dirKey(name)
+	if err != nil {
+		return nil, err
+	}
+	info := &types.FileInfo{Name: path.Base(name), Mode: dirMode, IsDir: true}
+	if isRoot(name) {
+		return info, nil
+	}
+	result, err := s.listObjects(ctx, prefix, "", "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Contents) == 0 && len(result.CommonPrefixes) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return info, nil
+}
+
+// List returns objects and prefixes directly under directory
+func (s *S3) List(ctx context.Context, dir string) ([]types.FileInfo, error) {
+	prefix, err := s.dirKey(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []types.FileInfo{}
+	found := isRoot(dir)
+	token := ""
+	for {
+		result, err := s.listObjects(ctx, prefix, "/", token, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Contents {
+			found = true
+			if obj.Key == prefix {
+				// directory marker
+				continue
+			}
+			infos = append(infos, types.FileInfo{
+				Name:    strings.TrimPrefix(obj.Key, prefix),
+				Size:    obj.Size,
+				Mode:    0600,
+				ModTime: obj.LastModified,
+			})
+		}
+		for _, p := range result.CommonPrefixes {
+			found = true
+			infos = append(infos, types.FileInfo{
+				Name:  strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"),
+				Mode:  dirMode,
+				IsDir: true,
+			})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	if !found {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// listObjects sends one ListObjectsV2 request
+func (s *S3) listObjects(ctx context.Context, prefix, delimiter, token string, maxKeys int) (*listBucketResult, error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+		"max-keys":  {strconv.Itoa(maxKeys)},
+	}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	req, err := s.newRequest(ctx, http.MethodGet, "", query, nil, hashHex(nil))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, "/"+prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &listBucketResult{}
+	if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Open reads object with range request
+func (s *S3) Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil, hashHex(nil))
+	if err != nil {
+		return nil, err
+	}
+	if length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.do(req, name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if info, serr := s.statDir(ctx, name); serr == nil && info.IsDir {
+				return nil, &os.PathError{Op: "open", Path: name, Err: ErrNotRegular}
+			}
+		}
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Create uploads object with single PUT if its declared size fits in one
+// part, otherwise with multipart upload
+func (s *S3) Create(ctx context.Context, name string, size int64) (Writer, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	if isRoot(name) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	if size >= 0 && size <= s.conf.PartSize {
+		return s.putObject(ctx, key, name, size)
+	}
+	return s.createMultipart(ctx, key, name)
+}
+
+// putObject streams content of declared size into one PUT request
+func (s *S3) putObject(ctx context.Context, key, name string, size int64) (Writer, error) {
+	pr, pw := io.Pipe()
+	req, err := s.newRequest(ctx, http.MethodPut, key, nil, pr, unsignedPayload)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+
+	w := &s3PutWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		resp, err := s.do(req, name)
+		if err == nil {
+			resp.Body.Close()
+		}
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+type s3PutWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *s3PutWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *s3PutWriter) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
+
+func (w *s3PutWriter) Abort() error {
+	w.pw.CloseWithError(errors.New("upload aborted"))
+	<-w.done
+	return nil
+}
+
+// createMultipart starts multipart upload, parts are uploaded whenever
+// part size bytes are buffered
+func (s *S3) createMultipart(ctx context.Context, key, name string) (Writer, error) {
+	req, err := s.newRequest(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, hashHex(nil))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result := &initiateMultipartUploadResult{}
+	if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return &s3MultipartWriter{s: s, ctx: ctx, key: key, name: name, uploadID: result.UploadID}, nil
+}
+
+type s3MultipartWriter struct {
+	s        *S3
+	ctx      context.Context
+	key      string
+	name     string
+	uploadID string
+	buf      bytes.Buffer
+	parts    []completedPart
+}
+
+func (w *s3MultipartWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := int(w.s.conf.PartSize) - w.buf.Len()
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf.Write(p[:n])
+		written += n
+		p = p[n:]
+		if int64(w.buf.Len()) == w.s.conf.PartSize {
+			if err := w.uploadPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *s3MultipartWriter) uploadPart() error {
+	number := len(w.parts) + 1
+	query := url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {w.uploadID},
+	}
+	data := w.buf.Bytes()
+	req, err := w.s.newRequest(w.ctx, http.MethodPut, w.key, query, bytes.NewReader(data), hashHex(data))
+	if err != nil {
+		return err
+	}
+	resp, err := w.s.do(req, w.name)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	w.buf.Reset()
+	return nil
+}
+
+func (w *s3MultipartWriter) Close() error {
+	// the last part may be smaller than part size, but there must be one
+	if w.buf.Len() > 0 || len(w.parts) == 0 {
+		if err := w.uploadPart(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	body, err := xml.Marshal(completeMultipartUpload{Parts: w.parts})
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	req, err := w.s.newRequest(w.ctx, http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}},
+		bytes.NewReader(body), hashHex(body))
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	resp, err := w.s.do(req, w.name)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	defer resp.Body.Close()
+	// errors of complete request may come with 200 status
+	data, _ := ioutil.ReadAll(resp.Body)
+	s3err := &s3Error{}
+	if xml.Unmarshal(data, s3err) == nil && s3err.Code != "" {
+		w.Abort()
+		return errors.Errorf("complete upload %s: %s: %s", w.name, s3err.Code, s3err.Message)
+	}
+	return nil
+}
+
+func (w *s3MultipartWriter) Abort() error {
+	req, err := w.s.newRequest(context.Background(), http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, hashHex(nil))
+	if err != nil {
+		return err
+	}
+	resp, err := w.s.do(req, w.name)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Remove removes object, or directory marker of empty prefix
+func (s *S3) Remove(ctx context.Context, name string) error {
+	if isRoot(name) {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	info, err := s.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		key += "/"
+		result, err := s.listObjects(ctx, key, "", "", 2)
+		if err != nil {
+			return err
+		}
+		for _, obj := range result.Contents {
+			if obj.Key != key {
+				return &os.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+			}
+		}
+	}
+	return s.deleteObject(ctx, key, name)
+}
+
+func (s *S3) deleteObject(ctx context.Context, key, name string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil, nil, hashHex(nil))
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, name)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Rename copies objects to the new keys and deletes the old ones
+func (s *S3) Rename(ctx context.Context, oldname, newname string) error {
+	info, err := s.Stat(ctx, oldname)
+	if err != nil {
+		return err
+	}
+	oldkey, err := s.key(oldname)
+	if err != nil {
+		return err
+	}
+	newkey, err := s.key(newname)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir {
+		return s.move(ctx, oldkey, newkey, oldname)
+	}
+
+	if isRoot(oldname) || isRoot(newname) {
+		return &os.PathError{Op: "rename", Path: oldname, Err: os.ErrPermission}
+	}
+	token := ""
+	for {
+		result, err := s.listObjects(ctx, oldkey+"/", "", token, 1000)
+		if err != nil {
+			return err
+		}
+		for _, obj := range result.Contents {
+			if err := s.move(ctx, obj.Key, newkey+strings.TrimPrefix(obj.Key, oldkey), oldname); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// move copies one object and deletes the source
+func (s *S3) move(ctx context.Context, oldkey, newkey, name string) error {
+	req, err := s.newRequest(ctx, http.MethodPut, newkey, nil, nil, hashHex(nil))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Amz-Copy-Source", uriEncode("/"+s.conf.Bucket+"/"+oldkey, false))
+	signV4(req, s.conf.AccessKey, s.conf.SecretKey, s.conf.Region, hashHex(nil), time.Now())
+	resp, err := s.do(req, name)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return s.deleteObject(ctx, oldkey, name)
+}
+
+// Mkdir creates directory marker object
+func (s *S3) Mkdir(ctx context.Context, name string) error {
+	key, err := s.dirKey(name)
+	if err != nil || isRoot(name) {
+		return err
+	}
+	req, err := s.newRequest(ctx, http.MethodPut, key, nil, http.NoBody, hashHex(nil))
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, name)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
@@ -0,0 +1,530 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	testBucket    = "bucket"
+	testAccessKey = "access"
+	testSecretKey = "secret"
+	testRegion    = "us-east-1"
+)
+
+// fakeS3 is an in-memory S3 server for one path style bucket. It checks
+// request signatures, and returns at most maxKeys entries per list.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	nextID   int
+	maxKeys  int
+	modTime  time.Time
+	lists    int
+	copies   int
+	complete int
+	// failComplete fails complete requests with error in a 200 reply
+	failComplete bool
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: map[string][]byte{},
+		uploads: map[string]map[int][]byte{},
+		maxKeys: 1000,
+		modTime: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+type fakeListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Contents              []fakeObject
+	CommonPrefixes        []fakePrefix
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+}
+
+type fakeObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+type fakePrefix struct {
+	Prefix string
+}
+
+// verify recomputes the signature of r with the test keys
+func verify(r *http.Request, body []byte) error {
+	now, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return err
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash != unsignedPayload && payloadHash != hashHex(body) {
+		return errors.Errorf("payload hash %s does not match body", payloadHash)
+	}
+	req := &http.Request{
+		Method: r.Method,
+		URL:    &url.URL{Path: r.URL.Path, RawQuery: r.URL.RawQuery},
+		Host:   r.Host,
+		Header: http.Header{},
+	}
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			req.Header[name] = values
+		}
+	}
+	signV4(req, testAccessKey, testSecretKey, testRegion, payloadHash, now)
+	if got, want := r.Header.Get("Authorization"), req.Header.Get("Authorization"); got != want {
+		return errors.Errorf("authorization %q, want %q", got, want)
+	}
+	return nil
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+	}{Code: code})
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if err := verify(r, body); err != nil {
+		writeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+testBucket+"/") {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/"+testBucket+"/")
+	query := r.URL.Query()
+	_, initiate := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		f.list(w, query)
+	case r.Method == http.MethodPost && initiate:
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		xml.NewEncoder(w).Encode(struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadId string
+		}{UploadId: id})
+	case r.Method == http.MethodPost && uploadID != "":
+		f.completeUpload(w, key, uploadID, body)
+	case r.Method == http.MethodPut && uploadID != "":
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[number] = body
+		w.Header().Set("ETag", `"`+hashHex(body)+`"`)
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		data, ok := f.objects[strings.TrimPrefix(source, "/"+testBucket+"/")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		f.objects[key] = data
+		f.copies++
+		xml.NewEncoder(w).Encode(struct {
+			XMLName xml.Name `xml:"CopyObjectResult"`
+		}{})
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		http.ServeContent(w, r, key, f.modTime, bytes.NewReader(data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// list answers ListObjectsV2, continuation token is the last returned key
+// or prefix
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	f.lists++
+	prefix, delimiter, token := query.Get("prefix"), query.Get("delimiter"), query.Get("continuation-token")
+	maxKeys, _ := strconv.Atoi(query.Get("max-keys"))
+	if maxKeys <= 0 || maxKeys > f.maxKeys {
+		maxKeys = f.maxKeys
+	}
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := fakeListResult{}
+	last, count := "", 0
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if token != "" && (key <= token || delimiter != "" && strings.HasSuffix(token, delimiter) && strings.HasPrefix(key, token)) {
+			continue
+		}
+		entry, isPrefix := key, false
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry, isPrefix = key[:len(prefix)+i+len(delimiter)], true
+			}
+		}
+		if isPrefix && entry == last {
+			continue
+		}
+		if count == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
+		if isPrefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, fakePrefix{Prefix: entry})
+		} else {
+			result.Contents = append(result.Contents, fakeObject{Key: key, Size: int64(len(f.objects[key])), LastModified: f.modTime})
+		}
+		last = entry
+		count++
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// completeUpload joins uploaded parts, every part but the last must be at
+// least minPartSize like on S3
+func (f *fakeS3) completeUpload(w http.ResponseWriter, key, uploadID string, body []byte) {
+	parts, ok := f.uploads[uploadID]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	if f.failComplete {
+		xml.NewEncoder(w).Encode(&s3Error{Code: "InternalError", Message: "We encountered an internal error"})
+		return
+	}
+	complete := &completeMultipartUpload{}
+	if err := xml.Unmarshal(body, complete); err != nil || len(complete.Parts) == 0 {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	var data []byte
+	for i, part := range complete.Parts {
+		content, ok := parts[part.PartNumber]
+		if part.PartNumber != i+1 || !ok || part.ETag != `"`+hashHex(content)+`"` {
+			writeS3Error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		if i < len(complete.Parts)-1 && len(content) < minPartSize {
+			writeS3Error(w, http.StatusBadRequest, "EntityTooSmall")
+			return
+		}
+		data = append(data, content...)
+	}
+	f.objects[key] = data
+	delete(f.uploads, uploadID)
+	f.complete++
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string
+	}{Key: key})
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newTestS3(t *testing.T, f *fakeS3, conf types.S3Config) *S3 {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	conf.Endpoint = srv.URL
+	conf.Bucket = testBucket
+	conf.Region = testRegion
+	if conf.AccessKey == "" {
+		conf.AccessKey, conf.SecretKey = testAccessKey, testSecretKey
+	}
+	s, err := NewS3(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestS3Signature(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+	s := newTestS3(t, f, types.S3Config{})
+
+	// keys needing escaping are signed as sent
+	write(t, ctx, s, "/dir/a b+c", "content")
+	if got := read(t, ctx, s, "/dir/a b+c", 2, 3); got != "nte" {
+		t.Fatalf("read %q", got)
+	}
+	info, err := s.Stat(ctx, "/dir/a b+c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 7 || !info.ModTime.Equal(f.modTime) {
+		t.Fatalf("stat %+v", info)
+	}
+
+	bad := newTestS3(t, f, types.S3Config{AccessKey: testAccessKey, SecretKey: "wrong"})
+	if _, err := bad.Stat(ctx, "/dir/a b+c"); !os.IsPermission(err) {
+		t.Fatalf("stat with wrong secret got %v", err)
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+	s := newTestS3(t, f, types.S3Config{PartSize: minPartSize})
+
+	data := make([]byte, 2*minPartSize+1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	w, err := s.Create(ctx, "/big", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := data; len(p) > 0; {
+		n := 1 << 20
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if f.complete != 1 || len(f.uploads) != 0 {
+		t.Fatalf("%d completed uploads, %d left", f.complete, len(f.uploads))
+	}
+	if !bytes.Equal(f.objects["big"], data) {
+		t.Fatal("uploaded content differs")
+	}
+	if got := read(t, ctx, s, "/big", minPartSize-2, 4); got != string(data[minPartSize-2:minPartSize+2]) {
+		t.Fatalf("read across parts %q", got)
+	}
+
+	// declared small sizes are sent in one request
+	write(t, ctx, s, "/small", "small")
+	if f.complete != 1 {
+		t.Fatalf("small file used multipart upload")
+	}
+
+	w, err = s.Create(ctx, "/aborted", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data[:minPartSize+1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.uploads) != 0 {
+		t.Fatalf("aborted upload left %d uploads", len(f.uploads))
+	}
+	if _, err := s.Stat(ctx, "/aborted"); !os.IsNotExist(err) {
+		t.Fatalf("aborted file exists: %v", err)
+	}
+}
+
+func TestS3MultipartCompleteFails(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+	f.failComplete = true
+	s := newTestS3(t, f, types.S3Config{PartSize: minPartSize})
+
+	w, err := s.Create(ctx, "/big", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, minPartSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil || !strings.Contains(err.Error(), "InternalError") {
+		t.Fatalf("close got %v", err)
+	}
+	// the parts are not left behind on the bucket
+	if len(f.uploads) != 0 {
+		t.Fatalf("failed upload left %d uploads", len(f.uploads))
+	}
+}
+
+func TestS3Rename(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+	f.maxKeys = 2
+	s := newTestS3(t, f, types.S3Config{Prefix: "share"})
+
+	for _, name := range []string{"/dir/a", "/dir/b", "/dir/sub/c", "/dir/sub/d", "/other"} {
+		write(t, ctx, s, name, name)
+	}
+	if err := s.Rename(ctx, "/dir", "/new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rename(ctx, "/other", "/x/moved"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"share/new/a", "share/new/b", "share/new/sub/c", "share/new/sub/d", "share/x/moved"}
+	if got := f.keys(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("keys %v, want %v", got, want)
+	}
+	if f.copies != 5 {
+		t.Fatalf("%d copies, want 5", f.copies)
+	}
+	if got := read(t, ctx, s, "/new/sub/c", 0, -1); got != "/dir/sub/c" {
+		t.Fatalf("read %q", got)
+	}
+	if err := s.Rename(ctx, "/missing", "/other"); !os.IsNotExist(err) {
+		t.Fatalf("rename of missing file got %v", err)
+	}
+}
+
+func TestS3PrefixRoot(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+	s := newTestS3(t, f, types.S3Config{Prefix: "share"})
+
+	// the root exists before anything is stored under the prefix
+	info, err := s.Stat(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir {
+		t.Fatalf("stat of root %+v", info)
+	}
+	files, err := s.List(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("list of empty root %v", files)
+	}
+	if err := s.Mkdir(ctx, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create(ctx, "/", 0); err == nil {
+		t.Fatal("root is created as file")
+	}
+
+	f.objects["share/"] = nil
+	f.objects["outside"] = []byte("x")
+	write(t, ctx, s, "/a", "a")
+	if err := s.Remove(ctx, "/"); !os.IsPermission(err) {
+		t.Fatalf("remove of root got %v", err)
+	}
+	if err := s.Rename(ctx, "/", "/moved"); !os.IsPermission(err) {
+		t.Fatalf("rename of root got %v", err)
+	}
+	if got, want := strings.Join(f.keys(), ","), "outside,share/,share/a"; got != want {
+		t.Fatalf("keys %s, want %s", got, want)
+	}
+	if files, err = s.List(ctx, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "a" {
+		t.Fatalf("list of root %v", files)
+	}
+}
+
+func TestS3ListPagination(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+	f.maxKeys = 2
+	s := newTestS3(t, f, types.S3Config{})
+
+	for _, name := range []string{"/dir/f0", "/dir/f1", "/dir/f2", "/dir/f3", "/dir/f4", "/dir/sub/x", "/dir/sub/y"} {
+		write(t, ctx, s, name, "x")
+	}
+	if err := s.Mkdir(ctx, "/dir/empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	f.lists = 0
+	files, err := s.List(ctx, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	if got, want := strings.Join(names, ","), "empty,f0,f1,f2,f3,f4,sub"; got != want {
+		t.Fatalf("list %s, want %s", got, want)
+	}
+	if !files[0].IsDir || files[1].IsDir || !files[6].IsDir {
+		t.Fatalf("list %+v", files)
+	}
+	if f.lists != 4 {
+		t.Fatalf("listed in %d pages, want 4", f.lists)
+	}
+
+	files, err = s.List(ctx, "/dir/empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("empty directory lists %+v", files)
+	}
+	if _, err := s.List(ctx, "/missing"); !os.IsNotExist(err) {
+		t.Fatalf("list of missing directory got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+// Package storage abstracts where the listener keeps files. Protocol
+// handlers only talk to the Storage interface, so new backends can be added
+// without touching the protocol code.
+//
+// All names are absolute slash separated paths. Backends report missing
+// files with errors satisfying os.IsNotExist, and existing files with errors
+// satisfying os.IsExist.
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+// Storage is the file storage of the listener
+type Storage interface {
+	// Stat returns metadata of one file or directory
+	Stat(ctx context.Context, name string) (*types.FileInfo, error)
+	// List returns metadata of entries under directory, sorted by name
+	List(ctx context.Context, dir string) ([]types.FileInfo, error)
+	// Open reads length bytes of file starting at offset, length -1 reads
+	// until end of file
+	Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+	// Create creates or truncates file, and its parent directories. size is
+	// the declared size of content, -1 if unknown. Content is only visible
+	// once the writer is closed successfully.
+	Create(ctx context.Context, name string, size int64) (Writer, error)
+	// Remove removes file or empty directory
+	Remove(ctx context.Context, name string) error
+	// Rename moves file or directory to newname
+	Rename(ctx context.Context, oldname, newname string) error
+	// Mkdir creates directory and its parents
+	Mkdir(ctx context.Context, name string) error
+}
+
+// Writer receives content of a created file
+type Writer interface {
+	io.Writer
+	// Close commits written content
+	Close() error
+	// Abort discards written content
+	Abort() error
+}
+
+// Clean returns the shortest absolute form of name, and error if name is
+// not absolute
+func Clean(name string) (string, error) {
+	if !path.IsAbs(name) {
+		return "", &os.PathError{Op: "open", Path: name, Err: ErrNotAbsolute}
+	}
+	return path.Clean(name), nil
+}
+
+// fileInfo converts os.FileInfo into types.FileInfo
+func fileInfo(info os.FileInfo) *types.FileInfo {
+	return &types.FileInfo{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}
+}
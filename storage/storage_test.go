@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// backends creates every backend whose behaviour is checked by
+// testStorage
+var backends = map[string]func(t *testing.T) Storage{
+	"Local":  func(t *testing.T) Storage { return NewLocal(t.TempDir()) },
+	"Memory": func(t *testing.T) Storage { return NewMemory() },
+	"CAS":    func(t *testing.T) Storage { return NewCAS(NewLocal(t.TempDir())) },
+}
+
+// storageCases are behaviours every backend shares
+var storageCases = map[string]func(t *testing.T, ctx context.Context, s Storage){
+	"CreateOpen":        testCreateOpen,
+	"CreateAbort":       testCreateAbort,
+	"OpenRange":         testOpenRange,
+	"OpenDirectory":     testOpenDirectory,
+	"NotExist":          testNotExist,
+	"NotAbsolute":       testNotAbsolute,
+	"List":              testList,
+	"RemoveNotEmpty":    testRemoveNotEmpty,
+	"RenameDirectory":   testRenameDirectory,
+	"MkdirParents":      testMkdirParents,
+	"CreateOverwrites":  testCreateOverwrites,
+	"CreateOverDirFail": testCreateOverDirFail,
+}
+
+func TestStorage(t *testing.T) {
+	for backend, newStorage := range backends {
+		for name, test := range storageCases {
+			newStorage, test := newStorage, test
+			t.Run(backend+"/"+name, func(t *testing.T) {
+				test(t, context.Background(), newStorage(t))
+			})
+		}
+	}
+}
+
+func read(t *testing.T, ctx context.Context, s Storage, name string, offset, length int64) string {
+	r, err := s.Open(ctx, name, offset, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func write(t *testing.T, ctx context.Context, s Storage, name, content string) {
+	w, err := s.Create(ctx, name, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testCreateOpen(t *testing.T, ctx context.Context, s Storage) {
+	w, err := s.Create(ctx, "/dir/a", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(ctx, "/dir/a"); !os.IsNotExist(err) {
+		t.Fatalf("file visible before close: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.Stat(ctx, "/dir/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "a" || info.Size != 5 || info.IsDir {
+		t.Fatalf("stat got %+v", info)
+	}
+	if got := read(t, ctx, s, "/dir/a", 0, -1); got != "hello" {
+		t.Fatalf("read %q", got)
+	}
+}
+
+func testCreateAbort(t *testing.T, ctx context.Context, s Storage) {
+	w, err := s.Create(ctx, "/a", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(ctx, "/a"); !os.IsNotExist(err) {
+		t.Fatalf("aborted file exists: %v", err)
+	}
+	files, err := s.List(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("aborted write left %+v", files)
+	}
+}
+
+func testOpenRange(t *testing.T, ctx context.Context, s Storage) {
+	write(t, ctx, s, "/a", "0123456789")
+	for _, c := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, "0123456789"},
+		{3, -1, "3456789"},
+		{3, 4, "3456"},
+		{8, 10, "89"},
+		{10, -1, ""},
+	} {
+		if got := read(t, ctx, s, "/a", c.offset, c.length); got != c.want {
+			t.Errorf("read %d+%d got %q, want %q", c.offset, c.length, got, c.want)
+		}
+	}
+}
+
+func testOpenDirectory(t *testing.T, ctx context.Context, s Storage) {
+	if err := s.Mkdir(ctx, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open(ctx, "/dir", 0, -1); err == nil {
+		t.Fatal("opened directory")
+	}
+}
+
+func testNotExist(t *testing.T, ctx context.Context, s Storage) {
+	if _, err := s.Stat(ctx, "/missing"); !os.IsNotExist(err) {
+		t.Errorf("stat got %v", err)
+	}
+	if _, err := s.Open(ctx, "/missing", 0, -1); !os.IsNotExist(err) {
+		t.Errorf("open got %v", err)
+	}
+	if _, err := s.List(ctx, "/missing"); !os.IsNotExist(err) {
+		t.Errorf("list got %v", err)
+	}
+	if err := s.Remove(ctx, "/missing"); !os.IsNotExist(err) {
+		t.Errorf("remove got %v", err)
+	}
+	if err := s.Rename(ctx, "/missing", "/other"); !os.IsNotExist(err) {
+		t.Errorf("rename got %v", err)
+	}
+}
+
+func testNotAbsolute(t *testing.T, ctx context.Context, s Storage) {
+	if _, err := s.Stat(ctx, "a"); err == nil {
+		t.Error("stat accepted relative path")
+	}
+	if _, err := s.Create(ctx, "a", 0); err == nil {
+		t.Error("create accepted relative path")
+	}
+	if err := s.Mkdir(ctx, "a"); err == nil {
+		t.Error("mkdir accepted relative path")
+	}
+}
+
+func testList(t *testing.T, ctx context.Context, s Storage) {
+	write(t, ctx, s, "/dir/b", "b")
+	write(t, ctx, s, "/dir/a", "a")
+	write(t, ctx, s, "/dir/sub/c", "c")
+	files, err := s.List(ctx, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	if len(names) != 3 || names[0] != "a" || names[1] != "b" || names[2] != "sub" {
+		t.Fatalf("list got %v", names)
+	}
+	if !files[2].IsDir {
+		t.Fatalf("sub is not a directory: %+v", files[2])
+	}
+	if _, err := s.List(ctx, "/dir/a"); err == nil {
+		t.Fatal("listed a file")
+	}
+}
+
+func testRemoveNotEmpty(t *testing.T, ctx context.Context, s Storage) {
+	write(t, ctx, s, "/dir/a", "a")
+	if err := s.Remove(ctx, "/dir"); err == nil {
+		t.Fatal("removed non-empty directory")
+	}
+	if err := s.Remove(ctx, "/dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(ctx, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(ctx, "/dir"); !os.IsNotExist(err) {
+		t.Fatalf("removed directory exists: %v", err)
+	}
+}
+
+func testRenameDirectory(t *testing.T, ctx context.Context, s Storage) {
+	write(t, ctx, s, "/dir/sub/a", "a")
+	if err := s.Rename(ctx, "/dir", "/new/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(ctx, "/dir"); !os.IsNotExist(err) {
+		t.Fatalf("old directory exists: %v", err)
+	}
+	if got := read(t, ctx, s, "/new/dir/sub/a", 0, -1); got != "a" {
+		t.Fatalf("read %q", got)
+	}
+}
+
+func testMkdirParents(t *testing.T, ctx context.Context, s Storage) {
+	if err := s.Mkdir(ctx, "/a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	// existing directories are fine
+	if err := s.Mkdir(ctx, "/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a", "/a/b", "/a/b/c"} {
+		info, err := s.Stat(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.IsDir {
+			t.Fatalf("%s is not a directory", name)
+		}
+	}
+	write(t, ctx, s, "/file", "x")
+	if err := s.Mkdir(ctx, "/file/dir"); err == nil {
+		t.Fatal("created directory under a file")
+	}
+}
+
+func testCreateOverwrites(t *testing.T, ctx context.Context, s Storage) {
+	write(t, ctx, s, "/a", "first content")
+	write(t, ctx, s, "/a", "second")
+	if got := read(t, ctx, s, "/a", 0, -1); got != "second" {
+		t.Fatalf("read %q", got)
+	}
+}
+
+func testCreateOverDirFail(t *testing.T, ctx context.Context, s Storage) {
+	if err := s.Mkdir(ctx, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	// backends may refuse on Create, or only when committing
+	w, err := s.Create(ctx, "/dir", 1)
+	if err == nil {
+		w.Write([]byte("x"))
+		err = w.Close()
+	}
+	if err == nil {
+		t.Fatal("replaced directory with a file")
+	}
+	if info, err := s.Stat(ctx, "/dir"); err != nil || !info.IsDir {
+		t.Fatalf("directory changed: %+v, %v", info, err)
+	}
+	if files, err := s.List(ctx, "/"); err != nil || len(files) != 1 {
+		t.Fatalf("failed write left %+v, %v", files, err)
+	}
+}
@@ -0,0 +1,424 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// trashDir is where removed files are kept, it is hidden from listing
+	trashDir = "/.trash"
+	// trashMeta is the suffix of entry metadata next to its content
+	trashMeta = ".json"
+)
+
+// ErrNoTrash is returned for trash operations on storage without trash
+var ErrNoTrash = errors.New("trash is not enabled")
+
+// Trasher is implemented by storages moving removed files into trash
+type Trasher interface {
+	// Trash returns entries removed from under dir, newest first
+	Trash(ctx context.Context, dir string) ([]types.TrashEntry, error)
+	// Undelete moves entry back to the path it was removed from
+	Undelete(ctx context.Context, name, id string) (*types.FileInfo, error)
+	// Purge removes file or directory permanently, only peers allowed to
+	// may do it
+	Purge(ctx context.Context, name string) error
+}
+
+// Expirer is implemented by storages holding content which expires, Expire
+// removes what has expired and is called periodically by the server
+type Expirer interface {
+	Expire(ctx context.Context) error
+}
+
+// Trash moves removed files and directories into a trash area inside inner
+// storage, together with metadata of who removed them and when. Entries
+// older than retention are purged on Expire, and are hidden from listing
+// and undelete until then.
+type Trash struct {
+	inner     Storage
+	retention time.Duration
+	purgers   map[string]bool
+	keeper    Keeper
+}
+
+var (
+	_ Storage = (*Trash)(nil)
+	_ Trasher = (*Trash)(nil)
+	_ Expirer = (*Trash)(nil)
+)
+
+// NewTrash creates storage with trash. Entries are kept for retention, zero
+// keeps them forever. Only purgers may remove files permanently.
+func NewTrash(inner Storage, retention time.Duration, purgers ...string) *Trash {
+	t := &Trash{inner: inner, retention: retention, purgers: map[string]bool{}}
+	for _, id := range purgers {
+		t.purgers[id] = true
+	}
+	return t
+}
+
+// SetKeeper tells keeper about entries while they are in trash
+func (t *Trash) SetKeeper(k Keeper) {
+	t.keeper = k
+}
+
+// trashKey names entry id for keepers
+func trashKey(id string) string {
+	return "trash:" + id
+}
+
+// check cleans name, and hides the trash area
+func (t *Trash) check(op, name string) (string, error) {
+	name, err := Clean(name)
+	if err != nil {
+		return "", err
+	}
+	if name == trashDir || strings.HasPrefix(name, trashDir+"/") {
+		return "", &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return name, nil
+}
+
+// Stat returns metadata of one file or directory
+func (t *Trash) Stat(ctx context.Context, name string) (*types.FileInfo, error) {
+	name, err := t.check("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return t.inner.Stat(ctx, name)
+}
+
+// List returns metadata of entries under directory
+func (t *Trash) List(ctx context.Context, dir string) ([]types.FileInfo, error) {
+	dir, err := t.check("open", dir)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := t.inner.List(ctx, dir)
+	if err != nil || dir != "/" {
+		return infos, err
+	}
+	for i, info := range infos {
+		if "/"+info.Name == trashDir {
+			return append(infos[:i], infos[i+1:]...), nil
+		}
+	}
+	return infos, nil
+}
+
+// Open reads length bytes of file starting at offset
+func (t *Trash) Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	name, err := t.check("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return t.inner.Open(ctx, name, offset, length)
+}
+
+// Create creates or truncates file, and its parent directories
+func (t *Trash) Create(ctx context.Context, name string, size int64) (Writer, error) {
+	name, err := t.check("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return t.inner.Create(ctx, name, size)
+}
+
+// Remove moves file or directory into trash
+func (t *Trash) Remove(ctx context.Context, name string) error {
+	name, err := t.check("remove", name)
+	if err != nil {
+		return err
+	}
+	if name == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	info, err := t.inner.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	id, err := newTrashID()
+	if err != nil {
+		return err
+	}
+	entry := types.TrashEntry{
+		ID:        id,
+		Path:      name,
+		Size:      info.Size,
+		IsDir:     info.IsDir,
+		DeletedAt: time.Now(),
+		DeletedBy: Peer(ctx),
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := t.inner.Mkdir(ctx, trashDir); err != nil {
+		return err
+	}
+	if err := t.inner.Rename(ctx, name, path.Join(trashDir, id)); err != nil {
+		return err
+	}
+	w, err := t.inner.Create(ctx, path.Join(trashDir, id+trashMeta), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if t.keeper != nil {
+		size, err := treeSize(ctx, t.inner, path.Join(trashDir, id))
+		if err != nil {
+			return err
+		}
+		if err := t.keeper.Keep(ctx, trashKey(id), name, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTrashID returns unique entry id, which sorts by removal time
+func newTrashID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b), nil
+}
+
+// Rename moves file or directory to newname
+func (t *Trash) Rename(ctx context.Context, oldname, newname string) error {
+	oldname, err := t.check("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newname, err = t.check("rename", newname)
+	if err != nil {
+		return err
+	}
+	return t.inner.Rename(ctx, oldname, newname)
+}
+
+// Mkdir creates directory and its parents
+func (t *Trash) Mkdir(ctx context.Context, name string) error {
+	name, err := t.check("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return t.inner.Mkdir(ctx, name)
+}
+
+// entries returns all entries of trash, newest first
+func (t *Trash) entries(ctx context.Context) ([]types.TrashEntry, error) {
+	infos, err := t.inner.List(ctx, trashDir)
+	if os.IsNotExist(err) {
+		return []types.TrashEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []types.TrashEntry{}
+	for _, info := range infos {
+		if info.IsDir || !strings.HasSuffix(info.Name, trashMeta) {
+			continue
+		}
+		entry, err := t.entry(ctx, strings.TrimSuffix(info.Name, trashMeta))
+		if err != nil {
+			// partly written by a remove which failed
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID > entries[j].ID })
+	return entries, nil
+}
+
+// entry reads metadata of one entry
+func (t *Trash) entry(ctx context.Context, id string) (*types.TrashEntry, error) {
+	if id == "" || strings.Contains(id, "/") || strings.HasPrefix(id, ".") {
+		return nil, &os.PathError{Op: "open", Path: id, Err: os.ErrNotExist}
+	}
+	r, err := t.inner.Open(ctx, path.Join(trashDir, id+trashMeta), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	entry := &types.TrashEntry{}
+	if err := json.NewDecoder(r).Decode(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Trash returns entries removed from under dir, newest first
+func (t *Trash) Trash(ctx context.Context, dir string) ([]types.TrashEntry, error) {
+	dir, err := t.check("open", dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := t.entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	matched := []types.TrashEntry{}
+	for _, entry := range entries {
+		if t.expired(entry) {
+			continue
+		}
+		if dir == "/" || entry.Path == dir || strings.HasPrefix(entry.Path, dir+"/") {
+			matched = append(matched, entry)
+		}
+	}
+	return matched, nil
+}
+
+// Undelete moves entry back to the path it was removed from, which must
+// not exist again
+func (t *Trash) Undelete(ctx context.Context, name, id string) (*types.FileInfo, error) {
+	name, err := t.check("rename", name)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := t.entry(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if t.expired(*entry) {
+		return nil, &os.PathError{Op: "rename", Path: name, Err: os.ErrNotExist}
+	}
+	if entry.Path != name {
+		return nil, &os.PathError{Op: "rename", Path: name, Err: errors.Errorf("trash entry %s was removed from another path", id)}
+	}
+	if _, err := t.inner.Stat(ctx, name); err == nil {
+		return nil, &os.PathError{Op: "rename", Path: name, Err: os.ErrExist}
+	}
+	if err := t.inner.Rename(ctx, path.Join(trashDir, id), name); err != nil {
+		return nil, err
+	}
+	if err := t.inner.Remove(ctx, path.Join(trashDir, id+trashMeta)); err != nil {
+		return nil, err
+	}
+	if t.keeper != nil {
+		if err := t.keeper.Release(ctx, trashKey(id)); err != nil {
+			return nil, err
+		}
+	}
+	return t.inner.Stat(ctx, name)
+}
+
+// Purge removes file or directory tree permanently
+func (t *Trash) Purge(ctx context.Context, name string) error {
+	name, err := t.check("remove", name)
+	if err != nil {
+		return err
+	}
+	if !t.purgers[Peer(ctx)] {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	if name == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	return removeAll(ctx, t.inner, name)
+}
+
+// Expire purges entries older than retention
+func (t *Trash) Expire(ctx context.Context) error {
+	return t.purgeExpired(ctx)
+}
+
+// expired tells if entry is older than retention, and waits for Expire
+func (t *Trash) expired(entry types.TrashEntry) bool {
+	return t.retention != 0 && time.Since(entry.DeletedAt) >= t.retention
+}
+
+// purgeExpired removes entries older than retention
+func (t *Trash) purgeExpired(ctx context.Context) error {
+	if t.retention == 0 {
+		return nil
+	}
+	entries, err := t.entries(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !t.expired(entry) {
+			continue
+		}
+		if err := removeAll(ctx, t.inner, path.Join(trashDir, entry.ID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := t.inner.Remove(ctx, path.Join(trashDir, entry.ID+trashMeta)); err != nil {
+			return err
+		}
+		if t.keeper != nil {
+			if err := t.keeper.Release(ctx, trashKey(entry.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// treeSize returns size of file, or of all files under directory
+func treeSize(ctx context.Context, s Storage, name string) (int64, error) {
+	info, err := s.Stat(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir {
+		return info.Size, nil
+	}
+	infos, err := s.List(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, info := range infos {
+		n, err := treeSize(ctx, s, path.Join(name, info.Name))
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// removeAll removes file, or directory with everything under it
+func removeAll(ctx context.Context, s Storage, name string) error {
+	info, err := s.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		infos, err := s.List(ctx, name)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if err := removeAll(ctx, s, path.Join(name, info.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	return s.Remove(ctx, name)
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+// trashed returns names in the trash area of inner storage
+func trashed(t *testing.T, ctx context.Context, inner Storage) []types.FileInfo {
+	files, err := inner.List(ctx, trashDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestTrashExpire(t *testing.T) {
+	ctx := WithPeer(context.Background(), "peer")
+	inner := NewMemory()
+	mux := NewMux()
+	mux.Mount("/share", NewTrash(inner, 50*time.Millisecond))
+	q := newTestQuota(t, mux, types.Quota{Default: types.Limit{Bytes: 100}})
+
+	if err := put(ctx, q, "/share/a", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Remove(ctx, "/share/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Expire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if files := trashed(t, ctx, inner); len(files) != 2 {
+		t.Fatalf("entry expired before retention: %+v", files)
+	}
+
+	// time passes without any further remove
+	time.Sleep(60 * time.Millisecond)
+	if err := q.Expire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if files := trashed(t, ctx, inner); len(files) != 0 {
+		t.Fatalf("expired entry is kept: %+v", files)
+	}
+	if used := usedBytes(t, ctx, q); used != 0 {
+		t.Fatalf("used %d bytes after expiry, want 0", used)
+	}
+}
+
+func TestTrashHidesExpired(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemory()
+	tr := NewTrash(inner, 50*time.Millisecond)
+	write(t, ctx, tr, "/a", "a")
+	if err := tr.Remove(ctx, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := tr.Trash(ctx, "/")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("trash %+v, %v", entries, err)
+	}
+	entry := entries[0]
+
+	time.Sleep(60 * time.Millisecond)
+	entries, err = tr.Trash(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expired entries are listed: %+v", entries)
+	}
+	if _, err := tr.Undelete(ctx, "/a", entry.ID); !os.IsNotExist(err) {
+		t.Fatalf("undelete of expired entry got %v", err)
+	}
+	// only Expire purges, listing and removing leave the trash alone
+	write(t, ctx, tr, "/b", "b")
+	if err := tr.Remove(ctx, "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if files := trashed(t, ctx, inner); len(files) != 4 {
+		t.Fatalf("trash is purged before Expire: %+v", files)
+	}
+}
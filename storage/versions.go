@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+
+	"github.com/pkg/errors"
+)
+
+// versionFormat names versions by the time they were superseded, so that
+// they sort by age
+const versionFormat = "20060102T150405.000000000Z"
+
+// ErrNoVersioning is returned for version operations on storage without
+// versioning
+var ErrNoVersioning = errors.New("versioning is not enabled")
+
+// errInvalidVersion is returned for malformed version names
+var errInvalidVersion = errors.New("invalid version")
+
+// Versioner is implemented by storages keeping previous versions of files
+type Versioner interface {
+	// Versions returns previous versions of file, newest first. Version of
+	// each entry is the name to pass to OpenVersion and Restore.
+	Versions(ctx context.Context, name string) ([]types.FileInfo, error)
+	// OpenVersion reads length bytes of version starting at offset
+	OpenVersion(ctx context.Context, name, version string, offset, length int64) (io.ReadCloser, error)
+	// Restore makes version the current content of file, the replaced
+	// content becomes a version itself
+	Restore(ctx context.Context, name, version string) error
+}
+
+// Versioned copies files into archive storage before they are overwritten
+// or removed. Versions of a file are kept in the archive under a directory
+// named like the file.
+type Versioned struct {
+	inner   Storage
+	archive Storage
+	keep    int
+	maxAge  time.Duration
+	keeper  Keeper
+}
+
+var (
+	_ Storage   = (*Versioned)(nil)
+	_ Versioner = (*Versioned)(nil)
+	_ Trasher   = (*Versioned)(nil)
+	_ Expirer   = (*Versioned)(nil)
+)
+
+// NewVersioned creates versioned storage. At most keep versions younger
+// than maxAge are kept per file, zero disables either limit.
+func NewVersioned(inner, archive Storage, keep int, maxAge time.Duration) *Versioned {
+	return &Versioned{inner: inner, archive: archive, keep: keep, maxAge: maxAge}
+}
+
+// SetKeeper tells keeper about archived versions until they are pruned, and
+// about entries in trash of inner storage
+func (v *Versioned) SetKeeper(k Keeper) {
+	v.keeper = k
+	if ks, ok := v.inner.(keeperSetter); ok {
+		ks.SetKeeper(k)
+	}
+}
+
+// versionKey names version of file for keepers
+func versionKey(name, version string) string {
+	return "version:" + name + "@" + version
+}
+
+// Stat returns metadata of one file or directory
+func (v *Versioned) Stat(ctx context.Context, name string) (*types.FileInfo, error) {
+	return v.inner.Stat(ctx, name)
+}
+
+// List returns metadata of entries under directory
+func (v *Versioned) List(ctx context.Context, dir string) ([]types.FileInfo, error) {
+	return v.inner.List(ctx, dir)
+}
+
+// Open reads length bytes of file starting at offset
+func (v *Versioned) Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	return v.inner.Open(ctx, name, offset, length)
+}
+
+// Create creates or truncates file, the previous content is archived once
+// the new one is committed
+func (v *Versioned) Create(ctx context.Context, name string, size int64) (Writer, error) {
+	w, err := v.inner.Create(ctx, name, size)
+	if err != nil {
+		return nil, err
+	}
+	return &versionedWriter{Writer: w, v: v, ctx: ctx, name: name}, nil
+}
+
+type versionedWriter struct {
+	Writer
+	v    *Versioned
+	ctx  context.Context
+	name string
+}
+
+func (w *versionedWriter) Close() error {
+	if err := w.v.archiveFile(w.ctx, w.name); err != nil {
+		w.Writer.Abort()
+		return err
+	}
+	return w.Writer.Close()
+}
+
+// Remove archives file before removing it, directories are removed as is
+func (v *Versioned) Remove(ctx context.Context, name string) error {
+	if err := v.archiveFile(ctx, name); err != nil {
+		return err
+	}
+	return v.inner.Remove(ctx, name)
+}
+
+// Rename moves file or directory to newname, a file replaced by it is
+// archived
+func (v *Versioned) Rename(ctx context.Context, oldname, newname string) error {
+	if err := v.archiveFile(ctx, newname); err != nil {
+		return err
+	}
+	return v.inner.Rename(ctx, oldname, newname)
+}
+
+// Mkdir creates directory and its parents
+func (v *Versioned) Mkdir(ctx context.Context, name string) error {
+	return v.inner.Mkdir(ctx, name)
+}
+
+// archiveFile copies current content of file into archive, nothing is done
+// if it does not exist or is a directory
+func (v *Versioned) archiveFile(ctx context.Context, name string) error {
+	name, err := Clean(name)
+	if err != nil {
+		return err
+	}
+	info, err := v.inner.Stat(ctx, name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return nil
+	}
+
+	r, err := v.inner.Open(ctx, name, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	version := time.Now().UTC().Format(versionFormat)
+	w, err := v.archive.Create(ctx, path.Join(name, version), info.Size)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, r, info.Size); err != nil {
+		w.Abort()
+		return errors.Wrapf(err, "archive %s", name)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if v.keeper != nil {
+		if err := v.keeper.Keep(ctx, versionKey(name, version), name, info.Size); err != nil {
+			return err
+		}
+	}
+	return v.prune(ctx, name)
+}
+
+// prune removes versions beyond retention limits
+func (v *Versioned) prune(ctx context.Context, name string) error {
+	versions, err := v.Versions(ctx, name)
+	if err != nil {
+		return err
+	}
+	for i, version := range versions {
+		if (v.keep > 0 && i >= v.keep) || (v.maxAge > 0 && time.Since(version.ModTime) > v.maxAge) {
+			if err := v.archive.Remove(ctx, path.Join(name, version.Version)); err != nil {
+				return err
+			}
+			if v.keeper != nil {
+				if err := v.keeper.Release(ctx, versionKey(name, version.Version)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Versions returns previous versions of file, newest first
+func (v *Versioned) Versions(ctx context.Context, name string) ([]types.FileInfo, error) {
+	name, err := Clean(name)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := v.archive.List(ctx, name)
+	if os.IsNotExist(err) {
+		return []types.FileInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []types.FileInfo{}
+	for _, info := range infos {
+		// versions of files under a directory of the same name
+		if info.IsDir {
+			continue
+		}
+		archived, err := time.Parse(versionFormat, info.Name)
+		if err != nil {
+			continue
+		}
+		info.Version = info.Name
+		info.Name = path.Base(name)
+		info.ModTime = archived
+		versions = append(versions, info)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+	return versions, nil
+}
+
+// OpenVersion reads length bytes of version starting at offset
+func (v *Versioned) OpenVersion(ctx context.Context, name, version string, offset, length int64) (io.ReadCloser, error) {
+	name, err := Clean(name)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(version, "/") || version == "." || version == ".." || version == "" {
+		return nil, &os.PathError{Op: "open", Path: name + "@" + version, Err: errInvalidVersion}
+	}
+	return v.archive.Open(ctx, path.Join(name, version), offset, length)
+}
+
+// Restore makes version the current content of file
+func (v *Versioned) Restore(ctx context.Context, name, version string) error {
+	r, err := v.OpenVersion(ctx, name, version, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	info, err := v.archive.Stat(ctx, path.Join(name, version))
+	if err != nil {
+		return err
+	}
+
+	w, err := v.Create(ctx, name, info.Size)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, r, info.Size); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// Trash returns entries removed from under dir, if inner storage has trash
+func (v *Versioned) Trash(ctx context.Context, dir string) ([]types.TrashEntry, error) {
+	t, ok := v.inner.(Trasher)
+	if !ok {
+		return nil, ErrNoTrash
+	}
+	return t.Trash(ctx, dir)
+}
+
+// Undelete moves entry back to the path it was removed from
+func (v *Versioned) Undelete(ctx context.Context, name, id string) (*types.FileInfo, error) {
+	t, ok := v.inner.(Trasher)
+	if !ok {
+		return nil, ErrNoTrash
+	}
+	return t.Undelete(ctx, name, id)
+}
+
+// Expire prunes versions older than maxAge, and removes expired content of
+// inner storage
+func (v *Versioned) Expire(ctx context.Context) error {
+	if v.maxAge > 0 {
+		if err := v.expireDir(ctx, "/"); err != nil {
+			return err
+		}
+	}
+	if e, ok := v.inner.(Expirer); ok {
+		return e.Expire(ctx)
+	}
+	return nil
+}
+
+// expireDir removes versions older than maxAge of files archived under dir,
+// so that files which are never archived again are pruned too
+func (v *Versioned) expireDir(ctx context.Context, dir string) error {
+	infos, err := v.archive.List(ctx, dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir {
+			if err := v.expireDir(ctx, path.Join(dir, info.Name)); err != nil {
+				return err
+			}
+			continue
+		}
+		archived, err := time.Parse(versionFormat, info.Name)
+		if err != nil || time.Since(archived) <= v.maxAge {
+			continue
+		}
+		if err := v.archive.Remove(ctx, path.Join(dir, info.Name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if v.keeper != nil {
+			if err := v.keeper.Release(ctx, versionKey(dir, info.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Purge removes file or directory permanently without archiving it
+func (v *Versioned) Purge(ctx context.Context, name string) error {
+	t, ok := v.inner.(Trasher)
+	if !ok {
+		return ErrNoTrash
+	}
+	return t.Purge(ctx, name)
+}
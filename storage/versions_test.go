@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/leslie-wang/libp2p-ftp/types"
+)
+
+func versions(t *testing.T, ctx context.Context, v *Versioned, name string) []types.FileInfo {
+	infos, err := v.Versions(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return infos
+}
+
+func TestVersionsRestore(t *testing.T) {
+	ctx := context.Background()
+	v := NewVersioned(NewMemory(), NewMemory(), 2, 0)
+	write(t, ctx, v, "/dir/a", "1")
+	write(t, ctx, v, "/dir/a", "2")
+	write(t, ctx, v, "/dir/a", "3")
+	write(t, ctx, v, "/dir/a", "4")
+
+	infos := versions(t, ctx, v, "/dir/a")
+	if len(infos) != 2 {
+		t.Fatalf("kept %d versions, want 2", len(infos))
+	}
+	if got := read(t, ctx, v.archive, "/dir/a/"+infos[1].Version, 0, -1); got != "2" {
+		t.Fatalf("oldest kept version is %q, want %q", got, "2")
+	}
+
+	if err := v.Restore(ctx, "/dir/a", infos[1].Version); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, ctx, v, "/dir/a", 0, -1); got != "2" {
+		t.Fatalf("restored content is %q, want %q", got, "2")
+	}
+	// the replaced content became a version
+	infos = versions(t, ctx, v, "/dir/a")
+	if got := read(t, ctx, v.archive, "/dir/a/"+infos[0].Version, 0, -1); got != "4" {
+		t.Fatalf("newest version is %q, want %q", got, "4")
+	}
+}
+
+func TestVersionsExpire(t *testing.T) {
+	ctx := WithPeer(context.Background(), "peer")
+	v := NewVersioned(NewMemory(), NewMemory(), 0, 50*time.Millisecond)
+	q := newTestQuota(t, v, types.Quota{Default: types.Limit{Bytes: 100}})
+
+	if err := put(ctx, q, "/dir/a", 40); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(ctx, q, "/dir/a", 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Expire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if infos := versions(t, ctx, v, "/dir/a"); len(infos) != 1 {
+		t.Fatalf("version expired before max age: %+v", infos)
+	}
+
+	// time passes without the file being archived again
+	time.Sleep(60 * time.Millisecond)
+	if err := q.Expire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if infos := versions(t, ctx, v, "/dir/a"); len(infos) != 0 {
+		t.Fatalf("expired version is kept: %+v", infos)
+	}
+	if used := usedBytes(t, ctx, q); used != 20 {
+		t.Fatalf("used %d bytes after expiry, want 20", used)
+	}
+}
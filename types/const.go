@@ -13,14 +13,72 @@ const (
 	PutURL = "/p2pftp/v1/put"
 	//DeleteURL delete remote files
 	DeleteURL = "/p2pftp/v1/delete"
+	//PutV2URL puts local file to remote, which replies with the result
+	PutV2URL = "/p2pftp/v2/put"
+	//DeleteV2URL deletes remote file, which replies with the result
+	DeleteV2URL = "/p2pftp/v2/delete"
+	//ListDetailURL lists remote dir with file metadata
+	ListDetailURL = "/p2pftp/v1/listdetail"
+	//StatURL gets metadata of remote file
+	StatURL = "/p2pftp/v1/stat"
+	//StatusURL reports network status
+	StatusURL = "/p2pftp/v1/status"
+	//VersionsURL lists previous versions of remote file
+	VersionsURL = "/p2pftp/v1/versions"
+	//GetVersionURL gets previous version of remote file
+	GetVersionURL = "/p2pftp/v1/getversion"
+	//RestoreURL restores previous version of remote file
+	RestoreURL = "/p2pftp/v1/restore"
+	//TrashURL lists deleted remote files
+	TrashURL = "/p2pftp/v1/trash"
+	//UndeleteURL restores deleted remote file
+	UndeleteURL = "/p2pftp/v1/undelete"
+	//PurgeURL deletes remote file permanently
+	PurgeURL = "/p2pftp/v1/purge"
+	//QuotaURL reports storage quota of the asking peer
+	QuotaURL = "/p2pftp/v1/quota"
+	//MkdirURL creates remote directory
+	MkdirURL = "/p2pftp/v1/mkdir"
+	//RenameURL moves remote file or directory
+	RenameURL = "/p2pftp/v1/rename"
+	//GetRangeURL gets remote file starting at an offset
+	GetRangeURL = "/p2pftp/v1/getrange"
+	//ConnectionURL reports connection state of the connect daemon
+	ConnectionURL = "/p2pftp/v1/connection"
+)
+
+const (
+	//APIFilesURL is the REST resource of remote files, followed by their path
+	APIFilesURL = "/api/v1/files"
+	//APIStatusURL reports network status of the connect daemon
+	APIStatusURL = "/api/v1/status"
+	//APIConnectionURL reports connection state of the connect daemon
+	APIConnectionURL = "/api/v1/connection"
+	//APIQuotaURL reports storage quota of the connect daemon's peer
+	APIQuotaURL = "/api/v1/quota"
+	//APIOpenAPIURL serves OpenAPI description of the REST API
+	APIOpenAPIURL = "/api/v1/openapi.json"
 )
 
 // ReadTimeout is to control the wait time for p2p read
 const ReadTimeout = time.Hour
 
 const (
-	//QueryKeySource is the key for source
-    QueryKeySource = "src"
+	//QueryKeyRemote asks to query remote peer instead of local one
+	QueryKeyRemote = "remote"
 	//QueryKeyDestination is the key for destination
 	QueryKeyDestination = "dst"
+	//QueryKeyVersion is the key for file version
+	QueryKeyVersion = "version"
+	//QueryKeyID is the key for trash entry id
+	QueryKeyID = "id"
+	//QueryKeyPermanent asks to delete permanently instead of into trash
+	QueryKeyPermanent = "permanent"
+)
+
+const (
+	//TransportTCP is the name of the TCP transport
+	TransportTCP = "tcp"
+	//TransportWebSocket is the name of the WebSocket transport
+	TransportWebSocket = "ws"
 )
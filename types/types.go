@@ -1,14 +1,275 @@
 package types
 
-import "time"
+import (
+	"os"
+	"time"
+)
 
 // Config is the configuration structure
 type Config struct {
-	BootstrapNodes []string
-	ServerID string
-	ServerPublicKey string
+	BootstrapNodes   []string
+	ServerID         string
+	ServerPublicKey  string
 	ServerPrivateKey string
-	HTTPListenPort int
-	RetryCount int
-	RetryInterval time.Duration
+	HTTPListenPort   int
+	RetryCount       int
+	RetryInterval    time.Duration
+	// FTPListenPort serves FTP on localhost for FTP clients of the connect
+	// daemon, disabled if 0
+	FTPListenPort int `json:",omitempty"`
+	// WebDAVListenPort serves WebDAV on localhost for file managers and
+	// davfs, disabled if 0
+	WebDAVListenPort int `json:",omitempty"`
+	// S3ListenPort serves S3 compatible API on localhost for S3 clients
+	S3ListenPort int `json:",omitempty"`
+	// SFTP serves sftp on localhost for SSH clients of the connect daemon
+	SFTP *SFTP `json:",omitempty"`
+	// HTTP secures the HTTP bridge of the connect daemon on HTTPListenPort
+	HTTP *HTTP `json:",omitempty"`
+	// RelayNodes are circuit relay peers used to reach or be reached by
+	// peers behind NAT
+	RelayNodes []string
+	// RelayPrivateKey is the identity of the relay command, so it never
+	// takes the peer ID of the listener. A new key is used on every start
+	// if empty.
+	RelayPrivateKey string `json:",omitempty"`
+	// EnableNATPortMap opens listen ports on the router via UPnP or NAT-PMP
+	EnableNATPortMap bool
+	// DatastoreDir keeps known peers and routing table across restarts,
+	// nothing is persisted if empty
+	DatastoreDir string
+	// AllowedClients are peer IDs of clients allowed to use the server
+	AllowedClients []string
+	// ClientPrivateKey is the identity of the connect daemon and the CLI, so
+	// that a listener can name it in AllowedClients. A new key is used on
+	// every start if empty.
+	ClientPrivateKey string `json:",omitempty"`
+	// ConnMgrLowWater and ConnMgrHighWater bound number of open connections,
+	// connection manager is disabled if high watermark is 0. New connections
+	// are never trimmed within ConnMgrGracePeriod.
+	ConnMgrLowWater    int
+	ConnMgrHighWater   int
+	ConnMgrGracePeriod time.Duration
+	// ListenAddrs are multiaddrs the node listens on, like
+	// /ip4/0.0.0.0/tcp/4002/ws for WebSocket. Random TCP ports are used if
+	// empty.
+	ListenAddrs []string `json:",omitempty"`
+	// Transports enables only the given transports, TransportTCP and
+	// TransportWebSocket, for listening and dialing. All are enabled if
+	// empty.
+	Transports []string `json:",omitempty"`
+	// Shares mount storage backends at remote directories, the whole local
+	// filesystem is served if empty
+	Shares []Share
+	// Versioning keeps previous versions of overwritten and deleted files
+	Versioning *Versioning `json:",omitempty"`
+	// Quota limits storage used by each client peer
+	Quota *Quota `json:",omitempty"`
+	// Encryption encrypts files before they are uploaded
+	Encryption *Encryption `json:",omitempty"`
+}
+
+// SFTP configures the SSH server of the connect daemon
+type SFTP struct {
+	// ListenPort is the port on localhost
+	ListenPort int
+	// HostKey is the PEM file of the host private key, it is generated if
+	// it does not exist. A new key is used on every start if empty.
+	HostKey string `json:",omitempty"`
+	// Users maps user names to their public keys in authorized_keys format
+	Users map[string][]string
+}
+
+// HTTP configures listen address, authentication and TLS of the HTTP bridge.
+// The CLI reads the same settings to reach the bridge.
+type HTTP struct {
+	// ListenAddr is the IP to listen on, default is 127.0.0.1
+	ListenAddr string `json:",omitempty"`
+	// Socket is a Unix domain socket listened on instead of TCP
+	Socket string `json:",omitempty"`
+	// Tokens are the accepted bearer tokens, every request needs one of
+	// them unless empty
+	Tokens []string `json:",omitempty"`
+	// CertFile and KeyFile are PEM files enabling TLS
+	CertFile string `json:",omitempty"`
+	KeyFile  string `json:",omitempty"`
+}
+
+// Encryption configures client side encryption
+type Encryption struct {
+	// Key is 32 base64 encoded bytes
+	Key string
+	// EncryptNames encrypts file and directory names as well
+	EncryptNames bool `json:",omitempty"`
+	// Root is the remote directory below which files are encrypted, so
+	// that share mount points stay readable. Default is /.
+	Root string `json:",omitempty"`
+}
+
+// Quota configures storage limits of client peers
+type Quota struct {
+	// Ledger is the file usage is tracked in, default is quota.json in
+	// DatastoreDir
+	Ledger string `json:",omitempty"`
+	// Default limits peers without own limit
+	Default Limit
+	// Peers maps peer ID to its limit
+	Peers map[string]Limit `json:",omitempty"`
+}
+
+// Limit is an amount of storage, zero fields are unlimited
+type Limit struct {
+	Bytes int64
+	Files int64
+}
+
+// QuotaStatus reports usage and limits of the asking peer and of shares
+type QuotaStatus struct {
+	Peer   string
+	Used   Limit
+	Limit  Limit
+	Shares []ShareQuota `json:",omitempty"`
+}
+
+// ShareQuota is usage and limit of one share
+type ShareQuota struct {
+	Path  string
+	Used  Limit
+	Limit Limit
+}
+
+// Versioning configures how many previous versions of files are kept
+type Versioning struct {
+	// Dir is the local directory versions are kept in
+	Dir string
+	// Keep is the number of versions kept per file, 0 is unlimited
+	Keep int
+	// MaxAge removes versions older than it, 0 keeps them forever
+	MaxAge time.Duration
+}
+
+const (
+	// BackendLocal serves a local directory
+	BackendLocal = "local"
+	// BackendS3 serves a bucket of S3 compatible object storage
+	BackendS3 = "s3"
+)
+
+// Share mounts a storage backend at a remote directory
+type Share struct {
+	// Path is the remote directory the share is mounted at, like /archive
+	Path string
+	// Backend is one of the Backend* constants, default is local
+	Backend string `json:",omitempty"`
+	// Root is the local directory served by local backend
+	Root string `json:",omitempty"`
+	// S3 configures S3 backend
+	S3 *S3Config `json:",omitempty"`
+	// ContentAddressed stores content as deduplicated chunks in the
+	// backend instead of plain files, unreferenced chunks are reclaimed by
+	// p2pftp gc
+	ContentAddressed bool `json:",omitempty"`
+	// Trash moves deleted files into a trash area of the share instead of
+	// removing them
+	Trash *Trash `json:",omitempty"`
+	// Quota limits storage used by the share
+	Quota *Limit `json:",omitempty"`
+}
+
+// Trash configures trash of a share
+type Trash struct {
+	// Retention purges entries older than it, 0 keeps them forever
+	Retention time.Duration
+	// PurgePeers are the peers allowed to delete permanently
+	PurgePeers []string `json:",omitempty"`
+}
+
+// S3Config is the configuration of S3 compatible object storage
+type S3Config struct {
+	// Endpoint is the base URL, like https://s3.amazonaws.com or
+	// http://localhost:9000 for MinIO
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to object keys, so several shares can use one
+	// bucket. The share root is never removed, even if it has a directory
+	// marker.
+	Prefix string `json:",omitempty"`
+	// VirtualHost addresses bucket as subdomain of endpoint instead of the
+	// first path element
+	VirtualHost bool `json:",omitempty"`
+	// PartSize is the multipart upload part size in bytes, uploads larger
+	// than it are split into parts
+	PartSize int64 `json:",omitempty"`
+}
+
+// Status is the network status of a node
+type Status struct {
+	ID            string
+	ListenAddrs   []string
+	ObservedAddrs []string
+	// MappedPorts maps internal listen address to external address
+	// established by UPnP or NAT-PMP
+	MappedPorts map[string]string
+	// BehindNAT tells whether no peer observed node on its local IPs
+	BehindNAT bool
+	// Reachable tells whether node is observed on, or mapped to, any
+	// public address
+	Reachable bool
+	// BootstrapPeers are currently connected bootstrap peers
+	BootstrapPeers []string
+}
+
+const (
+	// StateConnecting is the state before first connection is established
+	StateConnecting = "connecting"
+	// StateConnected means remote peer is connected
+	StateConnected = "connected"
+	// StateReconnecting means connection is lost and being re-established
+	StateReconnecting = "reconnecting"
+)
+
+// ConnectionState describes the connection to remote peer
+type ConnectionState struct {
+	State string
+	// Since is when current state was entered
+	Since time.Time
+	// LastError is the last reconnect error
+	LastError string `json:",omitempty"`
+	// Reconnects counts successful reconnects
+	Reconnects int
+}
+
+// FileInfo describes one remote file
+type FileInfo struct {
+	Name    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	IsDir   bool
+	// Version names a previous version of the file, it is only set when
+	// listing versions
+	Version string `json:",omitempty"`
+}
+
+// Reply is the JSON reply of remote operations
+type Reply struct {
+	Error string       `json:",omitempty"`
+	Files []FileInfo   `json:",omitempty"`
+	Trash []TrashEntry `json:",omitempty"`
+	Quota *QuotaStatus `json:",omitempty"`
+}
+
+// TrashEntry is a file or directory in trash
+type TrashEntry struct {
+	ID string
+	// Path is where it was deleted from
+	Path      string
+	Size      int64
+	IsDir     bool
+	DeletedAt time.Time
+	// DeletedBy is the peer which deleted it, empty if deleted locally
+	DeletedBy string `json:",omitempty"`
 }